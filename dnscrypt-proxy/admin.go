@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+// Names temporarily blocked or allowed using the admin API.
+// They are not stored, and are matched before the rules loaded from files.
+
+type AdminNames struct {
+	sync.RWMutex
+	names map[string]adminNameRule
+}
+
+type adminNameRule struct {
+	expiration time.Time
+	suffix     bool
+}
+
+func NewAdminNames() *AdminNames {
+	return &AdminNames{names: make(map[string]adminNameRule)}
+}
+
+// add registers a name, and its subdomains if suffix is set
+func (adminNames *AdminNames) add(name string, suffix bool, ttl time.Duration) {
+	rule := adminNameRule{suffix: suffix}
+	if ttl > 0 {
+		rule.expiration = time.Now().Add(ttl)
+	}
+	adminNames.Lock()
+	adminNames.names[name] = rule
+	adminNames.Unlock()
+}
+
+func (adminNames *AdminNames) remove(name string) bool {
+	adminNames.Lock()
+	_, found := adminNames.names[name]
+	delete(adminNames.names, name)
+	adminNames.Unlock()
+	return found
+}
+
+// match returns true if the name, or one of its parent domains registered with its subdomains has been registered
+func (adminNames *AdminNames) match(qName string) bool {
+	now := time.Now()
+	adminNames.RLock()
+	defer adminNames.RUnlock()
+	if len(adminNames.names) == 0 {
+		return false
+	}
+	for parent := false; ; parent = true {
+		if rule, found := adminNames.names[qName]; found && (rule.suffix || !parent) && (rule.expiration.IsZero() || rule.expiration.After(now)) {
+			return true
+		}
+		i := strings.IndexByte(qName, '.')
+		if i < 0 {
+			return false
+		}
+		qName = qName[i+1:]
+	}
+}
+
+type AdminNameEntry struct {
+	Name       string     `json:"name"`
+	Suffix     bool       `json:"suffix"`
+	Expiration *time.Time `json:"expiration,omitempty"`
+}
+
+func (adminNames *AdminNames) list() []AdminNameEntry {
+	now := time.Now()
+	entries := make([]AdminNameEntry, 0)
+	adminNames.Lock()
+	for name, rule := range adminNames.names {
+		if rule.expiration.IsZero() {
+			entries = append(entries, AdminNameEntry{Name: name, Suffix: rule.suffix})
+		} else if rule.expiration.After(now) {
+			expiration := rule.expiration
+			entries = append(entries, AdminNameEntry{Name: name, Suffix: rule.suffix, Expiration: &expiration})
+		} else {
+			delete(adminNames.names, name)
+		}
+	}
+	adminNames.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// ---
+
+type PluginAdminNames struct {
+	blockedNames *AdminNames
+	allowedNames *AdminNames
+}
+
+func (plugin *PluginAdminNames) Name() string {
+	return "admin_names"
+}
+
+func (plugin *PluginAdminNames) Description() string {
+	return "Block or allow names registered using the admin API"
+}
+
+func (plugin *PluginAdminNames) Init(proxy *Proxy) error {
+	plugin.blockedNames = proxy.adminBlockedNames
+	plugin.allowedNames = proxy.adminAllowedNames
+	return nil
+}
+
+func (plugin *PluginAdminNames) Drop() error {
+	return nil
+}
+
+func (plugin *PluginAdminNames) Reload() error {
+	return nil
+}
+
+func (plugin *PluginAdminNames) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if pluginsState.sessionData["whitelisted"] != nil {
+		return nil
+	}
+	if plugin.allowedNames.match(pluginsState.qName) {
+		pluginsState.sessionData["whitelisted"] = true
+		return nil
+	}
+	if plugin.blockedNames.match(pluginsState.qName) {
+		pluginsState.action = PluginsActionReject
+		pluginsState.returnCode = PluginsReturnCodeReject
+	}
+	return nil
+}
+
+// ---
+
+type adminHandler struct {
+	proxy *Proxy
+}
+
+type AdminServerSummary struct {
+	Name  string  `json:"name"`
+	Proto string  `json:"proto"`
+	Host  string  `json:"host,omitempty"`
+	RTT   float64 `json:"rtt_ms"`
+}
+
+type adminNameRequest struct {
+	Name   string `json:"name"`
+	Suffix *bool  `json:"suffix"`
+	TTL    int    `json:"ttl"`
+}
+
+// suffix returns whether a request applies to the subdomains of the name, if not explicitly set in the request
+func (nameRequest *adminNameRequest) suffix(defaultSuffix bool) bool {
+	if nameRequest.Suffix == nil {
+		return defaultSuffix
+	}
+	return *nameRequest.Suffix
+}
+
+func adminWriteJSON(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(value)
+}
+
+func adminWriteError(writer http.ResponseWriter, status int, err error) {
+	adminWriteJSON(writer, status, map[string]string{"error": err.Error()})
+}
+
+func adminReadNameRequest(request *http.Request, nameRequired bool) (adminNameRequest, error) {
+	var nameRequest adminNameRequest
+	body, err := ioutil.ReadAll(io.LimitReader(request.Body, MaxHTTPBodyLength))
+	if err != nil {
+		return nameRequest, err
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &nameRequest); err != nil {
+			return nameRequest, err
+		}
+	}
+	if len(nameRequest.Name) == 0 {
+		nameRequest.Name = request.URL.Query().Get("name")
+	}
+	if len(nameRequest.Name) == 0 {
+		if nameRequired {
+			return nameRequest, errors.New("Missing name")
+		}
+		return nameRequest, nil
+	}
+	if nameRequest.Name, err = NormalizeQName(nameRequest.Name); err != nil {
+		return nameRequest, err
+	}
+	if nameRequest.TTL < 0 {
+		return nameRequest, errors.New("Invalid TTL")
+	}
+	return nameRequest, nil
+}
+
+func (handler adminHandler) authorized(request *http.Request) bool {
+	token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(handler.proxy.adminAPIToken)) == 1
+}
+
+func (handler adminHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	proxy := handler.proxy
+	writer.Header().Set("Server", "dnscrypt-proxy")
+	if !handler.authorized(request) {
+		adminWriteError(writer, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	route := request.Method + " " + request.URL.Path
+	switch route {
+	case "GET /servers":
+		summary := make([]AdminServerSummary, 0)
+		proxy.serversInfo.RLock()
+		for _, serverInfo := range proxy.serversInfo.inner {
+			summary = append(summary, AdminServerSummary{
+				Name:  serverInfo.Name,
+				Proto: StampProtoString(serverInfo.Proto),
+				Host:  serverInfo.HostName,
+				RTT:   serverInfo.rtt.Value(),
+			})
+		}
+		proxy.serversInfo.RUnlock()
+		adminWriteJSON(writer, http.StatusOK, summary)
+	case "POST /servers/refresh":
+		liveServers, err := proxy.refreshServers()
+		response := map[string]interface{}{"live_servers": liveServers}
+		if err != nil {
+			response["error"] = err.Error()
+		}
+		adminWriteJSON(writer, http.StatusOK, response)
+	case "POST /cache/flush":
+		nameRequest, err := adminReadNameRequest(request, false)
+		if err != nil {
+			adminWriteError(writer, http.StatusBadRequest, err)
+			return
+		}
+		flushed := cachedResponses.Flush(nameRequest.Name, nameRequest.suffix(false))
+		dlog.Noticef("Admin API: flushed %d cached response(s)", flushed)
+		adminWriteJSON(writer, http.StatusOK, map[string]int{"flushed": flushed})
+	case "POST /cache/save":
+		if len(proxy.cacheFilename) == 0 {
+			adminWriteError(writer, http.StatusConflict, errors.New("No cache file configured"))
+			return
+		}
+		if err := cachedResponses.SaveCache(proxy.cacheFilename); err != nil {
+			adminWriteError(writer, http.StatusInternalServerError, err)
+			return
+		}
+		adminWriteJSON(writer, http.StatusOK, map[string]string{"saved": proxy.cacheFilename})
+	case "POST /rules/reload":
+		proxy.ReloadPlugins()
+		adminWriteJSON(writer, http.StatusOK, map[string]bool{"reloaded": true})
+	case "GET /rules/blocked", "POST /rules/blocked", "DELETE /rules/blocked",
+		"GET /rules/allowed", "POST /rules/allowed", "DELETE /rules/allowed":
+		adminNames := proxy.adminBlockedNames
+		if strings.HasSuffix(request.URL.Path, "/allowed") {
+			adminNames = proxy.adminAllowedNames
+		}
+		if request.Method == "GET" {
+			adminWriteJSON(writer, http.StatusOK, adminNames.list())
+			return
+		}
+		nameRequest, err := adminReadNameRequest(request, true)
+		if err != nil {
+			adminWriteError(writer, http.StatusBadRequest, err)
+			return
+		}
+		if request.Method == "POST" {
+			adminNames.add(nameRequest.Name, nameRequest.suffix(true), time.Duration(nameRequest.TTL)*time.Second)
+			dlog.Noticef("Admin API: added [%s] to %s", nameRequest.Name, request.URL.Path)
+		} else if !adminNames.remove(nameRequest.Name) {
+			adminWriteError(writer, http.StatusNotFound, errors.New("Name not found"))
+			return
+		} else {
+			dlog.Noticef("Admin API: removed [%s] from %s", nameRequest.Name, request.URL.Path)
+		}
+		adminWriteJSON(writer, http.StatusOK, adminNames.list())
+	default:
+		adminWriteError(writer, http.StatusNotFound, errors.New("Not found"))
+	}
+}
+
+func (proxy *Proxy) startAdminAPIListener() {
+	var listener net.Listener
+	var err error
+	listenAddress := proxy.adminAPIListenAddress
+	if strings.HasPrefix(listenAddress, "/") {
+		if fileInfo, statErr := os.Lstat(listenAddress); statErr == nil {
+			if fileInfo.Mode()&os.ModeSocket == 0 {
+				dlog.Fatalf("Unable to start the admin API listener: [%s] already exists and is not a socket", listenAddress)
+			}
+			os.Remove(listenAddress)
+		}
+		listener, err = net.Listen("unix", listenAddress)
+		if err == nil {
+			err = os.Chmod(listenAddress, 0600)
+		}
+	} else {
+		listener, err = net.Listen("tcp", listenAddress)
+		if err == nil {
+			if tcpAddr, ok := listener.Addr().(*net.TCPAddr); ok && !tcpAddr.IP.IsLoopback() {
+				dlog.Warnf("The admin API is reachable from other hosts [%v]", listenAddress)
+			}
+		}
+	}
+	if err != nil {
+		dlog.Fatalf("Unable to start the admin API listener: %v", err)
+	}
+	dlog.Noticef("Now listening to %v [admin API]", listenAddress)
+	go func() {
+		if err := http.Serve(listener, adminHandler{proxy: proxy}); err != nil {
+			dlog.Errorf("Admin API listener: %v", err)
+		}
+	}()
+}
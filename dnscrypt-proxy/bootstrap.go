@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	stamps "github.com/jedisct1/go-dnsstamps"
+	"github.com/miekg/dns"
+)
+
+const (
+	BootstrapMaxServers = 4
+)
+
+// Encrypted bootstrap resolves the host names of DoH servers, relays and sources through live
+// servers that can be reached without resolving any name: DNSCrypt servers, and DoH servers whose
+// IP address is part of the stamp. An address is only accepted once two servers, run by different
+// providers, have returned it.
+
+// bootstrapServers returns the servers that can be used for bootstrapping, in random order,
+// with a single server per provider
+func (proxy *Proxy) bootstrapServers() []*ServerInfo {
+	var servers []*ServerInfo
+	proxy.serversInfo.RLock()
+	for _, serverInfo := range proxy.serversInfo.inner {
+		if proxy.bootstrapServerAddr(serverInfo) != "" {
+			servers = append(servers, serverInfo)
+		}
+	}
+	proxy.serversInfo.RUnlock()
+	rand.Shuffle(len(servers), func(i, j int) {
+		servers[i], servers[j] = servers[j], servers[i]
+	})
+	providers := make(map[string]bool)
+	uniqueServers := servers[:0]
+	for _, serverInfo := range servers {
+		if provider := bootstrapProvider(serverInfo); !providers[provider] {
+			providers[provider] = true
+			uniqueServers = append(uniqueServers, serverInfo)
+		}
+	}
+	return uniqueServers
+}
+
+// bootstrapProvider returns the name of the provider running a server, so that servers run by the
+// same provider, even at different IP addresses, count as a single vote
+func bootstrapProvider(serverInfo *ServerInfo) string {
+	host, _ := ExtractHostAndPort(serverInfo.HostName, -1)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if serverInfo.Proto == stamps.StampProtoTypeDNSCrypt {
+		host = strings.TrimPrefix(host, "2.dnscrypt-cert.")
+	}
+	if len(host) == 0 {
+		return serverInfo.Name
+	}
+	return host
+}
+
+func isBootstrapStamp(stamp stamps.ServerStamp) bool {
+	switch stamp.Proto {
+	case stamps.StampProtoTypeDNSCrypt:
+		return true
+	case stamps.StampProtoTypeDoH:
+		ipOnly, _ := ExtractHostAndPort(stamp.ServerAddrStr, -1)
+		return ParseIP(ipOnly) != nil
+	}
+	return false
+}
+
+// bootstrapServerAddr returns the IP address a server is reached at, or "" if it cannot be used for bootstrapping
+func (proxy *Proxy) bootstrapServerAddr(serverInfo *ServerInfo) string {
+	switch serverInfo.Proto {
+	case stamps.StampProtoTypeDNSCrypt:
+		return serverInfo.UDPAddr.IP.String()
+	case stamps.StampProtoTypeDoH:
+		if ip := proxy.xTransport.pinnedIP(serverInfo.HostName); ip != nil {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+func (proxy *Proxy) resolveUsingServer(serverInfo *ServerInfo, host string, qType uint16, timeout time.Duration) ([]net.IP, time.Duration, error) {
+	msg := dns.Msg{}
+	msg.SetQuestion(dns.Fqdn(host), qType)
+	msg.SetEdns0(uint16(MaxDNSPacketSize), false)
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	// Truncated DNSCrypt responses are retried over TCP
+	response, _, err := proxy.exchangeWithServer(serverInfo, query, "udp", timeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	in := dns.Msg{}
+	if err := in.Unpack(response); err != nil {
+		return nil, 0, err
+	}
+	if in.Truncated {
+		return nil, 0, errors.New("Truncated response")
+	}
+	if in.Rcode != dns.RcodeSuccess {
+		return nil, 0, errors.New(dns.RcodeToString[in.Rcode])
+	}
+	var ips []net.IP
+	var ttl time.Duration
+	for _, answer := range in.Answer {
+		var ip net.IP
+		switch rr := answer.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if rrTTL := time.Duration(answer.Header().Ttl) * time.Second; len(ips) == 0 || rrTTL < ttl {
+			ttl = rrTTL
+		}
+		ips = append(ips, ip)
+	}
+	return ips, ttl, nil
+}
+
+type bootstrapResult struct {
+	serverInfo *ServerInfo
+	ips        []net.IP
+	ttl        time.Duration
+	err        error
+}
+
+// resolveEncrypted queries up to BootstrapMaxServers live servers in parallel, and returns as soon as two of them agree
+func (proxy *Proxy) resolveEncrypted(host string) (net.IP, time.Duration, error) {
+	servers := proxy.bootstrapServers()
+	if len(servers) < 2 {
+		return nil, 0, errors.New("Not enough live DNSCrypt or IP-pinned DoH servers")
+	}
+	if len(servers) > BootstrapMaxServers {
+		servers = servers[:BootstrapMaxServers]
+	}
+	var qTypes []uint16
+	if proxy.xTransport.useIPv4 {
+		qTypes = append(qTypes, dns.TypeA)
+	}
+	if proxy.xTransport.useIPv6 {
+		qTypes = append(qTypes, dns.TypeAAAA)
+	}
+	timeout := proxy.timeout
+	results := make(chan bootstrapResult, len(servers)*len(qTypes))
+	for _, qType := range qTypes {
+		for _, serverInfo := range servers {
+			go func(serverInfo *ServerInfo, qType uint16) {
+				ips, ttl, err := proxy.resolveUsingServer(serverInfo, host, qType, timeout)
+				results <- bootstrapResult{serverInfo: serverInfo, ips: ips, ttl: ttl, err: err}
+			}(serverInfo, qType)
+		}
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	votes := make(map[string]map[string]bool)
+	ttls := make(map[string]time.Duration)
+	for pending := cap(results); pending > 0; pending-- {
+		var result bootstrapResult
+		select {
+		case result = <-results:
+		case <-deadline.C:
+			return nil, 0, errors.New("Timeout while waiting for live servers to agree")
+		}
+		if result.err != nil {
+			dlog.Debugf("Unable to resolve [%s] using [%s]: %v", host, result.serverInfo.Name, result.err)
+			continue
+		}
+		provider := bootstrapProvider(result.serverInfo)
+		for _, ip := range result.ips {
+			ipStr := ip.String()
+			if votes[ipStr] == nil {
+				votes[ipStr] = make(map[string]bool)
+			}
+			votes[ipStr][provider] = true
+			if previousTTL, ok := ttls[ipStr]; !ok || result.ttl < previousTTL {
+				ttls[ipStr] = result.ttl
+			}
+			if len(votes[ipStr]) >= 2 {
+				dlog.Debugf("[%s] resolved to [%s] using encrypted servers", host, ipStr)
+				return ip, ttls[ipStr], nil
+			}
+		}
+	}
+	return nil, 0, errors.New("Live servers didn't return the same address")
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/miekg/dns"
+)
+
+const cacheCommandUsage = `Usage: dnscrypt-proxy cache <command> [options] [cache file...]
+
+Commands:
+  list    print the entries of cache files, as JSON or as zone file text
+  delete  remove entries from a cache file
+  merge   merge cache files into a new one; for identical entries, the one expiring last is kept
+
+Without file names, the cache_filename and cache_extra_filenames files of the configuration are used.
+The name and expiration filters select the entries to print, delete or merge.
+`
+
+// A CacheEntry is a response read from a cache file
+
+type CacheEntry struct {
+	savedResponse *SavedResponse
+	msg           *dns.Msg
+}
+
+type CacheEntryFilter struct {
+	name    string
+	suffix  bool
+	expired bool
+	valid   bool
+}
+
+func (filter *CacheEntryFilter) isSet() bool {
+	return len(filter.name) > 0 || filter.expired || filter.valid
+}
+
+func (filter *CacheEntryFilter) match(entry *CacheEntry, now time.Time) bool {
+	expired := !entry.savedResponse.Expiration.After(now)
+	if (filter.expired && !expired) || (filter.valid && expired) {
+		return false
+	}
+	if len(filter.name) == 0 {
+		return true
+	}
+	if len(entry.msg.Question) == 0 {
+		return false
+	}
+	qName, err := NormalizeQName(entry.msg.Question[0].Name)
+	if err != nil {
+		return false
+	}
+	return qName == filter.name || (filter.suffix && strings.HasSuffix(qName, "."+filter.name))
+}
+
+// CacheCommand runs the `cache` subcommand, that inspects and edits cache files without running the proxy
+func CacheCommand(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, cacheCommandUsage)
+		return errors.New("Missing cache command")
+	}
+	command := args[0]
+	if command != "list" && command != "delete" && command != "merge" {
+		fmt.Fprint(os.Stderr, cacheCommandUsage)
+		return fmt.Errorf("Unknown cache command [%s]", command)
+	}
+	flagSet := flag.NewFlagSet("cache "+command, flag.ContinueOnError)
+	flagSet.Usage = func() {
+		fmt.Fprint(os.Stderr, cacheCommandUsage+"\nOptions:\n")
+		flagSet.PrintDefaults()
+	}
+	configFile := flagSet.String("config", DefaultConfigFileName, "Path to the configuration file")
+	format := flagSet.String("format", "json", "output format of the list command: json or zone")
+	output := flagSet.String("output", "", "file to write; the delete command rewrites its input file by default")
+	filter := CacheEntryFilter{}
+	flagSet.StringVar(&filter.name, "name", "", "only consider entries for this name")
+	flagSet.BoolVar(&filter.suffix, "suffix", false, "also consider the subdomains of -name")
+	flagSet.BoolVar(&filter.expired, "expired", false, "only consider expired entries")
+	flagSet.BoolVar(&filter.valid, "valid", false, "only consider entries that haven't expired yet")
+	if err := flagSet.Parse(args[1:]); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(filter.name) > 0 {
+		name, err := NormalizeQName(filter.name)
+		if err != nil {
+			return err
+		}
+		filter.name = name
+	}
+	if len(*output) > 0 {
+		absOutput, err := filepath.Abs(*output)
+		if err != nil {
+			return err
+		}
+		*output = absOutput
+	}
+	fileNames := flagSet.Args()
+	if len(fileNames) == 0 {
+		var err error
+		if fileNames, err = configCacheFileNames(configFile); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+
+	switch command {
+	case "list":
+		entries, err := readCacheEntries(fileNames, &filter, now)
+		if err != nil {
+			return err
+		}
+		return printCacheEntries(os.Stdout, entries, *format, now)
+	case "delete":
+		if len(fileNames) != 1 {
+			return errors.New("The delete command requires a single cache file")
+		}
+		if !filter.isSet() {
+			return errors.New("The delete command requires -name, -expired or -valid")
+		}
+		entries, err := readCacheEntries(fileNames, nil, now)
+		if err != nil {
+			return err
+		}
+		kept := entries[:0]
+		for _, entry := range entries {
+			if !filter.match(entry, now) {
+				kept = append(kept, entry)
+			}
+		}
+		if len(*output) == 0 {
+			*output = fileNames[0]
+		}
+		fmt.Fprintf(os.Stderr, "Deleted %d of %d entries\n", len(entries)-len(kept), len(entries))
+		return writeCacheEntries(*output, kept)
+	case "merge":
+		if len(*output) == 0 {
+			return errors.New("The merge command requires -output")
+		}
+		entries, err := readCacheEntries(fileNames, &filter, now)
+		if err != nil {
+			return err
+		}
+		merged := make(map[[32]byte]*CacheEntry)
+		var keys [][32]byte
+		for _, entry := range entries {
+			cacheKey := entry.savedResponse.cacheKey(entry.msg)
+			previous, found := merged[cacheKey]
+			if !found {
+				keys = append(keys, cacheKey)
+			}
+			if !found || entry.savedResponse.Expiration.After(previous.savedResponse.Expiration) {
+				merged[cacheKey] = entry
+			}
+		}
+		mergedEntries := make([]*CacheEntry, 0, len(keys))
+		for _, cacheKey := range keys {
+			mergedEntries = append(mergedEntries, merged[cacheKey])
+		}
+		fmt.Fprintf(os.Stderr, "Merged %d entries from %d files into %d entries\n", len(entries), len(fileNames), len(mergedEntries))
+		return writeCacheEntries(*output, mergedEntries)
+	}
+	return nil
+}
+
+// configCacheFileNames returns the cache files of a configuration file, relative to its directory
+func configCacheFileNames(configFile *string) ([]string, error) {
+	foundConfigFile, err := findConfigFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load the configuration file [%s] -- Maybe use the -config command-line switch?", *configFile)
+	}
+	config := newConfig()
+	if _, err := toml.DecodeFile(foundConfigFile, &config); err != nil {
+		return nil, err
+	}
+	var fileNames []string
+	for _, fileName := range append([]string{config.CacheFilename}, config.ExtraCacheFiles...) {
+		if len(fileName) == 0 {
+			continue
+		}
+		if !filepath.IsAbs(fileName) {
+			fileName = filepath.Join(filepath.Dir(foundConfigFile), fileName)
+		}
+		fileNames = append(fileNames, fileName)
+	}
+	if len(fileNames) == 0 {
+		return nil, errors.New("No cache files configured")
+	}
+	return fileNames, nil
+}
+
+func readCacheEntries(fileNames []string, filter *CacheEntryFilter, now time.Time) ([]*CacheEntry, error) {
+	var entries []*CacheEntry
+	for _, fileName := range fileNames {
+		cacheFile, err := OpenCacheFile(fileName)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read the cache file [%s]: %v", fileName, err)
+		}
+		for {
+			savedResponse, msg, err := cacheFile.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				cacheFile.Close()
+				return nil, fmt.Errorf("Unable to read the cache file [%s]: %v", fileName, err)
+			}
+			entry := CacheEntry{savedResponse: savedResponse, msg: msg}
+			if filter == nil || filter.match(&entry, now) {
+				entries = append(entries, &entry)
+			}
+		}
+		cacheFile.Close()
+	}
+	return entries, nil
+}
+
+func writeCacheEntries(fileName string, entries []*CacheEntry) error {
+	itemsSize := 0
+	for _, entry := range entries {
+		itemsSize += len(entry.savedResponse.Packet)
+	}
+	cacheFile, err := CreateCacheFile(fileName, len(entries), itemsSize)
+	if err != nil {
+		return err
+	}
+	defer cacheFile.Close()
+	for _, entry := range entries {
+		if err := cacheFile.Write(entry.savedResponse); err != nil {
+			return err
+		}
+	}
+	return cacheFile.Commit()
+}
+
+type CacheEntryJSON struct {
+	Name       string    `json:"name"`
+	Type       string    `json:"type"`
+	Rcode      string    `json:"rcode"`
+	Expiration time.Time `json:"expiration"`
+	TTL        int64     `json:"ttl"`
+	Frequent   bool      `json:"frequent"`
+	Size       int       `json:"size"`
+	Key        string    `json:"key"`
+	Records    []string  `json:"records"`
+}
+
+func printCacheEntries(writer io.Writer, entries []*CacheEntry, format string, now time.Time) error {
+	switch format {
+	case "json":
+		list := make([]CacheEntryJSON, 0, len(entries))
+		for _, entry := range entries {
+			entryJSON := CacheEntryJSON{
+				Rcode:      dns.RcodeToString[entry.msg.Rcode],
+				Expiration: entry.savedResponse.Expiration,
+				TTL:        int64(entry.savedResponse.Expiration.Sub(now) / time.Second),
+				Frequent:   entry.savedResponse.Frequent,
+				Size:       len(entry.savedResponse.Packet),
+				Records:    []string{},
+			}
+			cacheKey := entry.savedResponse.cacheKey(entry.msg)
+			entryJSON.Key = hex.EncodeToString(cacheKey[:])
+			if len(entry.msg.Question) > 0 {
+				entryJSON.Name = entry.msg.Question[0].Name
+				entryJSON.Type = dns.TypeToString[entry.msg.Question[0].Qtype]
+			}
+			for _, rr := range cacheEntryRecords(entry, now) {
+				entryJSON.Records = append(entryJSON.Records, rr.String())
+			}
+			list = append(list, entryJSON)
+		}
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(list)
+	case "zone":
+		for _, entry := range entries {
+			if len(entry.msg.Question) > 0 {
+				question := entry.msg.Question[0]
+				fmt.Fprintf(writer, "; %s %s %s expires=%s size=%d\n", question.Name, dns.TypeToString[question.Qtype],
+					dns.RcodeToString[entry.msg.Rcode], entry.savedResponse.Expiration.Format(time.RFC3339), len(entry.savedResponse.Packet))
+			}
+			for _, rr := range cacheEntryRecords(entry, now) {
+				fmt.Fprintln(writer, rr.String())
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unsupported output format [%s]", format)
+	}
+}
+
+// cacheEntryRecords returns the answer and authority records of an entry, with their remaining TTL
+func cacheEntryRecords(entry *CacheEntry, now time.Time) []dns.RR {
+	ttl := uint32(Max(0, int(entry.savedResponse.Expiration.Sub(now)/time.Second)))
+	var rrs []dns.RR
+	for _, rr := range append(append([]dns.RR{}, entry.msg.Answer...), entry.msg.Ns...) {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			rr = dns.Copy(rr)
+			rr.Header().Ttl = ttl
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
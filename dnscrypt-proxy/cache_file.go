@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+
+	"github.com/dchest/safefile"
+	"github.com/miekg/dns"
+)
+
+// A cache file is a JSON header line, followed by gob-encoded SavedResponse entries.
+// Since version 2, entries are gzip-compressed, and followed by a trailer: a magic string
+// and the SHA-256 checksum of everything before it.
+
+const (
+	CacheFileProtoVersion = 2
+	CacheFileTrailerMagic = "DCPC"
+)
+
+type SavedResponse struct {
+	Expiration time.Time
+	Frequent   bool
+	Packet     []byte
+	Key        [32]byte
+}
+
+// cacheKey returns the key the response was cached with. Files saved by previous versions don't include it.
+func (savedResponse *SavedResponse) cacheKey(msg *dns.Msg) [32]byte {
+	if savedResponse.Key != [32]byte{} {
+		return savedResponse.Key
+	}
+	return computeCacheKey(nil, msg)
+}
+
+type CacheFileHeader struct {
+	Description      string    `json:"description"`
+	AppName          string    `json:"app_name"`
+	AppVersion       string    `json:"app_version"`
+	ProtoVersion     uint32    `json:"proto_version"`
+	TimeSaved        time.Time `json:"time_saved"`
+	ItemsCount       int       `json:"items_count"`
+	ItemsSize        int       `json:"items_size"`
+	OriginalLocation string    `json:"original_location"`
+	Compressed       bool      `json:"compressed"`
+	Links            []string  `json:"links"`
+}
+
+type CacheFileReader struct {
+	header     CacheFileHeader
+	file       *os.File
+	gzipReader *gzip.Reader
+	dec        *gob.Decoder
+}
+
+func OpenCacheFile(cacheFilename string) (*CacheFileReader, error) {
+	file, err := os.Open(cacheFilename)
+	if err != nil {
+		return nil, err
+	}
+	cacheFile := CacheFileReader{file: file}
+	if err := cacheFile.open(cacheFilename); err != nil {
+		cacheFile.Close()
+		return nil, err
+	}
+	return &cacheFile, nil
+}
+
+func (cacheFile *CacheFileReader) open(cacheFilename string) error {
+	reader := bufio.NewReader(cacheFile.file)
+	jsonBuf, _ := reader.ReadBytes('\n')
+	if err := json.Unmarshal(jsonBuf, &cacheFile.header); err != nil {
+		return err
+	}
+	switch cacheFile.header.ProtoVersion {
+	case 1:
+		cacheFile.dec = gob.NewDecoder(reader)
+	case CacheFileProtoVersion:
+		body, err := cacheFileBody(cacheFile.file, jsonBuf)
+		if err != nil {
+			return fmt.Errorf("Corrupted cache file [%s]: %v", cacheFilename, err)
+		}
+		if cacheFile.gzipReader, err = gzip.NewReader(bufio.NewReader(body)); err != nil {
+			return err
+		}
+		cacheFile.dec = gob.NewDecoder(cacheFile.gzipReader)
+	default:
+		return fmt.Errorf("unknown protocol version [%d]", cacheFile.header.ProtoVersion)
+	}
+	return nil
+}
+
+// Next returns the next saved response and its parsed message, or io.EOF
+func (cacheFile *CacheFileReader) Next() (*SavedResponse, *dns.Msg, error) {
+	// Gob doesn't encode zero values, so a previous entry must not be reused
+	var savedResponse SavedResponse
+	if err := cacheFile.dec.Decode(&savedResponse); err != nil {
+		return nil, nil, err
+	}
+	msg := dns.Msg{}
+	if err := msg.Unpack(savedResponse.Packet); err != nil {
+		return nil, nil, err
+	}
+	return &savedResponse, &msg, nil
+}
+
+func (cacheFile *CacheFileReader) Close() error {
+	if cacheFile.gzipReader != nil {
+		cacheFile.gzipReader.Close()
+	}
+	return cacheFile.file.Close()
+}
+
+// cacheFileBody checks the trailer of a v2 cache file, and returns the compressed entries
+func cacheFileBody(loadFile *os.File, headerBuf []byte) (io.Reader, error) {
+	fileInfo, err := loadFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	bodyLen := fileInfo.Size() - int64(len(headerBuf)) - int64(len(CacheFileTrailerMagic)+sha256.Size)
+	if bodyLen < 0 {
+		return nil, errors.New("truncated file")
+	}
+	trailer := make([]byte, len(CacheFileTrailerMagic)+sha256.Size)
+	if _, err := loadFile.ReadAt(trailer, fileInfo.Size()-int64(len(trailer))); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(trailer[:len(CacheFileTrailerMagic)], []byte(CacheFileTrailerMagic)) {
+		return nil, errors.New("missing trailer")
+	}
+	h := sha256.New()
+	h.Write(headerBuf)
+	if _, err := io.Copy(h, io.NewSectionReader(loadFile, int64(len(headerBuf)), bodyLen)); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(h.Sum(nil), trailer[len(CacheFileTrailerMagic):]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return io.NewSectionReader(loadFile, int64(len(headerBuf)), bodyLen), nil
+}
+
+// A CacheFileWriter streams entries to a temporary file, that replaces the previous file once committed
+
+type CacheFileWriter struct {
+	saveFile   *safefile.File
+	fileWriter *bufio.Writer
+	h          hash.Hash
+	gzipWriter *gzip.Writer
+	enc        *gob.Encoder
+}
+
+func CreateCacheFile(cacheFilename string, itemsCount int, itemsSize int) (*CacheFileWriter, error) {
+	header := CacheFileHeader{
+		AppName:          "dnscrypt-proxy-home",
+		AppVersion:       AppVersion,
+		ProtoVersion:     CacheFileProtoVersion,
+		TimeSaved:        time.Now(),
+		OriginalLocation: cacheFilename,
+		ItemsCount:       itemsCount,
+		ItemsSize:        itemsSize,
+		Compressed:       true,
+		Description:      "This is a file with saved cache of dnscrypt-proxy-home app. All data after the first line is binary (gzip-compressed golang encoding/gob), followed by a SHA-256 checksum",
+		Links:            []string{"https://github.com/antonme/dnscrypt-proxy-home", "https://github.com/DNSCrypt/dnscrypt-proxy"},
+	}
+	saveFile, err := safefile.Create(cacheFilename, 0644)
+	if err != nil {
+		return nil, err
+	}
+	cacheFile := CacheFileWriter{saveFile: saveFile, fileWriter: bufio.NewWriter(saveFile), h: sha256.New()}
+	writer := io.MultiWriter(cacheFile.fileWriter, cacheFile.h)
+	if err := json.NewEncoder(writer).Encode(header); err != nil {
+		saveFile.Close()
+		return nil, err
+	}
+	cacheFile.gzipWriter = gzip.NewWriter(writer)
+	cacheFile.enc = gob.NewEncoder(cacheFile.gzipWriter)
+	return &cacheFile, nil
+}
+
+func (cacheFile *CacheFileWriter) Write(savedResponse *SavedResponse) error {
+	return cacheFile.enc.Encode(savedResponse)
+}
+
+func (cacheFile *CacheFileWriter) Commit() error {
+	if err := cacheFile.gzipWriter.Close(); err != nil {
+		return err
+	}
+	if _, err := cacheFile.fileWriter.Write(append([]byte(CacheFileTrailerMagic), cacheFile.h.Sum(nil)...)); err != nil {
+		return err
+	}
+	if err := cacheFile.fileWriter.Flush(); err != nil {
+		return err
+	}
+	return cacheFile.saveFile.Commit()
+}
+
+// Close removes the temporary file if the new file was not committed
+func (cacheFile *CacheFileWriter) Close() error {
+	return cacheFile.saveFile.Close()
+}
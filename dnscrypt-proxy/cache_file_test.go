@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/powerman/check"
+)
+
+func cacheFileTestEntries(t *testing.T) []SavedResponse {
+	var entries []SavedResponse
+	for i, name := range []string{"example.com.", "example.net."} {
+		msg := dns.Msg{}
+		msg.SetQuestion(name, dns.TypeA)
+		msg.Response = true
+		packet, err := msg.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, SavedResponse{
+			Expiration: time.Now().Add(time.Hour).Round(0),
+			Frequent:   i == 0,
+			Packet:     packet,
+			Key:        sha256.Sum256([]byte(name)),
+		})
+	}
+	return entries
+}
+
+func writeCacheFileTest(t *testing.T, fileName string, entries []SavedResponse) {
+	cacheFile, err := CreateCacheFile(fileName, len(entries), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cacheFile.Close()
+	for i := range entries {
+		if err := cacheFile.Write(&entries[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cacheFile.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readCacheFileTest(fileName string) (*CacheFileHeader, []SavedResponse, error) {
+	cacheFile, err := OpenCacheFile(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cacheFile.Close()
+	var entries []SavedResponse
+	for {
+		savedResponse, _, err := cacheFile.Next()
+		if err == io.EOF {
+			return &cacheFile.header, entries, nil
+		} else if err != nil {
+			return &cacheFile.header, entries, err
+		}
+		entries = append(entries, *savedResponse)
+	}
+}
+
+func TestCacheFile(t *testing.T) {
+	dir := t.TempDir()
+	entries := cacheFileTestEntries(t)
+	fileName := filepath.Join(dir, "cache.bin")
+	writeCacheFileTest(t, fileName, entries)
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("format", func(t *testing.T) {
+		c := check.T(t)
+		headerLen := bytes.IndexByte(content, '\n') + 1
+		c.Must(c.True(headerLen > 0, "Missing header"))
+		var header CacheFileHeader
+		c.Nil(json.Unmarshal(content[:headerLen], &header))
+		c.EQ(header.ProtoVersion, uint32(CacheFileProtoVersion))
+		c.True(header.Compressed)
+		c.EQ(header.ItemsCount, len(entries))
+		trailerLen := len(CacheFileTrailerMagic) + sha256.Size
+		c.Must(c.True(len(content) > headerLen+trailerLen, "File too short"))
+		c.DeepEqual(content[headerLen:headerLen+2], []byte{0x1f, 0x8b}, "Body is not gzip-compressed")
+		trailer := content[len(content)-trailerLen:]
+		c.Equal(string(trailer[:len(CacheFileTrailerMagic)]), CacheFileTrailerMagic)
+		checksum := sha256.Sum256(content[:len(content)-trailerLen])
+		c.DeepEqual(trailer[len(CacheFileTrailerMagic):], checksum[:])
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		c := check.T(t)
+		_, got, err := readCacheFileTest(fileName)
+		c.Nil(err)
+		c.DeepEqual(got, entries)
+	})
+
+	t.Run("v1", func(t *testing.T) {
+		c := check.T(t)
+		v1FileName := filepath.Join(dir, "cache-v1.bin")
+		buf := bytes.Buffer{}
+		c.Nil(json.NewEncoder(&buf).Encode(CacheFileHeader{ProtoVersion: 1, ItemsCount: len(entries)}))
+		enc := gob.NewEncoder(&buf)
+		for _, entry := range entries {
+			// Version 1 entries don't have a key
+			c.Nil(enc.Encode(struct {
+				Expiration time.Time
+				Frequent   bool
+				Packet     []byte
+			}{entry.Expiration, entry.Frequent, entry.Packet}))
+		}
+		c.Nil(os.WriteFile(v1FileName, buf.Bytes(), 0644))
+		header, got, err := readCacheFileTest(v1FileName)
+		c.Nil(err)
+		c.EQ(header.ProtoVersion, uint32(1))
+		c.Must(c.Len(got, len(entries)))
+		for i := range got {
+			c.Equal(got[i].Key, [32]byte{})
+			c.DeepEqual(got[i].Packet, entries[i].Packet)
+			msg := dns.Msg{}
+			c.Nil(msg.Unpack(got[i].Packet))
+			c.Equal(got[i].cacheKey(&msg), computeCacheKey(nil, &msg))
+		}
+		c.Equal(entries[0].cacheKey(nil), entries[0].Key)
+	})
+
+	corrupted := append([]byte{}, content...)
+	corrupted[len(corrupted)-len(CacheFileTrailerMagic)-sha256.Size-1] ^= 0xff
+	for _, tt := range []struct {
+		name    string
+		content []byte
+		err     string
+	}{
+		{"truncated", content[:len(content)-8], "missing trailer"},
+		{"truncated trailer", content[:bytes.IndexByte(content, '\n')+8], "truncated file"},
+		{"corrupted", corrupted, "checksum mismatch"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := check.T(t)
+			badFileName := filepath.Join(dir, "cache-"+tt.name+".bin")
+			c.Nil(os.WriteFile(badFileName, tt.content, 0644))
+			_, _, err := readCacheFileTest(badFileName)
+			c.Match(err, tt.err)
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	PrefetchInterval = 1 * time.Second
+	PrefetchLeadTime = 10 * time.Second
+	PrefetchClient   = "prefetch"
+)
+
+// A PrefetchEntry counts the hits of a cached response, until the response expires or is refreshed
+
+type PrefetchEntry struct {
+	query       []byte
+	clientAddr  *net.Addr
+	hits        int
+	expiration  time.Time
+	prefetching bool
+}
+
+// Hits are tracked in shards that match the cache shards, so that cache hits don't contend on a single lock
+
+type PrefetchShard struct {
+	sync.Mutex
+	entries map[[32]byte]*PrefetchEntry
+}
+
+// CachePrefetcher refreshes popular cached responses shortly before they expire.
+// At most `budget` queries are sent every minute, the most popular entries first.
+
+type CachePrefetcher struct {
+	sync.Mutex
+	shards      [CacheShardsCount]PrefetchShard
+	maxEntries  int
+	minHits     int
+	budget      int
+	spent       int
+	windowStart time.Time
+}
+
+func NewCachePrefetcher(maxEntries int, minHits int, budget int) *CachePrefetcher {
+	prefetcher := CachePrefetcher{
+		maxEntries: Max(1, (maxEntries+CacheShardsCount-1)/CacheShardsCount),
+		minHits:    Max(1, minHits),
+		budget:     budget,
+	}
+	for i := range prefetcher.shards {
+		prefetcher.shards[i].entries = make(map[[32]byte]*PrefetchEntry)
+	}
+	return &prefetcher
+}
+
+func (prefetcher *CachePrefetcher) noticeHit(cacheKey [32]byte, expiration time.Time, pluginsState *PluginsState) {
+	if prefetcher == nil || len(pluginsState.rawQuery) == 0 {
+		return
+	}
+	shard := &prefetcher.shards[cacheShardIndex(cacheKey)]
+	shard.Lock()
+	defer shard.Unlock()
+	entry := shard.entries[cacheKey]
+	if entry == nil {
+		if len(shard.entries) >= prefetcher.maxEntries {
+			return
+		}
+		entry = &PrefetchEntry{
+			query:      append([]byte{}, pluginsState.rawQuery...),
+			clientAddr: pluginsState.clientAddr,
+		}
+		shard.entries[cacheKey] = entry
+	}
+	if !entry.expiration.Equal(expiration) {
+		entry.expiration, entry.hits = expiration, 0
+	}
+	entry.hits++
+}
+
+type prefetchCandidate struct {
+	cacheKey [32]byte
+	entry    *PrefetchEntry
+	hits     int
+}
+
+// candidates returns the entries to refresh now, within the remaining budget
+func (prefetcher *CachePrefetcher) candidates(now time.Time) []prefetchCandidate {
+	var candidates []prefetchCandidate
+	for i := range prefetcher.shards {
+		shard := &prefetcher.shards[i]
+		shard.Lock()
+		for cacheKey, entry := range shard.entries {
+			if now.After(entry.expiration) {
+				delete(shard.entries, cacheKey)
+				continue
+			}
+			if !entry.prefetching && entry.hits >= prefetcher.minHits && entry.expiration.Sub(now) <= PrefetchLeadTime {
+				candidates = append(candidates, prefetchCandidate{cacheKey: cacheKey, entry: entry, hits: entry.hits})
+			}
+		}
+		shard.Unlock()
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].hits > candidates[j].hits
+	})
+
+	prefetcher.Lock()
+	if now.Sub(prefetcher.windowStart) >= time.Minute {
+		prefetcher.windowStart, prefetcher.spent = now, 0
+	}
+	if remaining := Max(0, prefetcher.budget-prefetcher.spent); len(candidates) > remaining {
+		dlog.Debugf("Prefetch budget exhausted -- Skipping %d popular responses", len(candidates)-remaining)
+		candidates = candidates[:remaining]
+	}
+	prefetcher.spent += len(candidates)
+	prefetcher.Unlock()
+
+	for _, candidate := range candidates {
+		shard := &prefetcher.shards[cacheShardIndex(candidate.cacheKey)]
+		shard.Lock()
+		candidate.entry.prefetching = true
+		shard.Unlock()
+	}
+	return candidates
+}
+
+func (prefetcher *CachePrefetcher) run(proxy *Proxy) {
+	for {
+		time.Sleep(PrefetchInterval)
+		for _, candidate := range prefetcher.candidates(time.Now()) {
+			go func(cacheKey [32]byte, entry *PrefetchEntry) {
+				proxy.processIncomingQueryEx(PrefetchClient, proxy.mainProto, entry.query, entry.clientAddr, nil, time.Now(), false)
+				shard := &prefetcher.shards[cacheShardIndex(cacheKey)]
+				shard.Lock()
+				delete(shard.entries, cacheKey)
+				shard.Unlock()
+			}(candidate.cacheKey, candidate.entry)
+		}
+	}
+}
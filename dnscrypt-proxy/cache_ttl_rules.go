@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+// A CacheTTLRule overrides the global cache TTL limits for the names matching a pattern.
+// Limits that are not set keep their global value.
+
+type CacheTTLRule struct {
+	minTTL    *uint32
+	maxTTL    *uint32
+	negMinTTL *uint32
+	negMaxTTL *uint32
+	noCache   bool
+}
+
+// CacheTTLRules holds the rules of a pattern: a rule for any query type, and rules for specific types
+
+type CacheTTLRules struct {
+	anyType *CacheTTLRule
+	qTypes  map[uint16]*CacheTTLRule
+	lineNo  int
+}
+
+func (rules *CacheTTLRules) lookup(qType uint16) *CacheTTLRule {
+	if rule, ok := rules.qTypes[qType]; ok {
+		return rule
+	}
+	return rules.anyType
+}
+
+// limits returns the TTL limits to apply, given the global ones.
+// A limit set by the rule takes precedence over a conflicting global limit.
+func (rule *CacheTTLRule) limits(minTTL, maxTTL, negMinTTL, negMaxTTL uint32) (uint32, uint32, uint32, uint32) {
+	if rule == nil {
+		return minTTL, maxTTL, negMinTTL, negMaxTTL
+	}
+	if rule.minTTL != nil {
+		minTTL = *rule.minTTL
+	}
+	if rule.maxTTL != nil {
+		maxTTL = *rule.maxTTL
+		if rule.minTTL == nil && minTTL > maxTTL {
+			minTTL = maxTTL
+		}
+	}
+	if rule.minTTL != nil && maxTTL < minTTL {
+		maxTTL = minTTL
+	}
+	if rule.negMinTTL != nil {
+		negMinTTL = *rule.negMinTTL
+	}
+	if rule.negMaxTTL != nil {
+		negMaxTTL = *rule.negMaxTTL
+		if rule.negMinTTL == nil && negMinTTL > negMaxTTL {
+			negMinTTL = negMaxTTL
+		}
+	}
+	if rule.negMinTTL != nil && negMaxTTL < negMinTTL {
+		negMaxTTL = negMinTTL
+	}
+	return minTTL, maxTTL, negMinTTL, negMaxTTL
+}
+
+func lookupCacheTTLRule(patternMatcher *PatternMatcher, qName string, qType uint16) *CacheTTLRule {
+	if patternMatcher == nil {
+		return nil
+	}
+	_, _, xrules := patternMatcher.Eval(qName)
+	if xrules == nil {
+		return nil
+	}
+	return xrules.(*CacheTTLRules).lookup(qType)
+}
+
+// loadCacheTTLRules reads lines such as `*.example.com [qtype] min=60 max=600 neg_min=5 neg_max=30 nocache`
+func loadCacheTTLRules(fileName string) (*PatternMatcher, error) {
+	bin, err := ReadTextFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	allRules := make(map[string]*CacheTTLRules)
+	for lineNo, line := range strings.Split(string(bin), "\n") {
+		line = TrimAndStripInlineComments(line)
+		if len(line) == 0 {
+			continue
+		}
+		parts := strings.FieldsFunc(line, unicode.IsSpace)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("Syntax error in cache TTL rules at line %d -- Missing TTL settings", 1+lineNo)
+		}
+		pattern, settings := strings.ToLower(parts[0]), parts[1:]
+		qType, hasQType := uint16(0), false
+		if qTypeValue, ok := dns.StringToType[strings.ToUpper(settings[0])]; ok {
+			qType, hasQType, settings = qTypeValue, true, settings[1:]
+		}
+		rule := CacheTTLRule{}
+		for _, setting := range settings {
+			if strings.ToLower(setting) == "nocache" {
+				rule.noCache = true
+				continue
+			}
+			keyValue := strings.SplitN(setting, "=", 2)
+			if len(keyValue) != 2 {
+				return nil, fmt.Errorf("Syntax error in cache TTL rules at line %d -- Unexpected [%s]", 1+lineNo, setting)
+			}
+			key, value := keyValue[0], keyValue[1]
+			ttl, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid TTL in cache TTL rules at line %d: [%s]", 1+lineNo, value)
+			}
+			ttl32 := uint32(ttl)
+			switch strings.ToLower(key) {
+			case "min":
+				rule.minTTL = &ttl32
+			case "max":
+				rule.maxTTL = &ttl32
+			case "neg_min":
+				rule.negMinTTL = &ttl32
+			case "neg_max":
+				rule.negMaxTTL = &ttl32
+			default:
+				return nil, fmt.Errorf("Unknown setting in cache TTL rules at line %d: [%s]", 1+lineNo, key)
+			}
+		}
+		rules, found := allRules[pattern]
+		if !found {
+			rules = &CacheTTLRules{qTypes: make(map[uint16]*CacheTTLRule), lineNo: 1 + lineNo}
+			allRules[pattern] = rules
+		}
+		if hasQType {
+			rules.qTypes[qType] = &rule
+		} else {
+			rules.anyType = &rule
+		}
+	}
+	patternMatcher := NewPatternMatcher()
+	for pattern, rules := range allRules {
+		if err := patternMatcher.Add(pattern, rules, rules.lineNo); err != nil {
+			return nil, err
+		}
+	}
+	dlog.Noticef("Loaded %d cache TTL rules from [%s]", len(allRules), fileName)
+	return patternMatcher, nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	DHCPLeasesCheckInterval = 10 * time.Second
+)
+
+// A ClientGroup overrides the global rules for a set of clients.
+// Rule files set to nil are inherited from the global configuration,
+// and rule files set to an empty string disable the corresponding plugin.
+
+type ClientGroup struct {
+	name              string
+	networks          []*net.IPNet
+	macs              map[string]bool
+	listenAddresses   map[string]bool
+	serverNames       []string
+	allWeeklyRanges   *map[string]WeeklyRanges
+	blockNameFile     *string
+	whitelistNameFile *string
+	cloakFile         *string
+
+	blockedNames            *BlockedNames
+	whitelistPatternMatcher *PatternMatcher
+	cloakPatternMatcher     *PatternMatcher
+}
+
+type ClientGroups struct {
+	groups []*ClientGroup
+	leases *DHCPLeases
+}
+
+func NewClientGroups(config map[string]ClientGroupConfig, globalWeeklyRanges map[string]WeeklyRangesStr, leasesFile string) (*ClientGroups, error) {
+	clientGroups := ClientGroups{}
+	if len(leasesFile) > 0 {
+		clientGroups.leases = &DHCPLeases{fileName: leasesFile}
+	}
+	for name, groupConfig := range config {
+		group := ClientGroup{
+			name:              name,
+			macs:              make(map[string]bool),
+			listenAddresses:   make(map[string]bool),
+			serverNames:       groupConfig.ServerNames,
+			blockNameFile:     groupConfig.BlockedNamesFile,
+			whitelistNameFile: groupConfig.AllowedNamesFile,
+			cloakFile:         groupConfig.CloakingRules,
+		}
+		for _, cidr := range groupConfig.CIDRs {
+			if !strings.Contains(cidr, "/") {
+				if ip := ParseIP(cidr); ip != nil && ip.To4() != nil {
+					cidr = cidr + "/32"
+				} else {
+					cidr = cidr + "/128"
+				}
+			}
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("Client group [%s]: invalid network [%s]", name, cidr)
+			}
+			group.networks = append(group.networks, network)
+		}
+		for _, macStr := range groupConfig.MACs {
+			mac, err := net.ParseMAC(macStr)
+			if err != nil {
+				return nil, fmt.Errorf("Client group [%s]: invalid MAC address [%s]", name, macStr)
+			}
+			group.macs[mac.String()] = true
+		}
+		if len(group.macs) > 0 && clientGroups.leases == nil {
+			return nil, fmt.Errorf("Client group [%s]: MAC addresses require `dhcp_leases_file` to be set", name)
+		}
+		for _, listenAddrStr := range groupConfig.ListenAddresses {
+			listenAddr, err := net.ResolveTCPAddr("tcp", listenAddrStr)
+			if err != nil {
+				return nil, fmt.Errorf("Client group [%s]: invalid listen address [%s]", name, listenAddrStr)
+			}
+			group.listenAddresses[listenAddr.String()] = true
+		}
+		allWeeklyRangesStr := make(map[string]WeeklyRangesStr)
+		for weeklyRangesName, weeklyRangesStr := range globalWeeklyRanges {
+			allWeeklyRangesStr[weeklyRangesName] = weeklyRangesStr
+		}
+		for weeklyRangesName, weeklyRangesStr := range groupConfig.Schedules {
+			allWeeklyRangesStr[weeklyRangesName] = weeklyRangesStr
+		}
+		allWeeklyRanges, err := ParseAllWeeklyRanges(allWeeklyRangesStr)
+		if err != nil {
+			return nil, fmt.Errorf("Client group [%s]: %v", name, err)
+		}
+		group.allWeeklyRanges = allWeeklyRanges
+		clientGroups.groups = append(clientGroups.groups, &group)
+	}
+	sort.Slice(clientGroups.groups, func(i, j int) bool {
+		return clientGroups.groups[i].name < clientGroups.groups[j].name
+	})
+	return &clientGroups, nil
+}
+
+// hasOwnPolicy tells whether a group uses its own servers or rules files, so that its clients
+// can get different responses than other clients
+func (group *ClientGroup) hasOwnPolicy() bool {
+	return len(group.serverNames) > 0 || group.blockNameFile != nil || group.whitelistNameFile != nil || group.cloakFile != nil
+}
+
+// match returns the group of a client, if any.
+// A MAC address takes precedence over the most specific network, which takes precedence over the listen address.
+func (clientGroups *ClientGroups) match(clientAddr *net.Addr, clientPc net.Conn) *ClientGroup {
+	if clientGroups == nil || clientAddr == nil {
+		return nil
+	}
+	clientIP := ExtractClientIP(clientAddr)
+	if clientIP == nil {
+		return nil
+	}
+	if clientGroups.leases != nil {
+		if mac := clientGroups.leases.lookup(clientIP); len(mac) > 0 {
+			for _, group := range clientGroups.groups {
+				if group.macs[mac] {
+					return group
+				}
+			}
+		}
+	}
+	var bestGroup *ClientGroup
+	bestPrefixLen := -1
+	for _, group := range clientGroups.groups {
+		for _, network := range group.networks {
+			if prefixLen, _ := network.Mask.Size(); prefixLen > bestPrefixLen && network.Contains(clientIP) {
+				bestGroup, bestPrefixLen = group, prefixLen
+			}
+		}
+	}
+	if bestGroup != nil || clientPc == nil {
+		return bestGroup
+	}
+	localAddr := clientPc.LocalAddr()
+	if localAddr == nil {
+		return nil
+	}
+	var listenAddrStr string
+	switch addr := localAddr.(type) {
+	case *net.UDPAddr:
+		listenAddrStr = (&net.TCPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}).String()
+	default:
+		listenAddrStr = addr.String()
+	}
+	for _, group := range clientGroups.groups {
+		if group.listenAddresses[listenAddrStr] {
+			return group
+		}
+	}
+	return nil
+}
+
+func (proxy *Proxy) isRegisteredServer(name string) bool {
+	for _, registeredServer := range proxy.registeredServers {
+		if registeredServer.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (clientGroups *ClientGroups) list() []*ClientGroup {
+	if clientGroups == nil {
+		return nil
+	}
+	return clientGroups.groups
+}
+
+func (clientGroups *ClientGroups) hasFiles(fileOf func(group *ClientGroup) *string) bool {
+	if clientGroups == nil {
+		return false
+	}
+	for _, group := range clientGroups.groups {
+		if fileName := fileOf(group); fileName != nil && len(*fileName) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ---
+
+// DHCPLeases maps IP addresses to MAC addresses, using a dnsmasq leases file:
+// <expiration> <MAC address> <IP address> <host name> <client id>
+
+type DHCPLeases struct {
+	sync.Mutex
+	fileName  string
+	macs      map[string]string
+	lastCheck time.Time
+	modTime   time.Time
+	size      int64
+}
+
+func (leases *DHCPLeases) load() {
+	fileInfo, err := os.Stat(leases.fileName)
+	if err != nil {
+		dlog.Warnf("Unable to read the DHCP leases file [%s]: %v", leases.fileName, err)
+		return
+	}
+	if fileInfo.ModTime().Equal(leases.modTime) && fileInfo.Size() == leases.size {
+		return
+	}
+	bin, err := ReadTextFile(leases.fileName)
+	if err != nil {
+		dlog.Warnf("Unable to read the DHCP leases file [%s]: %v", leases.fileName, err)
+		return
+	}
+	macs := make(map[string]string)
+	for _, line := range strings.Split(bin, "\n") {
+		parts := strings.Fields(line)
+		if len(parts) < 3 {
+			continue
+		}
+		mac, err := net.ParseMAC(parts[1])
+		if err != nil {
+			continue
+		}
+		ip := ParseIP(parts[2])
+		if ip == nil {
+			continue
+		}
+		macs[ip.String()] = mac.String()
+	}
+	leases.macs = macs
+	leases.modTime, leases.size = fileInfo.ModTime(), fileInfo.Size()
+	dlog.Debugf("Loaded %d DHCP lease(s) from [%s]", len(macs), leases.fileName)
+}
+
+func (leases *DHCPLeases) lookup(ip net.IP) string {
+	leases.Lock()
+	defer leases.Unlock()
+	if now := time.Now(); now.Sub(leases.lastCheck) >= DHCPLeasesCheckInterval {
+		leases.lastCheck = now
+		leases.load()
+	}
+	return leases.macs[ip.String()]
+}
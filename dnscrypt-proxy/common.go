@@ -169,6 +169,19 @@ func ExtractHostAndPort(str string, defaultPort int) (host string, port int) {
 	return
 }
 
+func ExtractClientIP(clientAddr *net.Addr) net.IP {
+	if clientAddr == nil {
+		return nil
+	}
+	switch addr := (*clientAddr).(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
 func ReadTextFile(filename string) (string, error) {
 	bin, err := ioutil.ReadFile(filename)
 	if err != nil {
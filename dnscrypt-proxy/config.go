@@ -28,91 +28,119 @@
 )
 
 type Config struct {
-	LogLevel                 int                         `toml:"log_level"`
-	LogFile                  *string                     `toml:"log_file"`
-	LogFileLatest            bool                        `toml:"log_file_latest"`
-	UseSyslog                bool                        `toml:"use_syslog"`
-	ServerNames              []string                    `toml:"server_names"`
-	DisabledServerNames      []string                    `toml:"disabled_server_names"`
-	ListenAddresses          []string                    `toml:"listen_addresses"`
-	LocalDoH                 LocalDoHConfig              `toml:"local_doh"`
-	Daemonize                bool                        ``
-	UserName                 string                      `toml:"user_name"`
-	ForceTCP                 bool                        `toml:"force_tcp"`
-	Timeout                  int                         `toml:"timeout"`
-	KeepAlive                int                         `toml:"keepalive"`
-	Proxy                    string                      `toml:"proxy"`
-	CertRefreshDelay         int                         `toml:"cert_refresh_delay"`
-	CertIgnoreTimestamp      bool                        `toml:"cert_ignore_timestamp"`
-	EphemeralKeys            bool                        `toml:"dnscrypt_ephemeral_keys"`
-	LBStrategy               string                      `toml:"lb_strategy"`
-	LBEstimator              bool                        `toml:"lb_estimator"`
-	BlockIPv6                bool                        `toml:"block_ipv6"`
-	BlockUnqualified         bool                        `toml:"block_unqualified"`
-	BlockUndelegated         bool                        `toml:"block_undelegated"`
-	Cache                    bool                        `toml:"cache"`
-	CacheForced              bool                        `toml:"cache_forced"`
-	CachePersistent          bool                        `toml:"cache_persistent"`
-	CacheFilename            string                      `toml:"cache_filename"`
-	ExtraCacheFiles          []string                    `toml:"cache_extra_filenames"`
-	CacheAutoSave            uint32                      `toml:"cache_autosave_interval"`
-	CacheAutoSaveMinutes     uint32                      `toml:"cache_autosave_interval_minutes"`
-	CacheAutoSaveHours       uint32                      `toml:"cache_autosave_interval_hours"`
-	CacheFlushEnabled        bool                        `toml:"cache_flush_command"`
-	CacheSize                int                         `toml:"cache_size"`
-	CacheNegTTL              uint32                      `toml:"cache_neg_ttl"`
-	CacheNegMinTTL           uint32                      `toml:"cache_neg_min_ttl"`
-	CacheNegMaxTTL           uint32                      `toml:"cache_neg_max_ttl"`
-	CacheMinTTL              uint32                      `toml:"cache_min_ttl"`
-	CacheMaxTTL              uint32                      `toml:"cache_max_ttl"`
-	CacheForcedMaxTTL        uint32                      `toml:"cache_forced_max_ttl"`
-	CacheForcedMaxTTLHours   uint32                      `toml:"cache_forced_max_ttl_hours"`
-	CacheForcedMaxTTLDays    uint32                      `toml:"cache_forced_max_ttl_days"`
-	RejectTTL                uint32                      `toml:"reject_ttl"`
-	CloakTTL                 uint32                      `toml:"cloak_ttl"`
-	QueryLog                 QueryLogConfig              `toml:"query_log"`
-	NxLog                    NxLogConfig                 `toml:"nx_log"`
-	BlockName                BlockNameConfig             `toml:"blocked_names"`
-	BlockNameLegacy          BlockNameConfigLegacy       `toml:"blacklist"`
-	WhitelistNameLegacy      WhitelistNameConfigLegacy   `toml:"whitelist"`
-	AllowedName              AllowedNameConfig           `toml:"allowed_names"`
-	BlockIP                  BlockIPConfig               `toml:"blocked_ips"`
-	BlockIPLegacy            BlockIPConfigLegacy         `toml:"ip_blacklist"`
-	ForwardFile              string                      `toml:"forwarding_rules"`
-	CloakFile                string                      `toml:"cloaking_rules"`
-	CaptivePortalFile        string                      `toml:"captive_portal_handler"`
-	StaticsConfig            map[string]StaticConfig     `toml:"static"`
-	SourcesConfig            map[string]SourceConfig     `toml:"sources"`
-	BrokenImplementations    BrokenImplementationsConfig `toml:"broken_implementations"`
-	SourceRequireDNSSEC      bool                        `toml:"require_dnssec"`
-	SourceRequireNoLog       bool                        `toml:"require_nolog"`
-	SourceRequireNoFilter    bool                        `toml:"require_nofilter"`
-	SourceDNSCrypt           bool                        `toml:"dnscrypt_servers"`
-	SourceDoH                bool                        `toml:"doh_servers"`
-	SourceIPv4               bool                        `toml:"ipv4_servers"`
-	SourceIPv6               bool                        `toml:"ipv6_servers"`
-	MaxClients               uint32                      `toml:"max_clients"`
-	FallbackResolver         string                      `toml:"fallback_resolver"`
-	FallbackResolvers        []string                    `toml:"fallback_resolvers"`
-	IgnoreSystemDNS          bool                        `toml:"ignore_system_dns"`
-	AllWeeklyRanges          map[string]WeeklyRangesStr  `toml:"schedules"`
-	LogMaxSize               int                         `toml:"log_files_max_size"`
-	LogMaxAge                int                         `toml:"log_files_max_age"`
-	LogMaxBackups            int                         `toml:"log_files_max_backups"`
-	TLSDisableSessionTickets bool                        `toml:"tls_disable_session_tickets"`
-	TLSCipherSuite           []uint16                    `toml:"tls_cipher_suite"`
-	NetprobeAddress          string                      `toml:"netprobe_address"`
-	NetprobeTimeout          int                         `toml:"netprobe_timeout"`
-	OfflineMode              bool                        `toml:"offline_mode"`
-	HTTPProxyURL             string                      `toml:"http_proxy"`
-	RefusedCodeInResponses   bool                        `toml:"refused_code_in_responses"`
-	BlockedQueryResponse     string                      `toml:"blocked_query_response"`
-	QueryMeta                []string                    `toml:"query_meta"`
-	AnonymizedDNS            AnonymizedDNSConfig         `toml:"anonymized_dns"`
-	DoHClientX509Auth        DoHClientX509AuthConfig     `toml:"doh_client_x509_auth"`
-	DoHClientX509AuthLegacy  DoHClientX509AuthConfig     `toml:"tls_client_auth"`
-	DNS64                    DNS64Config                 `toml:"dns64"`
-	EDNSClientSubnet         []string                    `toml:"edns_client_subnet"`
+	LogLevel                 int                          `toml:"log_level"`
+	LogFile                  *string                      `toml:"log_file"`
+	LogFileLatest            bool                         `toml:"log_file_latest"`
+	UseSyslog                bool                         `toml:"use_syslog"`
+	ServerNames              []string                     `toml:"server_names"`
+	DisabledServerNames      []string                     `toml:"disabled_server_names"`
+	ListenAddresses          []string                     `toml:"listen_addresses"`
+	LocalDoH                 LocalDoHConfig               `toml:"local_doh"`
+	Metrics                  MetricsConfig                `toml:"metrics"`
+	AdminAPI                 AdminAPIConfig               `toml:"admin_api"`
+	Plugins                  PluginsConfig                `toml:"plugins"`
+	Daemonize                bool                         ``
+	UserName                 string                       `toml:"user_name"`
+	ForceTCP                 bool                         `toml:"force_tcp"`
+	Timeout                  int                          `toml:"timeout"`
+	UpstreamRetries          int                          `toml:"upstream_retries"`
+	ClientDeadline           int                          `toml:"client_deadline"`
+	KeepAlive                int                          `toml:"keepalive"`
+	Proxy                    string                       `toml:"proxy"`
+	CertRefreshDelay         int                          `toml:"cert_refresh_delay"`
+	CertIgnoreTimestamp      bool                         `toml:"cert_ignore_timestamp"`
+	EphemeralKeys            bool                         `toml:"dnscrypt_ephemeral_keys"`
+	LBStrategy               string                       `toml:"lb_strategy"`
+	LBEstimator              bool                         `toml:"lb_estimator"`
+	LBRaceHedgeDelay         int                          `toml:"lb_race_hedge_delay"`
+	BlockIPv6                bool                         `toml:"block_ipv6"`
+	BlockUnqualified         bool                         `toml:"block_unqualified"`
+	BlockUndelegated         bool                         `toml:"block_undelegated"`
+	DNSSECValidation         bool                         `toml:"dnssec_validation"`
+	DNSSECTrustAnchors       []string                     `toml:"dnssec_trust_anchors"`
+	Cache                    bool                         `toml:"cache"`
+	CacheForced              bool                         `toml:"cache_forced"`
+	CachePersistent          bool                         `toml:"cache_persistent"`
+	CacheFilename            string                       `toml:"cache_filename"`
+	ExtraCacheFiles          []string                     `toml:"cache_extra_filenames"`
+	CacheAutoSave            uint32                       `toml:"cache_autosave_interval"`
+	CacheAutoSaveMinutes     uint32                       `toml:"cache_autosave_interval_minutes"`
+	CacheAutoSaveHours       uint32                       `toml:"cache_autosave_interval_hours"`
+	CacheFlushEnabled        bool                         `toml:"cache_flush_command"`
+	CacheSize                int                          `toml:"cache_size"`
+	CacheMaxMemory           int                          `toml:"cache_max_memory"`
+	CacheTTLRulesFile        string                       `toml:"cache_ttl_rules"`
+	CacheNegTTL              uint32                       `toml:"cache_neg_ttl"`
+	CacheNegMinTTL           uint32                       `toml:"cache_neg_min_ttl"`
+	CacheNegMaxTTL           uint32                       `toml:"cache_neg_max_ttl"`
+	CacheMinTTL              uint32                       `toml:"cache_min_ttl"`
+	CacheMaxTTL              uint32                       `toml:"cache_max_ttl"`
+	CacheForcedMaxTTL        uint32                       `toml:"cache_forced_max_ttl"`
+	CacheForcedMaxTTLHours   uint32                       `toml:"cache_forced_max_ttl_hours"`
+	CacheForcedMaxTTLDays    uint32                       `toml:"cache_forced_max_ttl_days"`
+	CachePrefetchBudget      int                          `toml:"cache_prefetch_budget"`
+	CachePrefetchMinHits     int                          `toml:"cache_prefetch_min_hits"`
+	StaleAnswerClientTimeout int                          `toml:"stale_answer_client_timeout"`
+	StaleAnswerTTL           int                          `toml:"stale_answer_ttl"`
+	StaleAnswerMaxAge        int                          `toml:"stale_answer_max_age"`
+	RejectTTL                uint32                       `toml:"reject_ttl"`
+	CloakTTL                 uint32                       `toml:"cloak_ttl"`
+	QueryLog                 QueryLogConfig               `toml:"query_log"`
+	NxLog                    NxLogConfig                  `toml:"nx_log"`
+	BlockName                BlockNameConfig              `toml:"blocked_names"`
+	BlockNameLegacy          BlockNameConfigLegacy        `toml:"blacklist"`
+	WhitelistNameLegacy      WhitelistNameConfigLegacy    `toml:"whitelist"`
+	AllowedName              AllowedNameConfig            `toml:"allowed_names"`
+	BlockIP                  BlockIPConfig                `toml:"blocked_ips"`
+	BlockIPLegacy            BlockIPConfigLegacy          `toml:"ip_blacklist"`
+	ForwardFile              string                       `toml:"forwarding_rules"`
+	CloakFile                string                       `toml:"cloaking_rules"`
+	CaptivePortalFile        string                       `toml:"captive_portal_handler"`
+	ReloadRulesOnChange      bool                         `toml:"reload_rules_on_change"`
+	StaticsConfig            map[string]StaticConfig      `toml:"static"`
+	SourcesConfig            map[string]SourceConfig      `toml:"sources"`
+	BrokenImplementations    BrokenImplementationsConfig  `toml:"broken_implementations"`
+	SourceRequireDNSSEC      bool                         `toml:"require_dnssec"`
+	SourceRequireNoLog       bool                         `toml:"require_nolog"`
+	SourceRequireNoFilter    bool                         `toml:"require_nofilter"`
+	SourceDNSCrypt           bool                         `toml:"dnscrypt_servers"`
+	SourceDoH                bool                         `toml:"doh_servers"`
+	SourceDoT                bool                         `toml:"dot_servers"`
+	SourceDoQ                bool                         `toml:"doq_servers"`
+	SourceODoH               bool                         `toml:"odoh_servers"`
+	SourceIPv4               bool                         `toml:"ipv4_servers"`
+	SourceIPv6               bool                         `toml:"ipv6_servers"`
+	MaxClients               uint32                       `toml:"max_clients"`
+	FallbackResolver         string                       `toml:"fallback_resolver"`
+	FallbackResolvers        []string                     `toml:"fallback_resolvers"`
+	IgnoreSystemDNS          bool                         `toml:"ignore_system_dns"`
+	EncryptedBootstrap       bool                         `toml:"encrypted_bootstrap"`
+	AllWeeklyRanges          map[string]WeeklyRangesStr   `toml:"schedules"`
+	ClientGroups             map[string]ClientGroupConfig `toml:"client_groups"`
+	DHCPLeasesFile           string                       `toml:"dhcp_leases_file"`
+	LogMaxSize               int                          `toml:"log_files_max_size"`
+	LogMaxAge                int                          `toml:"log_files_max_age"`
+	LogMaxBackups            int                          `toml:"log_files_max_backups"`
+	TLSDisableSessionTickets bool                         `toml:"tls_disable_session_tickets"`
+	TLSCipherSuite           []uint16                     `toml:"tls_cipher_suite"`
+	HTTP3                    bool                         `toml:"http3"`
+	HTTP3ServerNames         []string                     `toml:"http3_server_names"`
+	NetprobeAddress          string                       `toml:"netprobe_address"`
+	NetprobeTimeout          int                          `toml:"netprobe_timeout"`
+	OfflineMode              bool                         `toml:"offline_mode"`
+	HTTPProxyURL             string                       `toml:"http_proxy"`
+	RefusedCodeInResponses   bool                         `toml:"refused_code_in_responses"`
+	BlockedQueryResponse     string                       `toml:"blocked_query_response"`
+	QueryMeta                []string                     `toml:"query_meta"`
+	AnonymizedDNS            AnonymizedDNSConfig          `toml:"anonymized_dns"`
+	DoHClientX509Auth        DoHClientX509AuthConfig      `toml:"doh_client_x509_auth"`
+	DoHClientX509AuthLegacy  DoHClientX509AuthConfig      `toml:"tls_client_auth"`
+	DNS64                    DNS64Config                  `toml:"dns64"`
+	EDNSClientSubnet         []string                     `toml:"edns_client_subnet"`
+	EDNSClientSubnetMode     string                       `toml:"edns_client_subnet_mode"`
+	EDNSClientSubnetPrefixV4 int                          `toml:"edns_client_subnet_prefix_v4"`
+	EDNSClientSubnetPrefixV6 int                          `toml:"edns_client_subnet_prefix_v6"`
+	EDNSClientSubnetPolicy   string                       `toml:"edns_client_subnet_policy"`
 }
 
 func newConfig() Config {
@@ -121,6 +149,7 @@ func newConfig() Config {
 		LogFileLatest:            true,
 		ListenAddresses:          []string{"127.0.0.1:53"},
 		LocalDoH:                 LocalDoHConfig{Path: "/dns-query"},
+		Metrics:                  MetricsConfig{Path: "/metrics"},
 		Timeout:                  5000,
 		KeepAlive:                5,
 		CertRefreshDelay:         240,
@@ -141,6 +170,11 @@ func newConfig() Config {
 		CacheForcedMaxTTL:        0,
 		CacheForcedMaxTTLHours:   0,
 		CacheForcedMaxTTLDays:    0,
+		CachePrefetchBudget:      0,
+		CachePrefetchMinHits:     3,
+		StaleAnswerClientTimeout: 0,
+		StaleAnswerTTL:           30,
+		StaleAnswerMaxAge:        86400,
 		RejectTTL:                600,
 		CloakTTL:                 600,
 		SourceRequireNoLog:       true,
@@ -149,6 +183,9 @@ func newConfig() Config {
 		SourceIPv6:               false,
 		SourceDNSCrypt:           true,
 		SourceDoH:                true,
+		SourceDoT:                false,
+		SourceDoQ:                false,
+		SourceODoH:               false,
 		MaxClients:               250,
 		FallbackResolvers:        []string{DefaultFallbackResolver},
 		IgnoreSystemDNS:          false,
@@ -162,6 +199,8 @@ func newConfig() Config {
 		RefusedCodeInResponses:   false,
 		LBEstimator:              true,
 		BlockedQueryResponse:     "hinfo",
+		EDNSClientSubnetPrefixV4: 24,
+		EDNSClientSubnetPrefixV6: 56,
 		BrokenImplementations: BrokenImplementationsConfig{
 			FragmentsBlocked: []string{
 				"cisco", "cisco-ipv6", "cisco-familyshield", "cisco-familyshield-ipv6",
@@ -189,6 +228,7 @@ type QueryLogConfig struct {
 	File          string
 	Format        string
 	IgnoredQtypes []string `toml:"ignored_qtypes"`
+	LogRetries    bool     `toml:"log_retries"`
 }
 
 type NxLogConfig struct {
@@ -255,6 +295,33 @@ type LocalDoHConfig struct {
 	CertKeyFile     string   `toml:"cert_key_file"`
 }
 
+type MetricsConfig struct {
+	ListenAddress string `toml:"listen_address"`
+	Path          string `toml:"path"`
+}
+
+type AdminAPIConfig struct {
+	ListenAddress string `toml:"listen_address"`
+	Token         string `toml:"token"`
+}
+
+type PluginsConfig struct {
+	Query    []string `toml:"query"`
+	Response []string `toml:"response"`
+	Logging  []string `toml:"logging"`
+}
+
+type ClientGroupConfig struct {
+	CIDRs            []string                   `toml:"cidr"`
+	MACs             []string                   `toml:"mac"`
+	ListenAddresses  []string                   `toml:"listen_addresses"`
+	ServerNames      []string                   `toml:"server_names"`
+	BlockedNamesFile *string                    `toml:"blocked_names_file"`
+	AllowedNamesFile *string                    `toml:"allowed_names_file"`
+	CloakingRules    *string                    `toml:"cloaking_rules"`
+	Schedules        map[string]WeeklyRangesStr `toml:"schedules"`
+}
+
 type ServerSummary struct {
 	Name        string   `json:"name"`
 	Proto       string   `json:"proto"`
@@ -269,10 +336,12 @@ type ServerSummary struct {
 }
 
 type TLSClientAuthCredsConfig struct {
-	ServerName string `toml:"server_name"`
-	ClientCert string `toml:"client_cert"`
-	ClientKey  string `toml:"client_key"`
-	RootCA     string `toml:"root_ca"`
+	ServerName     string   `toml:"server_name"`
+	ClientCert     string   `toml:"client_cert"`
+	ClientKey      string   `toml:"client_key"`
+	RootCA         string   `toml:"root_ca"`
+	TLSServerName  string   `toml:"tls_server_name"`
+	TLSCipherSuite []uint16 `toml:"tls_cipher_suite"`
 }
 
 type DoHClientX509AuthConfig struct {
@@ -361,6 +430,8 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 	proxy.xTransport = NewXTransport()
 	proxy.xTransport.tlsDisableSessionTickets = config.TLSDisableSessionTickets
 	proxy.xTransport.tlsCipherSuite = config.TLSCipherSuite
+	proxy.xTransport.http3 = config.HTTP3
+	proxy.xTransport.http3ServerNames = config.HTTP3ServerNames
 	proxy.xTransport.mainProto = proxy.mainProto
 	if len(config.FallbackResolver) > 0 {
 		config.FallbackResolvers = []string{config.FallbackResolver}
@@ -374,6 +445,9 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 		proxy.xTransport.ignoreSystemDNS = config.IgnoreSystemDNS
 	}
 	proxy.xTransport.fallbackResolvers = config.FallbackResolvers
+	if config.EncryptedBootstrap {
+		proxy.xTransport.encryptedBootstrap = proxy.resolveEncrypted
+	}
 	proxy.xTransport.useIPv4 = config.SourceIPv4
 	proxy.xTransport.useIPv6 = config.SourceIPv6
 	proxy.xTransport.keepAlive = time.Duration(config.KeepAlive) * time.Second
@@ -397,6 +471,11 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 		proxy.xTransport.proxyDialer = &proxyDialer
 		proxy.mainProto = "tcp"
 	}
+	if (config.HTTP3 || len(config.HTTP3ServerNames) > 0) && (proxy.xTransport.proxyDialer != nil || proxy.xTransport.httpProxyFunction != nil) {
+		dlog.Notice("HTTP/3 cannot be used through a proxy - Using HTTP/2 instead")
+		proxy.xTransport.http3 = false
+		proxy.xTransport.http3ServerNames = nil
+	}
 
 	proxy.xTransport.rebuildTransport()
 
@@ -410,6 +489,8 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 	}
 	proxy.blockedQueryResponse = config.BlockedQueryResponse
 	proxy.timeout = time.Duration(config.Timeout) * time.Millisecond
+	proxy.upstreamRetries = Max(0, config.UpstreamRetries)
+	proxy.clientDeadline = time.Duration(Max(config.Timeout, config.ClientDeadline)) * time.Millisecond
 	proxy.maxClients = config.MaxClients
 	proxy.mainProto = "udp"
 	if config.ForceTCP {
@@ -435,8 +516,17 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 		lbStrategy = LBStrategyFirst{}
 	case "random":
 		lbStrategy = LBStrategyRandom{}
+	case "race":
+		lbStrategy = LBStrategyRace{count: DefaultLBRaceCount}
 	default:
-		if strings.HasPrefix(lbStrategyStr, "p") {
+		if strings.HasPrefix(lbStrategyStr, "race") {
+			n, err := strconv.ParseInt(strings.TrimPrefix(lbStrategyStr, "race"), 10, 32)
+			if err != nil || n <= 0 {
+				dlog.Warnf("Invalid load balancing strategy: [%s]", config.LBStrategy)
+			} else {
+				lbStrategy = LBStrategyRace{count: int(n)}
+			}
+		} else if strings.HasPrefix(lbStrategyStr, "p") {
 			n, err := strconv.ParseInt(strings.TrimPrefix(lbStrategyStr, "p"), 10, 32)
 			if err != nil || n <= 0 {
 				dlog.Warnf("Invalid load balancing strategy: [%s]", config.LBStrategy)
@@ -447,6 +537,10 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 			dlog.Warnf("Unknown load balancing strategy: [%s]", config.LBStrategy)
 		}
 	}
+	if raceStrategy, ok := lbStrategy.(LBStrategyRace); ok {
+		raceStrategy.hedgeDelay = time.Duration(Max(0, config.LBRaceHedgeDelay)) * time.Millisecond
+		lbStrategy = raceStrategy
+	}
 	proxy.serversInfo.lbStrategy = lbStrategy
 	proxy.serversInfo.lbEstimator = config.LBEstimator
 
@@ -458,10 +552,29 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 	proxy.localDoHPath = config.LocalDoH.Path
 	proxy.localDoHCertFile = config.LocalDoH.CertFile
 	proxy.localDoHCertKeyFile = config.LocalDoH.CertKeyFile
+	if len(config.Metrics.ListenAddress) > 0 {
+		if len(config.Metrics.Path) == 0 || config.Metrics.Path[0] != '/' {
+			return fmt.Errorf("metrics: [%s] cannot be a valid URL path. Read the documentation", config.Metrics.Path)
+		}
+		proxy.metrics = NewMetrics()
+		proxy.metricsListenAddress = config.Metrics.ListenAddress
+		proxy.metricsPath = config.Metrics.Path
+	}
+	if len(config.AdminAPI.ListenAddress) > 0 {
+		if len(config.AdminAPI.Token) < 16 {
+			return errors.New("admin API: a token of at least 16 characters is required")
+		}
+		proxy.adminAPIListenAddress = config.AdminAPI.ListenAddress
+		proxy.adminAPIToken = config.AdminAPI.Token
+		proxy.adminBlockedNames = NewAdminNames()
+		proxy.adminAllowedNames = NewAdminNames()
+	}
 	proxy.daemonize = config.Daemonize
 	proxy.pluginBlockIPv6 = config.BlockIPv6
 	proxy.pluginBlockUnqualified = config.BlockUnqualified
 	proxy.pluginBlockUndelegated = config.BlockUndelegated
+	proxy.dnssecValidation = config.DNSSECValidation
+	proxy.dnssecTrustAnchors = config.DNSSECTrustAnchors
 
 	proxy.cache = config.Cache
 	proxy.cacheFilename = config.CacheFilename
@@ -469,6 +582,8 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 	proxy.cacheForced = config.CacheForced
 	proxy.cachePersistent = config.CachePersistent
 	proxy.cacheSize = config.CacheSize
+	proxy.cacheMaxMemory = Max(0, config.CacheMaxMemory)
+	proxy.cacheTTLRulesFile = config.CacheTTLRulesFile
 	proxy.cacheFlushEnabled = config.CacheFlushEnabled
 	proxy.cacheAutoSave = time.Duration(config.CacheAutoSave) * time.Second
 	proxy.cacheForcedMaxTTL = time.Duration(config.CacheForcedMaxTTL)*time.Second + time.Duration(config.CacheForcedMaxTTLHours)*time.Hour + time.Duration(config.CacheForcedMaxTTLDays)*time.Hour*24
@@ -483,6 +598,12 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 
 	proxy.cacheMinTTL = config.CacheMinTTL
 	proxy.cacheMaxTTL = config.CacheMaxTTL
+	if config.Cache && config.CachePrefetchBudget > 0 {
+		proxy.cachePrefetcher = NewCachePrefetcher(config.CacheSize, config.CachePrefetchMinHits, config.CachePrefetchBudget)
+	}
+	proxy.staleAnswerClientTimeout = time.Duration(Max(0, config.StaleAnswerClientTimeout)) * time.Millisecond
+	proxy.staleAnswerTTL = time.Duration(Max(1, config.StaleAnswerTTL)) * time.Second
+	proxy.staleAnswerMaxAge = time.Duration(Max(0, config.StaleAnswerMaxAge)) * time.Second
 	proxy.rejectTTL = config.RejectTTL
 	proxy.cloakTTL = config.CloakTTL
 
@@ -498,6 +619,27 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 			proxy.ednsClientSubnets = append(proxy.ednsClientSubnets, netclient)
 		}
 	}
+	switch config.EDNSClientSubnetMode {
+	case "", "fixed":
+	case "client":
+		proxy.ednsClientSubnetFromClient = true
+	default:
+		return fmt.Errorf("Unsupported EDNS-client-subnet mode: [%v]", config.EDNSClientSubnetMode)
+	}
+	if config.EDNSClientSubnetPrefixV4 < 0 || config.EDNSClientSubnetPrefixV4 > 32 ||
+		config.EDNSClientSubnetPrefixV6 < 0 || config.EDNSClientSubnetPrefixV6 > 128 {
+		return errors.New("Invalid EDNS-client-subnet prefix length")
+	}
+	proxy.ednsClientSubnetPrefixV4 = config.EDNSClientSubnetPrefixV4
+	proxy.ednsClientSubnetPrefixV6 = config.EDNSClientSubnetPrefixV6
+	switch config.EDNSClientSubnetPolicy {
+	case "":
+		proxy.ednsClientSubnetPolicy = ECSPolicyKeep
+	case ECSPolicyKeep, ECSPolicyStrip, ECSPolicyReplace:
+		proxy.ednsClientSubnetPolicy = config.EDNSClientSubnetPolicy
+	default:
+		return fmt.Errorf("Unsupported EDNS-client-subnet policy: [%v]", config.EDNSClientSubnetPolicy)
+	}
 
 	if len(config.QueryLog.Format) == 0 {
 		config.QueryLog.Format = "tsv"
@@ -510,6 +652,7 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 	proxy.queryLogFile = config.QueryLog.File
 	proxy.queryLogFormat = config.QueryLog.Format
 	proxy.queryLogIgnoredQtypes = config.QueryLog.IgnoredQtypes
+	proxy.queryLogRetries = config.QueryLog.LogRetries
 
 	if len(config.NxLog.Format) == 0 {
 		config.NxLog.Format = "tsv"
@@ -588,6 +731,7 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 	proxy.forwardFile = config.ForwardFile
 	proxy.cloakFile = config.CloakFile
 	proxy.captivePortalFile = config.CaptivePortalFile
+	proxy.reloadRulesOnChange = config.ReloadRulesOnChange
 
 	allWeeklyRanges, err := ParseAllWeeklyRanges(config.AllWeeklyRanges)
 	if err != nil {
@@ -595,6 +739,20 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 	}
 	proxy.allWeeklyRanges = allWeeklyRanges
 
+	proxy.pluginsOrder = map[string][]string{
+		PluginsChainQuery:    config.Plugins.Query,
+		PluginsChainResponse: config.Plugins.Response,
+		PluginsChainLogging:  config.Plugins.Logging,
+	}
+
+	if len(config.ClientGroups) > 0 {
+		clientGroups, err := NewClientGroups(config.ClientGroups, config.AllWeeklyRanges, config.DHCPLeasesFile)
+		if err != nil {
+			return err
+		}
+		proxy.clientGroups = clientGroups
+	}
+
 	if configRoutes := config.AnonymizedDNS.Routes; configRoutes != nil {
 		routes := make(map[string][]string)
 		for _, configRoute := range configRoutes {
@@ -612,9 +770,11 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 	creds := make(map[string]DOHClientCreds)
 	for _, configClientCred := range configClientCreds {
 		credFiles := DOHClientCreds{
-			clientCert: configClientCred.ClientCert,
-			clientKey:  configClientCred.ClientKey,
-			rootCA:     configClientCred.RootCA,
+			clientCert:  configClientCred.ClientCert,
+			clientKey:   configClientCred.ClientKey,
+			rootCA:      configClientCred.RootCA,
+			serverName:  configClientCred.TLSServerName,
+			cipherSuite: configClientCred.TLSCipherSuite,
 		}
 		creds[configClientCred.ServerName] = credFiles
 	}
@@ -638,6 +798,9 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 		config.SourceIPv6 = true
 		config.SourceDNSCrypt = true
 		config.SourceDoH = true
+		config.SourceDoT = true
+		config.SourceDoQ = true
+		config.SourceODoH = true
 	}
 
 	netprobeTimeout := config.NetprobeTimeout
@@ -679,6 +842,13 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 		if len(proxy.registeredServers) == 0 {
 			return errors.New("No servers configured")
 		}
+		for _, group := range proxy.clientGroups.list() {
+			for _, serverName := range group.serverNames {
+				if !proxy.isRegisteredServer(serverName) {
+					dlog.Warnf("Server [%s] of the [%s] client group is not among the configured servers", serverName, group.name)
+				}
+			}
+		}
 	}
 	if *flags.List || *flags.ListAll {
 		if err := config.printRegisteredServers(proxy, *flags.JSONOutput); err != nil {
@@ -690,8 +860,8 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 		hasSpecificRoutes := false
 		for _, server := range proxy.registeredServers {
 			if via, ok := (*proxy.routes)[server.name]; ok {
-				if server.stamp.Proto != stamps.StampProtoTypeDNSCrypt {
-					dlog.Errorf("DNS anonymization is only supported with the DNSCrypt protocol - Connections to [%v] cannot be anonymized", server.name)
+				if server.stamp.Proto != stamps.StampProtoTypeDNSCrypt && server.stamp.Proto != StampProtoTypeODoHTarget {
+					dlog.Errorf("DNS anonymization is only supported with the DNSCrypt and ODoH protocols - Connections to [%v] cannot be anonymized", server.name)
 				} else {
 					dlog.Noticef("Anonymized DNS: routing [%v] via %v", server.name, via)
 				}
@@ -717,10 +887,16 @@ func (config *Config) printRegisteredServers(proxy *Proxy, jsonOutput bool) erro
 	var summary []ServerSummary
 	for _, registeredServer := range proxy.registeredServers {
 		addrStr, port := registeredServer.stamp.ServerAddrStr, stamps.DefaultPort
+		if registeredServer.stamp.Proto == stamps.StampProtoTypeTLS {
+			port = DefaultDoTPort
+		} else if registeredServer.stamp.Proto == StampProtoTypeDoQ {
+			port = DefaultDoQPort
+		}
 		var hostAddr string
 		hostAddr, port = ExtractHostAndPort(addrStr, port)
 		addrs := make([]string, 0)
-		if registeredServer.stamp.Proto == stamps.StampProtoTypeDoH && len(registeredServer.stamp.ProviderName) > 0 {
+		if (registeredServer.stamp.Proto == stamps.StampProtoTypeDoH || registeredServer.stamp.Proto == stamps.StampProtoTypeTLS ||
+			registeredServer.stamp.Proto == StampProtoTypeDoQ || registeredServer.stamp.Proto == StampProtoTypeODoHTarget) && len(registeredServer.stamp.ProviderName) > 0 {
 			providerName := registeredServer.stamp.ProviderName
 			var host string
 			host, port = ExtractHostAndPort(providerName, port)
@@ -731,7 +907,7 @@ func (config *Config) printRegisteredServers(proxy *Proxy, jsonOutput bool) erro
 		}
 		serverSummary := ServerSummary{
 			Name:        registeredServer.name,
-			Proto:       registeredServer.stamp.Proto.String(),
+			Proto:       StampProtoString(registeredServer.stamp.Proto),
 			IPv6:        strings.HasPrefix(addrStr, "["),
 			Ports:       []int{port},
 			Addrs:       addrs,
@@ -739,7 +915,7 @@ func (config *Config) printRegisteredServers(proxy *Proxy, jsonOutput bool) erro
 			NoLog:       registeredServer.stamp.Props&stamps.ServerInformalPropertyNoLog != 0,
 			NoFilter:    registeredServer.stamp.Props&stamps.ServerInformalPropertyNoFilter != 0,
 			Description: registeredServer.description,
-			Stamp:       registeredServer.stamp.String(),
+			Stamp:       ServerStampString(&registeredServer.stamp),
 		}
 		if jsonOutput {
 			summary = append(summary, serverSummary)
@@ -787,7 +963,7 @@ func (config *Config) loadSources(proxy *Proxy) error {
 		if len(staticConfig.Stamp) == 0 {
 			return fmt.Errorf("Missing stamp for the static [%s] definition", serverName)
 		}
-		stamp, err := stamps.NewServerStampFromString(staticConfig.Stamp)
+		stamp, err := ParseServerStamp(staticConfig.Stamp)
 		if err != nil {
 			return fmt.Errorf("Stamp error for the static [%s] definition: [%v]", serverName, err)
 		}
@@ -842,7 +1018,8 @@ func (config *Config) loadSource(proxy *Proxy, requiredProps stamps.ServerInform
 		dlog.Warnf("Error in source [%s]: [%s] -- Continuing with reduced server count [%d]", cfgSourceName, err, len(registeredServers))
 	}
 	for _, registeredServer := range registeredServers {
-		if registeredServer.stamp.Proto != stamps.StampProtoTypeDNSCryptRelay {
+		isRelay := registeredServer.stamp.Proto == stamps.StampProtoTypeDNSCryptRelay || registeredServer.stamp.Proto == StampProtoTypeODoHRelay
+		if !isRelay {
 			if len(config.ServerNames) > 0 {
 				if !includesName(config.ServerNames, registeredServer.name) {
 					continue
@@ -856,7 +1033,9 @@ func (config *Config) loadSource(proxy *Proxy, requiredProps stamps.ServerInform
 		}
 		if config.SourceIPv4 || config.SourceIPv6 {
 			isIPv4, isIPv6 := true, false
-			if registeredServer.stamp.Proto == stamps.StampProtoTypeDoH {
+			if registeredServer.stamp.Proto == stamps.StampProtoTypeDoH || registeredServer.stamp.Proto == stamps.StampProtoTypeTLS ||
+				registeredServer.stamp.Proto == StampProtoTypeDoQ || registeredServer.stamp.Proto == StampProtoTypeODoHTarget ||
+				registeredServer.stamp.Proto == StampProtoTypeODoHRelay {
 				isIPv4, isIPv6 = true, true
 			}
 			if strings.HasPrefix(registeredServer.stamp.ServerAddrStr, "[") {
@@ -866,12 +1045,15 @@ func (config *Config) loadSource(proxy *Proxy, requiredProps stamps.ServerInform
 				continue
 			}
 		}
-		if registeredServer.stamp.Proto == stamps.StampProtoTypeDNSCryptRelay {
+		if isRelay {
 			dlog.Debugf("Adding [%s] to the set of available relays", registeredServer.name)
 			proxy.registeredRelays = append(proxy.registeredRelays, registeredServer)
 		} else {
 			if !((config.SourceDNSCrypt && registeredServer.stamp.Proto == stamps.StampProtoTypeDNSCrypt) ||
-				(config.SourceDoH && registeredServer.stamp.Proto == stamps.StampProtoTypeDoH)) {
+				(config.SourceDoH && registeredServer.stamp.Proto == stamps.StampProtoTypeDoH) ||
+				(config.SourceDoT && registeredServer.stamp.Proto == stamps.StampProtoTypeTLS) ||
+				(config.SourceDoQ && registeredServer.stamp.Proto == StampProtoTypeDoQ) ||
+				(config.SourceODoH && registeredServer.stamp.Proto == StampProtoTypeODoHTarget)) {
 				continue
 			}
 			dlog.Debugf("Adding [%s] to the set of wanted resolvers", registeredServer.name)
@@ -0,0 +1,748 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const (
+	DNSSECKeysCacheSize = 4096
+	DNSSECKeysMinTTL    = 60
+	DNSSECKeysMaxTTL    = 86400
+)
+
+// Root zone trust anchors (KSK-2017 and KSK-2024), used when none are configured
+var DefaultDNSSECTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+type DNSSECStatus int
+
+const (
+	DNSSECInsecure DNSSECStatus = iota
+	DNSSECSecure
+	DNSSECBogus
+	DNSSECIndeterminate
+)
+
+// DNSSECFetchError is returned when the records required to validate a response couldn't be retrieved
+type DNSSECFetchError struct {
+	err error
+}
+
+func (e *DNSSECFetchError) Error() string {
+	return e.err.Error()
+}
+
+// A DNSSECZone is the validated set of keys of a zone.
+// Keys are nil for zones that are provably insecure.
+
+type DNSSECZone struct {
+	name       string
+	keys       []*dns.DNSKEY
+	expiration time.Time
+}
+
+func (zone *DNSSECZone) secure() bool {
+	return zone.keys != nil
+}
+
+// DNSSECZones caches validated zones, by name. Names that are not zone apexes map to their enclosing zone.
+
+type DNSSECZones struct {
+	sync.RWMutex
+	cache *lru.ARCCache
+}
+
+var cachedDNSSECZones DNSSECZones
+
+func (zones *DNSSECZones) get(name string) *DNSSECZone {
+	zones.RLock()
+	defer zones.RUnlock()
+	if zones.cache == nil {
+		return nil
+	}
+	cached, ok := zones.cache.Get(name)
+	if !ok {
+		return nil
+	}
+	zone := cached.(*DNSSECZone)
+	if time.Now().After(zone.expiration) {
+		return nil
+	}
+	return zone
+}
+
+func (zones *DNSSECZones) add(name string, zone *DNSSECZone) {
+	zones.Lock()
+	defer zones.Unlock()
+	if zones.cache == nil {
+		var err error
+		if zones.cache, err = lru.NewARC(DNSSECKeysCacheSize); err != nil {
+			return
+		}
+	}
+	zones.cache.Add(name, zone)
+}
+
+func (zones *DNSSECZones) Purge() {
+	zones.Lock()
+	defer zones.Unlock()
+	if zones.cache != nil {
+		zones.cache.Purge()
+	}
+}
+
+// ---
+
+type DNSSECValidator struct {
+	proxy        *Proxy
+	trustAnchors map[string][]*dns.DS
+}
+
+func NewDNSSECValidator(proxy *Proxy, trustAnchorsStr []string) (*DNSSECValidator, error) {
+	if len(trustAnchorsStr) == 0 {
+		trustAnchorsStr = DefaultDNSSECTrustAnchors
+	}
+	validator := DNSSECValidator{proxy: proxy, trustAnchors: make(map[string][]*dns.DS)}
+	for _, trustAnchorStr := range trustAnchorsStr {
+		rr, err := dns.NewRR(trustAnchorStr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid DNSSEC trust anchor [%s]: %v", trustAnchorStr, err)
+		}
+		ds, ok := rr.(*dns.DS)
+		if !ok {
+			return nil, fmt.Errorf("Invalid DNSSEC trust anchor [%s]: a DS record is expected", trustAnchorStr)
+		}
+		name := dns.CanonicalName(ds.Hdr.Name)
+		validator.trustAnchors[name] = append(validator.trustAnchors[name], ds)
+	}
+	if _, found := validator.trustAnchors["."]; !found {
+		dlog.Warn("No trust anchor for the root zone -- Only names under the configured trust anchors can be validated")
+	}
+	return &validator, nil
+}
+
+// fetch sends a query for DNSSEC records to the upstream servers.
+// Checking is disabled, so that upstream validators return the records as they are.
+func (validator *DNSSECValidator) fetch(pluginsState *PluginsState, name string, qType uint16) (*dns.Msg, error) {
+	proxy := validator.proxy
+	msg := dns.Msg{}
+	msg.SetQuestion(name, qType)
+	msg.SetEdns0(uint16(MaxDNSUDPPacketSize-ResponseOverhead), true)
+	msg.CheckingDisabled = true
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	padLen := 63 - ((len(query) + 63) & 63)
+	if paddedQuery, _ := addEDNS0PaddingIfNoneFound(&msg, query, padLen); paddedQuery != nil {
+		query = paddedQuery
+	}
+	var serverNames []string
+	if pluginsState.clientGroup != nil {
+		serverNames = pluginsState.clientGroup.serverNames
+	}
+	serverInfos := proxy.serversInfo.getServers(serverNames, nil)
+	if len(serverInfos) == 0 {
+		return nil, &DNSSECFetchError{errors.New("No servers available")}
+	}
+	_, response, _, err := proxy.exchangeWithServers(serverInfos, query, "udp", true, 0)
+	if err != nil {
+		return nil, &DNSSECFetchError{err}
+	}
+	respMsg := dns.Msg{}
+	if err := respMsg.Unpack(response); err != nil {
+		return nil, &DNSSECFetchError{err}
+	}
+	if respMsg.Rcode != dns.RcodeSuccess && respMsg.Rcode != dns.RcodeNameError {
+		return nil, &DNSSECFetchError{fmt.Errorf("Unable to retrieve %s records for [%s]: %s", dns.TypeToString[qType], name, dns.RcodeToString[respMsg.Rcode])}
+	}
+	return &respMsg, nil
+}
+
+// zone returns the zone a name belongs to, along with its validated keys
+func (validator *DNSSECValidator) zone(pluginsState *PluginsState, name string) (*DNSSECZone, error) {
+	name = dns.CanonicalName(name)
+	if zone := cachedDNSSECZones.get(name); zone != nil {
+		return zone, nil
+	}
+	var zone *DNSSECZone
+	var err error
+	if trustAnchors, found := validator.trustAnchors[name]; found {
+		zone, err = validator.zoneKeys(pluginsState, name, trustAnchors, DNSSECKeysMaxTTL)
+	} else if name == "." {
+		zone = &DNSSECZone{name: name}
+	} else {
+		zone, err = validator.delegatedZone(pluginsState, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if zone.expiration.IsZero() {
+		zone.expiration = time.Now().Add(DNSSECKeysMaxTTL * time.Second)
+	}
+	cachedDNSSECZones.add(name, zone)
+	return zone, nil
+}
+
+func (validator *DNSSECValidator) delegatedZone(pluginsState *PluginsState, name string) (*DNSSECZone, error) {
+	respMsg, err := validator.fetch(pluginsState, name, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+	dsSet, dsSigs := rrsetAndSignatures(respMsg.Answer, name, dns.TypeDS)
+	var sigs []*dns.RRSIG
+	if len(dsSet) > 0 {
+		sigs = dsSigs
+	} else {
+		for _, rr := range respMsg.Ns {
+			if sig, ok := rr.(*dns.RRSIG); ok {
+				sigs = append(sigs, sig)
+			}
+		}
+	}
+	if len(sigs) == 0 {
+		// Unsigned records are only acceptable in an insecure parent zone
+		parentZone, err := validator.zone(pluginsState, parentName(name))
+		if err != nil {
+			return nil, err
+		}
+		if parentZone.secure() {
+			return nil, fmt.Errorf("Missing signature for the DS records of [%s]", name)
+		}
+		return parentZone, nil
+	}
+	signer := dns.CanonicalName(sigs[0].SignerName)
+	if signer == name || !dns.IsSubDomain(signer, name) {
+		return nil, fmt.Errorf("Unexpected signer [%s] for the DS records of [%s]", signer, name)
+	}
+	parentZone, err := validator.zone(pluginsState, signer)
+	if err != nil {
+		return nil, err
+	}
+	if !parentZone.secure() {
+		return parentZone, nil
+	}
+	if parentZone.name != signer {
+		return nil, fmt.Errorf("[%s] is not a zone apex", signer)
+	}
+	ttl := rrsetsMinTTL(respMsg.Answer, respMsg.Ns)
+	if len(dsSet) > 0 {
+		if err := verifyRRset(dsSet, dsSigs, parentZone.keys); err != nil {
+			return nil, fmt.Errorf("DS records of [%s]: %v", name, err)
+		}
+		var dsRecords []*dns.DS
+		for _, rr := range dsSet {
+			dsRecords = append(dsRecords, rr.(*dns.DS))
+		}
+		return validator.zoneKeys(pluginsState, name, dsRecords, ttl)
+	}
+
+	// No DS records: the name is either an insecure delegation, or a name of the parent zone
+	if err := verifyRRsets(respMsg.Ns, parentZone.keys); err != nil {
+		return nil, fmt.Errorf("Denial of the DS records of [%s]: %v", name, err)
+	}
+	types, found := nsecTypes(respMsg.Ns, name)
+	if !found {
+		closestEncloser, optOut, proven := closestEncloserProof(respMsg.Ns, name)
+		if proven && optOut {
+			return &DNSSECZone{name: name, expiration: ttlExpiration(ttl)}, nil
+		}
+		if proven && respMsg.Rcode == dns.RcodeNameError && nsecCovers(respMsg.Ns, wildcardName(closestEncloser)) {
+			return parentZone, nil
+		}
+		return nil, fmt.Errorf("No proof of the absence of DS records for [%s]", name)
+	}
+	if types[dns.TypeDS] {
+		return nil, fmt.Errorf("DS records of [%s] exist but were not returned", name)
+	}
+	if types[dns.TypeNS] && !types[dns.TypeSOA] {
+		return &DNSSECZone{name: name, expiration: ttlExpiration(ttl)}, nil
+	}
+	return parentZone, nil
+}
+
+// zoneKeys retrieves the keys of a zone, and checks that they are signed by a key matching a DS record
+func (validator *DNSSECValidator) zoneKeys(pluginsState *PluginsState, name string, dsRecords []*dns.DS, ttl uint32) (*DNSSECZone, error) {
+	respMsg, err := validator.fetch(pluginsState, name, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	keySet, sigs := rrsetAndSignatures(respMsg.Answer, name, dns.TypeDNSKEY)
+	var keys []*dns.DNSKEY
+	for _, rr := range keySet {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+	supported := false
+	for _, ds := range dsRecords {
+		if !dnssecAlgorithmSupported(ds.Algorithm, ds.DigestType) {
+			continue
+		}
+		supported = true
+		for _, key := range keys {
+			if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+				continue
+			}
+			if keyDS := key.ToDS(ds.DigestType); keyDS == nil || !strings.EqualFold(keyDS.Digest, ds.Digest) {
+				continue
+			}
+			if err := verifyRRset(keySet, sigs, []*dns.DNSKEY{key}); err == nil {
+				if keysTTL := rrsetsMinTTL(respMsg.Answer); keysTTL < ttl {
+					ttl = keysTTL
+				}
+				return &DNSSECZone{name: name, keys: keys, expiration: ttlExpiration(ttl)}, nil
+			}
+		}
+	}
+	if !supported {
+		dlog.Debugf("Unsupported DNSSEC algorithms for [%s] -- Treating the zone as insecure", name)
+		return &DNSSECZone{name: name, expiration: ttlExpiration(ttl)}, nil
+	}
+	return nil, fmt.Errorf("No valid signature for the keys of [%s]", name)
+}
+
+// validate checks the answer and authority sections of a response
+func (validator *DNSSECValidator) validate(pluginsState *PluginsState, msg *dns.Msg) (DNSSECStatus, error) {
+	if len(msg.Question) != 1 {
+		return DNSSECInsecure, nil
+	}
+	question := msg.Question[0]
+	status := DNSSECSecure
+	answered := false
+	target := dns.CanonicalName(question.Name)
+	var wildcards []string
+	for _, rrset := range splitRRsets(msg.Answer) {
+		header := rrset[0].Header()
+		name := dns.CanonicalName(header.Name)
+		if header.Rrtype == question.Qtype || question.Qtype == dns.TypeANY {
+			answered = true
+		}
+		if header.Rrtype == dns.TypeCNAME && name == target {
+			target = dns.CanonicalName(rrset[0].(*dns.CNAME).Target)
+		}
+		_, sigs := rrsetAndSignatures(msg.Answer, name, header.Rrtype)
+		if len(sigs) == 0 && header.Rrtype == dns.TypeCNAME && synthesizedFromDNAME(msg.Answer, name) {
+			continue
+		}
+		rrsetStatus, err := validator.validateRRset(pluginsState, name, rrset, sigs)
+		if err != nil {
+			return rrsetStatus, err
+		}
+		if rrsetStatus == DNSSECInsecure {
+			status = DNSSECInsecure
+		} else if labels := int(sigs[0].Labels); labels < dns.CountLabel(name) {
+			// Wildcard expansion: the next closer name must not exist
+			indices := dns.Split(name)
+			wildcards = append(wildcards, name[indices[len(indices)-labels-1]:])
+		}
+	}
+	if answered && len(wildcards) == 0 {
+		return status, nil
+	}
+	authorityRRsets := splitRRsets(msg.Ns)
+	if len(authorityRRsets) == 0 {
+		zone, err := validator.zone(pluginsState, target)
+		if err != nil {
+			return DNSSECIndeterminate, err
+		}
+		if zone.secure() {
+			return DNSSECBogus, fmt.Errorf("Missing denial of existence for [%s]", target)
+		}
+		return DNSSECInsecure, nil
+	}
+	for _, rrset := range authorityRRsets {
+		name := dns.CanonicalName(rrset[0].Header().Name)
+		_, sigs := rrsetAndSignatures(msg.Ns, name, rrset[0].Header().Rrtype)
+		rrsetStatus, err := validator.validateRRset(pluginsState, name, rrset, sigs)
+		if err != nil {
+			return rrsetStatus, err
+		}
+		if rrsetStatus == DNSSECInsecure {
+			status = DNSSECInsecure
+		}
+	}
+	if status != DNSSECSecure {
+		return status, nil
+	}
+	for _, wildcard := range wildcards {
+		if !nsecCovers(msg.Ns, wildcard) {
+			return DNSSECBogus, fmt.Errorf("Missing proof of non-existence for the wildcard expansion [%s]", wildcard)
+		}
+	}
+	if answered {
+		return status, nil
+	}
+	if msg.Rcode == dns.RcodeNameError {
+		// The name and the wildcard at its closest encloser must both be proven not to exist
+		closestEncloser, optOut, proven := closestEncloserProof(msg.Ns, target)
+		if !proven || !nsecCovers(msg.Ns, wildcardName(closestEncloser)) {
+			return DNSSECBogus, fmt.Errorf("Missing proof of non-existence for [%s]", target)
+		}
+		if optOut {
+			// The name may still exist as an unsigned delegation (RFC 5155, section 9.2)
+			return DNSSECInsecure, nil
+		}
+		return status, nil
+	}
+	if types, found := nsecTypes(msg.Ns, target); found {
+		// A record from the parent side of a delegation says nothing about the child zone
+		delegation := types[dns.TypeNS] && !types[dns.TypeSOA] && question.Qtype != dns.TypeDS
+		if !delegation && !types[question.Qtype] && !types[dns.TypeCNAME] {
+			return status, nil
+		}
+		return DNSSECBogus, fmt.Errorf("Missing proof of non-existence of %s records for [%s]", dns.TypeToString[question.Qtype], target)
+	}
+	if nsecEmptyNonTerminal(msg.Ns, target) {
+		return status, nil
+	}
+
+	// No record matches the name: it must have been synthesized from a wildcard with no matching type,
+	// unless DS records are requested for a name in an opt-out span (RFC 5155, sections 8.6 and 8.7)
+	if closestEncloser, optOut, proven := closestEncloserProof(msg.Ns, target); proven {
+		if types, found := nsecTypes(msg.Ns, wildcardName(closestEncloser)); found && !types[question.Qtype] && !types[dns.TypeCNAME] {
+			return status, nil
+		}
+		if optOut && question.Qtype == dns.TypeDS {
+			return DNSSECInsecure, nil
+		}
+	}
+	return DNSSECBogus, fmt.Errorf("Missing proof of non-existence of %s records for [%s]", dns.TypeToString[question.Qtype], target)
+}
+
+func (validator *DNSSECValidator) validateRRset(pluginsState *PluginsState, name string, rrset []dns.RR, sigs []*dns.RRSIG) (DNSSECStatus, error) {
+	rrType := rrset[0].Header().Rrtype
+	if len(sigs) == 0 {
+		zoneName := name
+		if rrType == dns.TypeDS {
+			zoneName = parentName(name)
+		}
+		zone, err := validator.zone(pluginsState, zoneName)
+		if err != nil {
+			return dnssecErrorStatus(err), err
+		}
+		if zone.secure() {
+			return DNSSECBogus, fmt.Errorf("Missing signature for the %s records of [%s]", dns.TypeToString[rrType], name)
+		}
+		return DNSSECInsecure, nil
+	}
+	signer := dns.CanonicalName(sigs[0].SignerName)
+	if !dns.IsSubDomain(signer, name) {
+		return DNSSECBogus, fmt.Errorf("Unexpected signer [%s] for [%s]", signer, name)
+	}
+	zone, err := validator.zone(pluginsState, signer)
+	if err != nil {
+		return dnssecErrorStatus(err), err
+	}
+	if !zone.secure() {
+		return DNSSECInsecure, nil
+	}
+	if zone.name != signer {
+		return DNSSECBogus, fmt.Errorf("[%s] is not a zone apex", signer)
+	}
+	if err := verifyRRset(rrset, sigs, zone.keys); err != nil {
+		return DNSSECBogus, fmt.Errorf("%s records of [%s]: %v", dns.TypeToString[rrType], name, err)
+	}
+	return DNSSECSecure, nil
+}
+
+func dnssecErrorStatus(err error) DNSSECStatus {
+	var fetchError *DNSSECFetchError
+	if errors.As(err, &fetchError) {
+		return DNSSECIndeterminate
+	}
+	return DNSSECBogus
+}
+
+// ---
+
+func verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY) error {
+	if len(sigs) == 0 {
+		return errors.New("No signature")
+	}
+	now := time.Now()
+	err := errors.New("No matching key")
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(now) {
+			err = errors.New("Signature expired or not yet valid")
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm || key.Flags&dns.ZONE == 0 {
+				continue
+			}
+			if err = sig.Verify(key, rrset); err == nil {
+				return nil
+			}
+		}
+	}
+	return err
+}
+
+// verifyRRsets checks that every RRset of a section is signed
+func verifyRRsets(rrs []dns.RR, keys []*dns.DNSKEY) error {
+	for _, rrset := range splitRRsets(rrs) {
+		header := rrset[0].Header()
+		_, sigs := rrsetAndSignatures(rrs, dns.CanonicalName(header.Name), header.Rrtype)
+		if err := verifyRRset(rrset, sigs, keys); err != nil {
+			return fmt.Errorf("%s records of [%s]: %v", dns.TypeToString[header.Rrtype], header.Name, err)
+		}
+	}
+	return nil
+}
+
+// splitRRsets groups records by name and type, ignoring signatures
+func splitRRsets(rrs []dns.RR) [][]dns.RR {
+	var rrsets [][]dns.RR
+	indices := make(map[string]int)
+	for _, rr := range rrs {
+		header := rr.Header()
+		if header.Rrtype == dns.TypeRRSIG || header.Rrtype == dns.TypeOPT {
+			continue
+		}
+		key := dns.CanonicalName(header.Name) + "/" + dns.TypeToString[header.Rrtype]
+		if i, found := indices[key]; found {
+			rrsets[i] = append(rrsets[i], rr)
+		} else {
+			indices[key] = len(rrsets)
+			rrsets = append(rrsets, []dns.RR{rr})
+		}
+	}
+	return rrsets
+}
+
+func rrsetAndSignatures(rrs []dns.RR, name string, rrType uint16) ([]dns.RR, []*dns.RRSIG) {
+	var rrset []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range rrs {
+		header := rr.Header()
+		if dns.CanonicalName(header.Name) != name {
+			continue
+		}
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			if sig.TypeCovered == rrType {
+				sigs = append(sigs, sig)
+			}
+		} else if header.Rrtype == rrType {
+			rrset = append(rrset, rr)
+		}
+	}
+	return rrset, sigs
+}
+
+func synthesizedFromDNAME(rrs []dns.RR, name string) bool {
+	for _, rr := range rrs {
+		if dname, ok := rr.(*dns.DNAME); ok && dns.IsSubDomain(dns.CanonicalName(dname.Hdr.Name), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// nsecTypes returns the types present at a name, according to a NSEC or NSEC3 record matching that name
+func nsecTypes(rrs []dns.RR, name string) (map[uint16]bool, bool) {
+	for _, rr := range rrs {
+		var typeBitMap []uint16
+		switch nsec := rr.(type) {
+		case *dns.NSEC:
+			if dns.CanonicalName(nsec.Hdr.Name) != name {
+				continue
+			}
+			typeBitMap = nsec.TypeBitMap
+		case *dns.NSEC3:
+			if !nsec.Match(name) {
+				continue
+			}
+			typeBitMap = nsec.TypeBitMap
+		default:
+			continue
+		}
+		types := make(map[uint16]bool)
+		for _, rrType := range typeBitMap {
+			types[rrType] = true
+		}
+		return types, true
+	}
+	return nil, false
+}
+
+// nsecCovers returns true if a NSEC or NSEC3 record proves that a name doesn't exist
+func nsecCovers(rrs []dns.RR, name string) bool {
+	for _, rr := range rrs {
+		switch nsec := rr.(type) {
+		case *dns.NSEC:
+			if nsecCoversName(nsec, name) {
+				return true
+			}
+		case *dns.NSEC3:
+			if nsec.Cover(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nsecCoversName returns true if a name falls between the owner and the next name of a NSEC record.
+// Records found at a delegation point or at a DNAME don't prove anything about the names below them.
+func nsecCoversName(nsec *dns.NSEC, name string) bool {
+	owner, next := dns.CanonicalName(nsec.Hdr.Name), dns.CanonicalName(nsec.NextDomain)
+	if canonicalCompare(owner, name) >= 0 || (canonicalCompare(name, next) >= 0 && canonicalCompare(next, owner) > 0) {
+		return false
+	}
+	return !dns.IsSubDomain(owner, name) || !nsecAtZoneCut(nsec.TypeBitMap)
+}
+
+// nsecEmptyNonTerminal returns true if a NSEC record proves that a name only exists as the ancestor of other names
+func nsecEmptyNonTerminal(rrs []dns.RR, name string) bool {
+	for _, rr := range rrs {
+		if nsec, ok := rr.(*dns.NSEC); ok && nsecCoversName(nsec, name) {
+			next := dns.CanonicalName(nsec.NextDomain)
+			if next != name && dns.IsSubDomain(name, next) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nsecAtZoneCut returns true if a type bitmap is the one of a delegation point or of a DNAME
+func nsecAtZoneCut(typeBitMap []uint16) bool {
+	types := make(map[uint16]bool)
+	for _, rrType := range typeBitMap {
+		types[rrType] = true
+	}
+	return types[dns.TypeDNAME] || (types[dns.TypeNS] && !types[dns.TypeSOA])
+}
+
+// closestEncloserProof returns the closest existing ancestor of a name that doesn't exist.
+// optOut is set if the NSEC3 record covering the next closer name has the Opt-Out flag.
+func closestEncloserProof(rrs []dns.RR, name string) (closestEncloser string, optOut bool, proven bool) {
+	if closestEncloser, proven = nsecClosestEncloser(rrs, name); proven {
+		return closestEncloser, false, true
+	}
+	return nsec3ClosestEncloser(rrs, name)
+}
+
+// nsecClosestEncloser derives the closest encloser of a name from the NSEC record covering it:
+// the longest common ancestor of the name and the owner or the next name (RFC 4035, section 5.4)
+func nsecClosestEncloser(rrs []dns.RR, name string) (string, bool) {
+	for _, rr := range rrs {
+		nsec, ok := rr.(*dns.NSEC)
+		if !ok || !nsecCoversName(nsec, name) {
+			continue
+		}
+		labels := Max(dns.CompareDomainName(name, nsec.Hdr.Name), dns.CompareDomainName(name, nsec.NextDomain))
+		return ancestorName(name, labels), true
+	}
+	return "", false
+}
+
+// nsec3ClosestEncloser looks for the closest existing ancestor of a name,
+// and checks that the next closer name is covered (RFC 5155, section 8.3)
+func nsec3ClosestEncloser(rrs []dns.RR, name string) (string, bool, bool) {
+	var nsec3s []*dns.NSEC3
+	for _, rr := range rrs {
+		if nsec3, ok := rr.(*dns.NSEC3); ok {
+			nsec3s = append(nsec3s, nsec3)
+		}
+	}
+	if len(nsec3s) == 0 {
+		return "", false, false
+	}
+	nextCloser := name
+	for closestEncloser := parentName(name); ; closestEncloser = parentName(closestEncloser) {
+		for _, nsec3 := range nsec3s {
+			if !nsec3.Match(closestEncloser) {
+				continue
+			}
+			if nsecAtZoneCut(nsec3.TypeBitMap) {
+				return "", false, false
+			}
+			for _, nsec3 := range nsec3s {
+				if nsec3.Cover(nextCloser) {
+					return closestEncloser, nsec3.Flags&1 != 0, true
+				}
+			}
+			return "", false, false
+		}
+		if closestEncloser == "." {
+			return "", false, false
+		}
+		nextCloser = closestEncloser
+	}
+}
+
+// canonicalCompare compares names using the canonical DNS order (RFC 4034, section 6.1)
+func canonicalCompare(a, b string) int {
+	aLabels, bLabels := dns.SplitDomainName(a), dns.SplitDomainName(b)
+	for i, j := len(aLabels)-1, len(bLabels)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(strings.ToLower(aLabels[i]), strings.ToLower(bLabels[j])); c != 0 {
+			return c
+		}
+	}
+	return len(aLabels) - len(bLabels)
+}
+
+// ancestorName returns the ancestor of a name made of its last labels
+func ancestorName(name string, labels int) string {
+	indices := dns.Split(name)
+	if labels <= 0 || len(indices) == 0 {
+		return "."
+	}
+	if labels >= len(indices) {
+		return name
+	}
+	return name[indices[len(indices)-labels]:]
+}
+
+func wildcardName(closestEncloser string) string {
+	if closestEncloser == "." {
+		return "*."
+	}
+	return "*." + closestEncloser
+}
+
+func parentName(name string) string {
+	if i, end := dns.NextLabel(name, 0); !end {
+		return name[i:]
+	}
+	return "."
+}
+
+func dnssecAlgorithmSupported(algorithm uint8, digestType uint8) bool {
+	switch digestType {
+	case dns.SHA1, dns.SHA256, dns.SHA384:
+	default:
+		return false
+	}
+	switch algorithm {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512, dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		return true
+	}
+	return false
+}
+
+func rrsetsMinTTL(sections ...[]dns.RR) uint32 {
+	ttl := uint32(DNSSECKeysMaxTTL)
+	for _, rrs := range sections {
+		for _, rr := range rrs {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+	}
+	return ttl
+}
+
+func ttlExpiration(ttl uint32) time.Time {
+	return time.Now().Add(time.Duration(Max(DNSSECKeysMinTTL, Min(DNSSECKeysMaxTTL, int(ttl)))) * time.Second)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/powerman/check"
+)
+
+const DNSSECTestZone = "example."
+
+type DNSSECTestSigner struct {
+	key     *dns.DNSKEY
+	privKey crypto.Signer
+}
+
+func newDNSSECTestSigner(t *testing.T) *DNSSECTestSigner {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: DNSSECTestZone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	privKey, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &DNSSECTestSigner{key: key, privKey: privKey.(crypto.Signer)}
+}
+
+// sign returns the records of an RRset, followed by their signature.
+// owner is the name the records are returned for, which differs from their name for wildcard expansions.
+func (signer *DNSSECTestSigner) sign(t *testing.T, owner string, rrStrs ...string) []dns.RR {
+	var rrset []dns.RR
+	for _, rrStr := range rrStrs {
+		rr, err := dns.NewRR(rrStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrset = append(rrset, rr)
+	}
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3600},
+		Algorithm:  signer.key.Algorithm,
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		KeyTag:     signer.key.KeyTag(),
+		SignerName: DNSSECTestZone,
+	}
+	if err := sig.Sign(signer.privKey, rrset); err != nil {
+		t.Fatal(err)
+	}
+	sig.Hdr.Name = owner
+	for _, rr := range rrset {
+		rr.Header().Name = owner
+	}
+	return append(rrset, sig)
+}
+
+func dnssecTestNSEC3(name string, optOut bool, nextName string, types string) string {
+	flags := 0
+	if optOut {
+		flags = 1
+	}
+	hash := dns.HashName(name, dns.SHA1, 0, "")
+	next := dns.HashName(nextName, dns.SHA1, 0, "")
+	return fmt.Sprintf("%s.%s 3600 IN NSEC3 1 %d 0 - %s %s", strings.ToLower(hash), DNSSECTestZone, flags, next, types)
+}
+
+func TestDNSSECValidate(t *testing.T) {
+	signer := newDNSSECTestSigner(t)
+	cachedDNSSECZones.add(DNSSECTestZone, &DNSSECZone{
+		name:       DNSSECTestZone,
+		keys:       []*dns.DNSKEY{signer.key},
+		expiration: time.Now().Add(time.Hour),
+	})
+	validator := &DNSSECValidator{trustAnchors: make(map[string][]*dns.DS)}
+	sign := func(owner string, rrStrs ...string) []dns.RR {
+		return signer.sign(t, owner, rrStrs...)
+	}
+	apexTypes := "NS SOA RRSIG NSEC DNSKEY"
+	apexNSEC3Types := "NS SOA RRSIG DNSKEY NSEC3PARAM"
+
+	// A single NSEC3 record whose interval is empty matches the apex, and covers every other name
+	nsec3 := dnssecTestNSEC3(DNSSECTestZone, false, DNSSECTestZone, apexNSEC3Types)
+	nsec3OptOut := dnssecTestNSEC3(DNSSECTestZone, true, DNSSECTestZone, apexNSEC3Types)
+
+	for _, tt := range []struct {
+		name   string
+		qName  string
+		qType  uint16
+		rcode  int
+		answer []dns.RR
+		ns     []dns.RR
+		want   DNSSECStatus
+	}{
+		{
+			name:   "positive",
+			qName:  "www.example.",
+			qType:  dns.TypeA,
+			answer: sign("www.example.", "www.example. 3600 IN A 192.0.2.1"),
+			want:   DNSSECSecure,
+		},
+		{
+			name:   "bad signature",
+			qName:  "www.example.",
+			qType:  dns.TypeA,
+			answer: append(sign("www.example.", "www.example. 3600 IN A 192.0.2.1")[1:], &dns.A{Hdr: dns.RR_Header{Name: "www.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}, A: []byte{192, 0, 2, 2}}),
+			want:   DNSSECBogus,
+		},
+		{
+			name:  "NXDOMAIN",
+			qName: "nx.example.",
+			qType: dns.TypeA,
+			rcode: dns.RcodeNameError,
+			ns:    sign("example.", "example. 3600 IN NSEC www.example. "+apexTypes),
+			want:  DNSSECSecure,
+		},
+		{
+			name:  "NXDOMAIN without wildcard proof",
+			qName: "nx.example.",
+			qType: dns.TypeA,
+			rcode: dns.RcodeNameError,
+			ns:    sign("m.example.", "m.example. 3600 IN NSEC www.example. A RRSIG NSEC"),
+			want:  DNSSECBogus,
+		},
+		{
+			name:  "NXDOMAIN below a delegation",
+			qName: "a.sub.example.",
+			qType: dns.TypeA,
+			rcode: dns.RcodeNameError,
+			ns:    sign("sub.example.", "sub.example. 3600 IN NSEC www.example. NS RRSIG NSEC"),
+			want:  DNSSECBogus,
+		},
+		{
+			name:  "NXDOMAIN NSEC3",
+			qName: "nx.example.",
+			qType: dns.TypeA,
+			rcode: dns.RcodeNameError,
+			ns:    sign(strings.Fields(nsec3)[0], nsec3),
+			want:  DNSSECSecure,
+		},
+		{
+			name:  "NODATA",
+			qName: "www.example.",
+			qType: dns.TypeAAAA,
+			ns:    sign("www.example.", "www.example. 3600 IN NSEC example. A RRSIG NSEC"),
+			want:  DNSSECSecure,
+		},
+		{
+			name:  "NODATA for an existing type",
+			qName: "www.example.",
+			qType: dns.TypeA,
+			ns:    sign("www.example.", "www.example. 3600 IN NSEC example. A RRSIG NSEC"),
+			want:  DNSSECBogus,
+		},
+		{
+			name:  "NODATA empty non-terminal",
+			qName: "ent.example.",
+			qType: dns.TypeA,
+			ns:    sign("example.", "example. 3600 IN NSEC a.ent.example. "+apexTypes),
+			want:  DNSSECSecure,
+		},
+		{
+			name:  "NODATA NSEC3",
+			qName: "example.",
+			qType: dns.TypeA,
+			ns:    sign(strings.Fields(nsec3)[0], nsec3),
+			want:  DNSSECSecure,
+		},
+		{
+			name:  "forged NODATA from a NXDOMAIN proof",
+			qName: "www.example.",
+			qType: dns.TypeA,
+			ns:    sign("example.", "example. 3600 IN NSEC zzz.example. "+apexTypes),
+			want:  DNSSECBogus,
+		},
+		{
+			name:  "forged NODATA from an opt-out span",
+			qName: "www.example.",
+			qType: dns.TypeA,
+			ns:    sign(strings.Fields(nsec3OptOut)[0], nsec3OptOut),
+			want:  DNSSECBogus,
+		},
+		{
+			name:  "opt-out DS",
+			qName: "insecure.example.",
+			qType: dns.TypeDS,
+			ns:    sign(strings.Fields(nsec3OptOut)[0], nsec3OptOut),
+			want:  DNSSECInsecure,
+		},
+		{
+			name:   "wildcard",
+			qName:  "a.example.",
+			qType:  dns.TypeA,
+			answer: sign("a.example.", "*.example. 3600 IN A 192.0.2.1"),
+			ns:     sign("*.example.", "*.example. 3600 IN NSEC www.example. A RRSIG NSEC"),
+			want:   DNSSECSecure,
+		},
+		{
+			name:   "wildcard without proof",
+			qName:  "a.example.",
+			qType:  dns.TypeA,
+			answer: sign("a.example.", "*.example. 3600 IN A 192.0.2.1"),
+			ns:     sign("www.example.", "www.example. 3600 IN NSEC example. A RRSIG NSEC"),
+			want:   DNSSECBogus,
+		},
+		{
+			name:  "wildcard NODATA",
+			qName: "a.example.",
+			qType: dns.TypeAAAA,
+			ns:    sign("*.example.", "*.example. 3600 IN NSEC www.example. A RRSIG NSEC"),
+			want:  DNSSECSecure,
+		},
+		{
+			name:  "wildcard NODATA for an existing type",
+			qName: "a.example.",
+			qType: dns.TypeA,
+			ns:    sign("*.example.", "*.example. 3600 IN NSEC www.example. A RRSIG NSEC"),
+			want:  DNSSECBogus,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := check.T(t)
+			msg := new(dns.Msg)
+			msg.SetQuestion(tt.qName, tt.qType)
+			msg.Rcode = tt.rcode
+			msg.Answer = tt.answer
+			msg.Ns = tt.ns
+			status, err := validator.validate(&PluginsState{}, msg)
+			c.Equal(status, tt.want, "Unexpected status (%v)", err)
+			if tt.want == DNSSECBogus {
+				c.Err(err, err)
+			}
+		})
+	}
+}
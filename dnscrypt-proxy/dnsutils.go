@@ -256,6 +256,23 @@ func addEDNS0PaddingIfNoneFound(msg *dns.Msg, unpaddedPacket []byte, paddingLen
 	return msg.Pack()
 }
 
+// ednsClientSubnet returns the EDNS client subnet option of a message, if present
+func ednsClientSubnet(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	if msg == nil {
+		return nil
+	}
+	edns0 := msg.IsEdns0()
+	if edns0 == nil {
+		return nil
+	}
+	for _, option := range edns0.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
 func removeEDNS0Options(msg *dns.Msg) bool {
 	edns0 := msg.IsEdns0()
 	if edns0 == nil {
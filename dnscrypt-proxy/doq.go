@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	DoQALPN          = "doq"
+	DoQNoError       = 0x0
+	DoQInternalError = 0x1
+)
+
+// A DoQ connection is shared by concurrent queries. Every query is sent over
+// its own stream (RFC 9250), so that a lost packet only delays a single query.
+
+type doqConn struct {
+	conn *quic.Conn
+	used bool
+}
+
+type DoQTransport struct {
+	sync.Mutex
+	name        string
+	host        string
+	addr        string
+	hashes      [][]uint8
+	xTransport  *XTransport
+	timeout     time.Duration
+	idleTimeout time.Duration
+	tlsConfig   *tls.Config
+	conn        *doqConn
+}
+
+func NewDoQTransport(proxy *Proxy, name string, host string, addr string, hashes [][]uint8) *DoQTransport {
+	tlsConfig := &tls.Config{
+		ServerName:             host,
+		MinVersion:             tls.VersionTLS13,
+		NextProtos:             []string{DoQALPN},
+		SessionTicketsDisabled: proxy.xTransport.tlsDisableSessionTickets,
+	}
+	if !proxy.xTransport.tlsDisableSessionTickets {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	}
+	return &DoQTransport{
+		name:        name,
+		host:        host,
+		addr:        addr,
+		hashes:      hashes,
+		xTransport:  proxy.xTransport,
+		timeout:     proxy.timeout,
+		idleTimeout: proxy.xTransport.keepAlive + proxy.timeout,
+		tlsConfig:   tlsConfig,
+	}
+}
+
+func (doqTransport *DoQTransport) upstreamAddr() (string, error) {
+	if len(doqTransport.addr) > 0 {
+		return doqTransport.addr, nil
+	}
+	host, port := ExtractHostAndPort(doqTransport.host, DefaultDoQPort)
+	if err := doqTransport.xTransport.resolveAndUpdateCache(host); err != nil {
+		return "", err
+	}
+	ip, _ := doqTransport.xTransport.loadCachedIP(host)
+	if ip == nil {
+		return "", errors.New("Unable to resolve [" + host + "]")
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+}
+
+func (doqTransport *DoQTransport) dial(showCerts bool) (*doqConn, *tls.ConnectionState, error) {
+	if doqTransport.xTransport.proxyDialer != nil {
+		return nil, nil, errors.New("DoQ servers cannot be reached through a proxy")
+	}
+	addr, err := doqTransport.upstreamAddr()
+	if err != nil {
+		return nil, nil, err
+	}
+	quicConfig := &quic.Config{
+		HandshakeIdleTimeout: doqTransport.timeout,
+		MaxIdleTimeout:       doqTransport.idleTimeout,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), doqTransport.timeout)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr, doqTransport.tlsConfig, quicConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsState := conn.ConnectionState().TLS
+	if err := checkCertHashes(doqTransport.name, doqTransport.hashes, &tlsState, showCerts); err != nil {
+		conn.CloseWithError(DoQNoError, "")
+		return nil, nil, err
+	}
+	return &doqConn{conn: conn}, &tlsState, nil
+}
+
+func (xconn *doqConn) isClosed() bool {
+	return xconn.conn.Context().Err() != nil
+}
+
+func (doqTransport *DoQTransport) getConn() (*doqConn, bool, error) {
+	doqTransport.Lock()
+	defer doqTransport.Unlock()
+	if xconn := doqTransport.conn; xconn != nil && !xconn.isClosed() {
+		reused := xconn.used
+		xconn.used = true
+		return xconn, reused, nil
+	}
+	xconn, _, err := doqTransport.dial(false)
+	if err != nil {
+		return nil, false, err
+	}
+	xconn.used = true
+	doqTransport.conn = xconn
+	return xconn, false, nil
+}
+
+func (doqTransport *DoQTransport) exchange(xconn *doqConn, query []byte, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	stream, err := xconn.conn.OpenStreamSync(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, &net.OpError{Op: "dial", Net: "udp", Err: dotTimeoutError{}}
+		}
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	stream.SetDeadline(deadline)
+	packet := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(packet[0:2], uint16(len(query)))
+	copy(packet[2:], query)
+	SetTransactionID(packet[2:], 0)
+	if _, err := stream.Write(packet); err != nil {
+		stream.CancelRead(DoQInternalError)
+		return nil, err
+	}
+	if err := stream.Close(); err != nil {
+		stream.CancelRead(DoQInternalError)
+		return nil, err
+	}
+	response, err := io.ReadAll(io.LimitReader(stream, int64(2+MaxDNSPacketSize+1)))
+	if err != nil {
+		stream.CancelRead(DoQInternalError)
+		return nil, err
+	}
+	if len(response) < 2 || int(binary.BigEndian.Uint16(response[0:2])) != len(response)-2 {
+		return nil, errors.New("Invalid DoQ response")
+	}
+	return response[2:], nil
+}
+
+// Exchange sends a query over a new stream of a shared connection, and returns the response with the original transaction ID.
+func (doqTransport *DoQTransport) Exchange(query []byte, timeout time.Duration) ([]byte, error) {
+	if len(query) < MinDNSPacketSize {
+		return nil, errors.New("Short query")
+	}
+	tid := TransactionID(query)
+	for tries := 2; tries > 0; tries-- {
+		xconn, reused, err := doqTransport.getConn()
+		if err != nil {
+			return nil, err
+		}
+		response, err := doqTransport.exchange(xconn, query, timeout)
+		if err != nil {
+			// The server may have closed an idle connection; retry once using a new one
+			if reused && xconn.isClosed() {
+				dlog.Debugf("[%v] Retrying over a new DoQ connection: %v", doqTransport.name, err)
+				continue
+			}
+			return nil, err
+		}
+		if len(response) < MinDNSPacketSize {
+			return nil, errors.New("Short response")
+		}
+		SetTransactionID(response, tid)
+		return response, nil
+	}
+	return nil, errors.New("Unable to reuse or establish a DoQ connection")
+}
+
+// Probe establishes a new connection and returns the TLS state, for the initial server check.
+func (doqTransport *DoQTransport) Probe(showCerts bool) (*tls.ConnectionState, error) {
+	xconn, tlsState, err := doqTransport.dial(showCerts)
+	if err != nil {
+		return nil, err
+	}
+	doqTransport.Lock()
+	if previous := doqTransport.conn; previous != nil {
+		go previous.conn.CloseWithError(DoQNoError, "")
+	}
+	doqTransport.conn = xconn
+	doqTransport.Unlock()
+	return tlsState, nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// A DoT connection is shared by concurrent queries. Queries are pipelined,
+// and responses are matched with their query using the transaction ID.
+
+type dotResponse struct {
+	packet []byte
+	err    error
+}
+
+type dotConn struct {
+	sync.Mutex
+	conn    net.Conn
+	pending map[uint16]chan dotResponse
+	closed  bool
+	err     error
+	used    bool
+}
+
+type DoTTransport struct {
+	sync.Mutex
+	name        string
+	host        string
+	addr        string
+	hashes      [][]uint8
+	xTransport  *XTransport
+	timeout     time.Duration
+	idleTimeout time.Duration
+	tlsConfig   *tls.Config
+	conn        *dotConn
+}
+
+func NewDoTTransport(proxy *Proxy, name string, host string, addr string, hashes [][]uint8) *DoTTransport {
+	tlsConfig := &tls.Config{
+		ServerName:             host,
+		MinVersion:             tls.VersionTLS12,
+		SessionTicketsDisabled: proxy.xTransport.tlsDisableSessionTickets,
+	}
+	if !proxy.xTransport.tlsDisableSessionTickets {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	}
+	if proxy.xTransport.tlsCipherSuite != nil {
+		tlsConfig.CipherSuites = proxy.xTransport.tlsCipherSuite
+	}
+	return &DoTTransport{
+		name:        name,
+		host:        host,
+		addr:        addr,
+		hashes:      hashes,
+		xTransport:  proxy.xTransport,
+		timeout:     proxy.timeout,
+		idleTimeout: proxy.xTransport.keepAlive + proxy.timeout,
+		tlsConfig:   tlsConfig,
+	}
+}
+
+func (dotTransport *DoTTransport) upstreamAddr() (string, error) {
+	if len(dotTransport.addr) > 0 {
+		return dotTransport.addr, nil
+	}
+	host, port := ExtractHostAndPort(dotTransport.host, DefaultDoTPort)
+	if dotTransport.xTransport.proxyDialer != nil {
+		return net.JoinHostPort(host, strconv.Itoa(port)), nil
+	}
+	if err := dotTransport.xTransport.resolveAndUpdateCache(host); err != nil {
+		return "", err
+	}
+	ip, _ := dotTransport.xTransport.loadCachedIP(host)
+	if ip == nil {
+		return "", errors.New("Unable to resolve [" + host + "]")
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+}
+
+func (dotTransport *DoTTransport) dial(showCerts bool) (*dotConn, *tls.ConnectionState, error) {
+	addr, err := dotTransport.upstreamAddr()
+	if err != nil {
+		return nil, nil, err
+	}
+	var rawConn net.Conn
+	if proxyDialer := dotTransport.xTransport.proxyDialer; proxyDialer == nil {
+		dialer := &net.Dialer{Timeout: dotTransport.timeout, KeepAlive: dotTransport.timeout}
+		rawConn, err = dialer.Dial("tcp", addr)
+	} else {
+		rawConn, err = (*proxyDialer).Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	conn := tls.Client(rawConn, dotTransport.tlsConfig)
+	if err := conn.SetDeadline(time.Now().Add(dotTransport.timeout)); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	tlsState := conn.ConnectionState()
+	if err := checkCertHashes(dotTransport.name, dotTransport.hashes, &tlsState, showCerts); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	xconn := &dotConn{conn: conn, pending: make(map[uint16]chan dotResponse)}
+	go dotTransport.readLoop(xconn)
+	return xconn, &tlsState, nil
+}
+
+func (dotTransport *DoTTransport) readLoop(xconn *dotConn) {
+	for {
+		xconn.conn.SetReadDeadline(time.Now().Add(dotTransport.idleTimeout))
+		packet, err := ReadPrefixed(&xconn.conn)
+		if err != nil {
+			xconn.close(err)
+			return
+		}
+		tid := TransactionID(packet)
+		xconn.Lock()
+		channel, ok := xconn.pending[tid]
+		delete(xconn.pending, tid)
+		xconn.Unlock()
+		if !ok {
+			dlog.Debugf("[%v] Unexpected DoT response", dotTransport.name)
+			continue
+		}
+		channel <- dotResponse{packet: packet}
+	}
+}
+
+func (xconn *dotConn) close(err error) {
+	xconn.Lock()
+	if xconn.closed {
+		xconn.Unlock()
+		return
+	}
+	xconn.closed = true
+	xconn.err = err
+	pending := xconn.pending
+	xconn.pending = make(map[uint16]chan dotResponse)
+	xconn.Unlock()
+	xconn.conn.Close()
+	for _, channel := range pending {
+		channel <- dotResponse{err: err}
+	}
+}
+
+func (dotTransport *DoTTransport) getConn() (*dotConn, error) {
+	dotTransport.Lock()
+	defer dotTransport.Unlock()
+	if xconn := dotTransport.conn; xconn != nil {
+		xconn.Lock()
+		closed := xconn.closed
+		xconn.Unlock()
+		if !closed {
+			return xconn, nil
+		}
+	}
+	xconn, _, err := dotTransport.dial(false)
+	if err != nil {
+		return nil, err
+	}
+	dotTransport.conn = xconn
+	return xconn, nil
+}
+
+func (dotTransport *DoTTransport) exchange(xconn *dotConn, query []byte, timeout time.Duration) ([]byte, error) {
+	channel := make(chan dotResponse, 1)
+	xconn.Lock()
+	if xconn.closed {
+		xconn.Unlock()
+		return nil, xconn.err
+	}
+	var tid uint16
+	for {
+		tid = uint16(rand.Uint32())
+		if _, found := xconn.pending[tid]; !found {
+			break
+		}
+	}
+	xconn.pending[tid] = channel
+	xconn.used = true
+	packet := make([]byte, len(query))
+	copy(packet, query)
+	SetTransactionID(packet, tid)
+	packet, err := PrefixWithSize(packet)
+	if err == nil {
+		xconn.conn.SetWriteDeadline(time.Now().Add(timeout))
+		_, err = xconn.conn.Write(packet)
+	}
+	if err != nil {
+		delete(xconn.pending, tid)
+		xconn.Unlock()
+		xconn.close(err)
+		return nil, err
+	}
+	xconn.Unlock()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case response := <-channel:
+		return response.packet, response.err
+	case <-timer.C:
+		xconn.Lock()
+		delete(xconn.pending, tid)
+		xconn.Unlock()
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: dotTimeoutError{}}
+	}
+}
+
+// Exchange sends a query over a shared connection, and returns the response with the original transaction ID.
+func (dotTransport *DoTTransport) Exchange(query []byte, timeout time.Duration) ([]byte, error) {
+	if len(query) < MinDNSPacketSize {
+		return nil, errors.New("Short query")
+	}
+	tid := TransactionID(query)
+	for tries := 2; tries > 0; tries-- {
+		xconn, err := dotTransport.getConn()
+		if err != nil {
+			return nil, err
+		}
+		xconn.Lock()
+		reused := xconn.used
+		xconn.Unlock()
+		response, err := dotTransport.exchange(xconn, query, timeout)
+		if err != nil {
+			// The server may have closed an idle connection; retry once using a new one
+			if neterr, ok := err.(net.Error); reused && !(ok && neterr.Timeout()) {
+				dlog.Debugf("[%v] Retrying over a new DoT connection: %v", dotTransport.name, err)
+				continue
+			}
+			return nil, err
+		}
+		if len(response) < MinDNSPacketSize {
+			return nil, errors.New("Short response")
+		}
+		SetTransactionID(response, tid)
+		return response, nil
+	}
+	return nil, errors.New("Unable to reuse or establish a DoT connection")
+}
+
+// Probe establishes a new connection and returns the TLS state, for the initial server check.
+func (dotTransport *DoTTransport) Probe(showCerts bool) (*tls.ConnectionState, error) {
+	xconn, tlsState, err := dotTransport.dial(showCerts)
+	if err != nil {
+		return nil, err
+	}
+	dotTransport.Lock()
+	if previous := dotTransport.conn; previous != nil {
+		go previous.close(errors.New("Connection replaced"))
+	}
+	dotTransport.conn = xconn
+	dotTransport.Unlock()
+	return tlsState, nil
+}
+
+type dotTimeoutError struct{}
+
+func (dotTimeoutError) Error() string   { return "i/o timeout" }
+func (dotTimeoutError) Timeout() bool   { return true }
+func (dotTimeoutError) Temporary() bool { return true }
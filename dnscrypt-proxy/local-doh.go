@@ -87,7 +87,7 @@ func (proxy *Proxy) localDoHListener(acceptPc *net.TCPListener) {
 	}
 	httpServer := &http.Server{
 		ReadTimeout:  proxy.timeout,
-		WriteTimeout: proxy.timeout,
+		WriteTimeout: proxy.clientDeadline,
 		Handler:      localDoHHandler{proxy: proxy},
 	}
 	httpServer.SetKeepAlivesEnabled(true)
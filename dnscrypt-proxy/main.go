@@ -38,6 +38,13 @@ func main() {
 		dlog.Fatal("Unable to find the path to the current directory")
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "cache" {
+		if err := CacheCommand(os.Args[2:]); err != nil {
+			dlog.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
 	svcFlag := flag.String("service", "", fmt.Sprintf("Control the system service: %q", service.ControlAction))
 	version := flag.Bool("version", false, "print current proxy version")
 	resolve := flag.String("resolve", "", "resolve a name using system libraries")
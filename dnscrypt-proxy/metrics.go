@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jedisct1/dlog"
+)
+
+type Metrics struct {
+	sync.Mutex
+	returnCodes    map[PluginsReturnCode]uint64
+	serverFailures map[string]uint64
+	cacheHits      uint64
+	cacheMisses    uint64
+	cacheStale     uint64
+	cacheForced    uint64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		returnCodes:    make(map[PluginsReturnCode]uint64),
+		serverFailures: make(map[string]uint64),
+	}
+}
+
+// All the counting functions can be called on a nil receiver, when metrics are disabled
+
+func (metrics *Metrics) countReturnCode(returnCode PluginsReturnCode) {
+	if metrics == nil {
+		return
+	}
+	metrics.Lock()
+	metrics.returnCodes[returnCode]++
+	metrics.Unlock()
+}
+
+func (metrics *Metrics) countServerFailure(name string) {
+	if metrics == nil {
+		return
+	}
+	metrics.Lock()
+	metrics.serverFailures[name]++
+	metrics.Unlock()
+}
+
+func (metrics *Metrics) countCacheHit() {
+	if metrics != nil {
+		atomic.AddUint64(&metrics.cacheHits, 1)
+	}
+}
+
+func (metrics *Metrics) countCacheMiss() {
+	if metrics != nil {
+		atomic.AddUint64(&metrics.cacheMisses, 1)
+	}
+}
+
+func (metrics *Metrics) countCacheStale() {
+	if metrics != nil {
+		atomic.AddUint64(&metrics.cacheStale, 1)
+	}
+}
+
+func (metrics *Metrics) countCacheForced() {
+	if metrics != nil {
+		atomic.AddUint64(&metrics.cacheForced, 1)
+	}
+}
+
+func metricsLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+type metricsWriter struct {
+	bytes.Buffer
+}
+
+func (writer *metricsWriter) header(name string, metricType string, help string) {
+	fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func (writer *metricsWriter) value(name string, value interface{}) {
+	fmt.Fprintf(writer, "%s %v\n", name, value)
+}
+
+func (writer *metricsWriter) labeledValue(name string, label string, labelValue string, value interface{}) {
+	fmt.Fprintf(writer, "%s{%s=\"%s\"} %v\n", name, label, metricsLabelValue(labelValue), value)
+}
+
+func (writer *metricsWriter) labeledValues(name string, labels []string, labelValues []string, value interface{}) {
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", label, metricsLabelValue(labelValues[i]))
+	}
+	fmt.Fprintf(writer, "%s{%s} %v\n", name, strings.Join(pairs, ","), value)
+}
+
+func (proxy *Proxy) writeMetrics(writer *metricsWriter) {
+	metrics := proxy.metrics
+
+	metrics.Lock()
+	returnCodes := make([]int, 0, len(PluginsReturnCodeToString))
+	for returnCode := range PluginsReturnCodeToString {
+		returnCodes = append(returnCodes, int(returnCode))
+	}
+	sort.Ints(returnCodes)
+	writer.header("dnscrypt_proxy_queries_total", "counter", "Number of processed queries, by return code.")
+	for _, returnCode := range returnCodes {
+		writer.labeledValue("dnscrypt_proxy_queries_total", "return_code", PluginsReturnCodeToString[PluginsReturnCode(returnCode)],
+			metrics.returnCodes[PluginsReturnCode(returnCode)])
+	}
+	serverFailures := make(map[string]uint64, len(metrics.serverFailures))
+	for name, count := range metrics.serverFailures {
+		serverFailures[name] = count
+	}
+	metrics.Unlock()
+
+	writer.header("dnscrypt_proxy_cache_hits_total", "counter", "Number of queries answered from the cache.")
+	writer.value("dnscrypt_proxy_cache_hits_total", atomic.LoadUint64(&metrics.cacheHits))
+	writer.header("dnscrypt_proxy_cache_misses_total", "counter", "Number of queries not found in the cache.")
+	writer.value("dnscrypt_proxy_cache_misses_total", atomic.LoadUint64(&metrics.cacheMisses))
+	writer.header("dnscrypt_proxy_cache_stale_total", "counter", "Number of expired cache entries kept as a fallback.")
+	writer.value("dnscrypt_proxy_cache_stale_total", atomic.LoadUint64(&metrics.cacheStale))
+	writer.header("dnscrypt_proxy_cache_forced_total", "counter", "Number of queries answered from expired cache entries.")
+	writer.value("dnscrypt_proxy_cache_forced_total", atomic.LoadUint64(&metrics.cacheForced))
+
+	cacheEntries := cachedResponses.Len()
+	writer.header("dnscrypt_proxy_cache_entries", "gauge", "Number of entries in the cache.")
+	writer.value("dnscrypt_proxy_cache_entries", cacheEntries)
+	writer.header("dnscrypt_proxy_cache_capacity", "gauge", "Maximum number of entries in the cache.")
+	writer.value("dnscrypt_proxy_cache_capacity", proxy.cacheSize)
+	writer.header("dnscrypt_proxy_cache_memory_bytes", "gauge", "Packed size of the cached responses.")
+	writer.value("dnscrypt_proxy_cache_memory_bytes", cachedResponses.MemoryUsage())
+	writer.header("dnscrypt_proxy_cache_max_memory_bytes", "gauge", "Maximum packed size of the cached responses, 0 if unlimited.")
+	writer.value("dnscrypt_proxy_cache_max_memory_bytes", proxy.cacheMaxMemory)
+
+	type serverRtt struct {
+		name     string
+		rtt      float64
+		protocol string
+	}
+	var serverRtts []serverRtt
+	proxy.serversInfo.RLock()
+	for _, serverInfo := range proxy.serversInfo.inner {
+		server := serverRtt{name: serverInfo.Name, rtt: serverInfo.rtt.Value()}
+		if serverInfo.odohRelayURL != nil {
+			server.protocol = proxy.xTransport.negotiatedProtocol(serverInfo.odohRelayURL.Host)
+		} else if serverInfo.URL != nil {
+			server.protocol = proxy.xTransport.negotiatedProtocol(serverInfo.URL.Host)
+		}
+		serverRtts = append(serverRtts, server)
+	}
+	proxy.serversInfo.RUnlock()
+	sort.Slice(serverRtts, func(i, j int) bool { return serverRtts[i].name < serverRtts[j].name })
+	writer.header("dnscrypt_proxy_server_rtt_milliseconds", "gauge", "Moving average of the response time of each server.")
+	for _, server := range serverRtts {
+		writer.labeledValue("dnscrypt_proxy_server_rtt_milliseconds", "server", server.name, server.rtt)
+	}
+	writer.header("dnscrypt_proxy_server_http_protocol", "gauge", "HTTP version negotiated with each DoH and ODoH server.")
+	for _, server := range serverRtts {
+		if len(server.protocol) > 0 {
+			writer.labeledValues("dnscrypt_proxy_server_http_protocol", []string{"server", "protocol"}, []string{server.name, server.protocol}, 1)
+		}
+	}
+	names := make([]string, 0, len(serverFailures))
+	for name := range serverFailures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	writer.header("dnscrypt_proxy_server_failures_total", "counter", "Number of failed queries, by server.")
+	for _, name := range names {
+		writer.labeledValue("dnscrypt_proxy_server_failures_total", "server", name, serverFailures[name])
+	}
+
+	writer.header("dnscrypt_proxy_clients", "gauge", "Number of clients being served.")
+	writer.value("dnscrypt_proxy_clients", atomic.LoadUint32(&proxy.clientsCount))
+	writer.header("dnscrypt_proxy_max_clients", "gauge", "Maximum number of clients that can be served simultaneously.")
+	writer.value("dnscrypt_proxy_max_clients", proxy.maxClients)
+}
+
+type metricsHandler struct {
+	proxy *Proxy
+}
+
+func (handler metricsHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	proxy := handler.proxy
+	writer.Header().Set("Server", "dnscrypt-proxy")
+	if request.URL.Path != proxy.metricsPath {
+		writer.WriteHeader(404)
+		return
+	}
+	if request.Method != "GET" && request.Method != "HEAD" {
+		writer.WriteHeader(405)
+		return
+	}
+	var metricsWriter metricsWriter
+	proxy.writeMetrics(&metricsWriter)
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writer.Write(metricsWriter.Bytes())
+}
+
+func (proxy *Proxy) startMetricsListener() {
+	listener, err := net.Listen("tcp", proxy.metricsListenAddress)
+	if err != nil {
+		dlog.Fatalf("Unable to start the metrics listener: %v", err)
+	}
+	dlog.Noticef("Now listening to http://%v%v [metrics]", proxy.metricsListenAddress, proxy.metricsPath)
+	go func() {
+		if err := http.Serve(listener, metricsHandler{proxy: proxy}); err != nil {
+			dlog.Errorf("Metrics listener: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	crypto_rand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"net/url"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Oblivious DNS-over-HTTPS (RFC 9230), using HPKE (RFC 9180) in base mode
+// with DHKEM(X25519, HKDF-SHA256), HKDF-SHA256 and AES-128-GCM.
+
+const (
+	ODoHVersion     = 0x0001
+	ODoHContentType = "application/oblivious-dns-message"
+	ODoHConfigsPath = "/.well-known/odohconfigs"
+
+	odohKEMX25519     = 0x0020
+	odohKDFSHA256     = 0x0001
+	odohAEADAES128GCM = 0x0001
+
+	odohMessageTypeQuery    = 0x01
+	odohMessageTypeResponse = 0x02
+
+	hpkeNk = 16
+	hpkeNn = 12
+	hpkeNh = sha256.Size
+)
+
+var (
+	hpkeKEMSuiteID = []byte{'K', 'E', 'M', 0x00, odohKEMX25519}
+	hpkeSuiteID    = []byte{'H', 'P', 'K', 'E', 0x00, odohKEMX25519, 0x00, odohKDFSHA256, 0x00, odohAEADAES128GCM}
+)
+
+type ODoHTargetConfig struct {
+	publicKey []byte
+	keyID     []byte
+}
+
+type odohQueryContext struct {
+	secret         []byte
+	encryptedQuery []byte
+}
+
+func hkdfExtract(salt []byte, ikm []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+func hkdfExpand(prk []byte, info []byte, length int) []byte {
+	var out, t []byte
+	for counter := byte(1); len(out) < length; counter++ {
+		mac := hmac.New(sha256.New, prk)
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{counter})
+		t = mac.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:length]
+}
+
+func hpkeLabeledExtract(suiteID []byte, salt []byte, label string, ikm []byte) []byte {
+	labeledIKM := append([]byte("HPKE-v1"), suiteID...)
+	labeledIKM = append(labeledIKM, label...)
+	labeledIKM = append(labeledIKM, ikm...)
+	return hkdfExtract(salt, labeledIKM)
+}
+
+func hpkeLabeledExpand(suiteID []byte, prk []byte, label string, info []byte, length int) []byte {
+	labeledInfo := []byte{byte(length >> 8), byte(length)}
+	labeledInfo = append(labeledInfo, "HPKE-v1"...)
+	labeledInfo = append(labeledInfo, suiteID...)
+	labeledInfo = append(labeledInfo, label...)
+	labeledInfo = append(labeledInfo, info...)
+	return hkdfExpand(prk, labeledInfo, length)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type hpkeSenderContext struct {
+	aead           cipher.AEAD
+	baseNonce      []byte
+	exporterSecret []byte
+}
+
+func hpkeSetupBaseSender(pkR []byte, info []byte) ([]byte, *hpkeSenderContext, error) {
+	skE := make([]byte, curve25519.ScalarSize)
+	if _, err := crypto_rand.Read(skE); err != nil {
+		return nil, nil, err
+	}
+	return hpkeSetupBaseSenderWithKey(skE, pkR, info)
+}
+
+func hpkeSetupBaseSenderWithKey(skE []byte, pkR []byte, info []byte) ([]byte, *hpkeSenderContext, error) {
+	pkE, err := curve25519.X25519(skE, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh, err := curve25519.X25519(skE, pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+	kemContext := append(append([]byte{}, pkE...), pkR...)
+	eaePrk := hpkeLabeledExtract(hpkeKEMSuiteID, nil, "eae_prk", dh)
+	sharedSecret := hpkeLabeledExpand(hpkeKEMSuiteID, eaePrk, "shared_secret", kemContext, hpkeNh)
+	context, err := hpkeKeySchedule(sharedSecret, info)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pkE, context, nil
+}
+
+func hpkeKeySchedule(sharedSecret []byte, info []byte) (*hpkeSenderContext, error) {
+	pskIDHash := hpkeLabeledExtract(hpkeSuiteID, nil, "psk_id_hash", nil)
+	infoHash := hpkeLabeledExtract(hpkeSuiteID, nil, "info_hash", info)
+	keyScheduleContext := append([]byte{0x00}, pskIDHash...)
+	keyScheduleContext = append(keyScheduleContext, infoHash...)
+	secret := hpkeLabeledExtract(hpkeSuiteID, sharedSecret, "secret", nil)
+	key := hpkeLabeledExpand(hpkeSuiteID, secret, "key", keyScheduleContext, hpkeNk)
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &hpkeSenderContext{
+		aead:           aead,
+		baseNonce:      hpkeLabeledExpand(hpkeSuiteID, secret, "base_nonce", keyScheduleContext, hpkeNn),
+		exporterSecret: hpkeLabeledExpand(hpkeSuiteID, secret, "exp", keyScheduleContext, hpkeNh),
+	}, nil
+}
+
+// Only a single message is ever sealed, so the sequence number is always 0
+func (context *hpkeSenderContext) seal(aad []byte, plaintext []byte) []byte {
+	return context.aead.Seal(nil, context.baseNonce, plaintext, aad)
+}
+
+func (context *hpkeSenderContext) export(exporterContext []byte, length int) []byte {
+	return hpkeLabeledExpand(hpkeSuiteID, context.exporterSecret, "sec", exporterContext, length)
+}
+
+func appendU16Prefixed(bin []byte, data []byte) []byte {
+	bin = append(bin, byte(len(data)>>8), byte(len(data)))
+	return append(bin, data...)
+}
+
+func readU16Prefixed(bin []byte) ([]byte, []byte, error) {
+	if len(bin) < 2 {
+		return nil, nil, errors.New("Short ODoH message")
+	}
+	length := int(binary.BigEndian.Uint16(bin))
+	if length > len(bin)-2 {
+		return nil, nil, errors.New("Short ODoH message")
+	}
+	return bin[2 : 2+length], bin[2+length:], nil
+}
+
+// ParseODoHTargetConfigs returns the configurations supported by this implementation, from a list served by a target
+func ParseODoHTargetConfigs(configs []byte) ([]ODoHTargetConfig, error) {
+	configs, rest, err := readU16Prefixed(configs)
+	if err != nil || len(rest) != 0 {
+		return nil, errors.New("Invalid ODoH configuration list")
+	}
+	var targetConfigs []ODoHTargetConfig
+	for len(configs) > 0 {
+		if len(configs) < 2 {
+			return nil, errors.New("Invalid ODoH configuration")
+		}
+		version := binary.BigEndian.Uint16(configs)
+		var contents []byte
+		if contents, configs, err = readU16Prefixed(configs[2:]); err != nil {
+			return nil, errors.New("Invalid ODoH configuration")
+		}
+		if version != ODoHVersion || len(contents) < 8 {
+			continue
+		}
+		kemID := binary.BigEndian.Uint16(contents[0:2])
+		kdfID := binary.BigEndian.Uint16(contents[2:4])
+		aeadID := binary.BigEndian.Uint16(contents[4:6])
+		if kemID != odohKEMX25519 || kdfID != odohKDFSHA256 || aeadID != odohAEADAES128GCM {
+			continue
+		}
+		publicKey, rest, err := readU16Prefixed(contents[6:])
+		if err != nil || len(rest) != 0 || len(publicKey) != curve25519.PointSize {
+			continue
+		}
+		targetConfigs = append(targetConfigs, ODoHTargetConfig{
+			publicKey: publicKey,
+			keyID:     hkdfExpand(hkdfExtract(nil, contents), []byte("odoh key id"), hpkeNh),
+		})
+	}
+	if len(targetConfigs) == 0 {
+		return nil, errors.New("No supported ODoH configuration")
+	}
+	return targetConfigs, nil
+}
+
+func (targetConfig *ODoHTargetConfig) encryptQuery(query []byte) ([]byte, *odohQueryContext, error) {
+	plaintext := appendU16Prefixed(nil, query)
+	plaintext = appendU16Prefixed(plaintext, nil) // queries are already padded using EDNS0
+	enc, context, err := hpkeSetupBaseSender(targetConfig.publicKey, []byte("odoh query"))
+	if err != nil {
+		return nil, nil, err
+	}
+	aad := appendU16Prefixed([]byte{odohMessageTypeQuery}, targetConfig.keyID)
+	encryptedQuery := append(enc, context.seal(aad, plaintext)...)
+	message := appendU16Prefixed([]byte{odohMessageTypeQuery}, targetConfig.keyID)
+	message = appendU16Prefixed(message, encryptedQuery)
+	queryContext := odohQueryContext{
+		secret:         context.export([]byte("odoh response"), hpkeNk),
+		encryptedQuery: encryptedQuery,
+	}
+	return message, &queryContext, nil
+}
+
+func (queryContext *odohQueryContext) decryptResponse(message []byte) ([]byte, error) {
+	if len(message) < 1 || message[0] != odohMessageTypeResponse {
+		return nil, errors.New("Unexpected ODoH message type")
+	}
+	responseNonce, rest, err := readU16Prefixed(message[1:])
+	if err != nil {
+		return nil, err
+	}
+	encryptedResponse, rest, err := readU16Prefixed(rest)
+	if err != nil || len(rest) != 0 {
+		return nil, errors.New("Invalid ODoH response")
+	}
+	salt := append(append([]byte{}, queryContext.encryptedQuery...), responseNonce...)
+	prk := hkdfExtract(salt, queryContext.secret)
+	aead, err := newAESGCM(hkdfExpand(prk, []byte("odoh key"), hpkeNk))
+	if err != nil {
+		return nil, err
+	}
+	aad := appendU16Prefixed([]byte{odohMessageTypeResponse}, responseNonce)
+	plaintext, err := aead.Open(nil, hkdfExpand(prk, []byte("odoh nonce"), hpkeNn), encryptedResponse, aad)
+	if err != nil {
+		return nil, errors.New("Unable to decrypt the ODoH response")
+	}
+	response, _, err := readU16Prefixed(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func odohRelayURL(relayURL *url.URL, targetURL *url.URL) *url.URL {
+	qs := relayURL.Query()
+	qs.Set("targethost", targetURL.Host)
+	qs.Set("targetpath", targetURL.Path)
+	url2 := *relayURL
+	url2.RawQuery = qs.Encode()
+	return &url2
+}
+
+// ODoHQuery encrypts a query for the target, sends it either directly or through a relay, and decrypts the response
+func (httpTransport *HTTPTransport) ODoHQuery(targetConfig *ODoHTargetConfig, url *url.URL, query []byte, timeout time.Duration) ([]byte, *tls.ConnectionState, time.Duration, error) {
+	encryptedQuery, queryContext, err := targetConfig.encryptQuery(query)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	encryptedResponse, tls, rtt, err := httpTransport.Post(url, ODoHContentType, ODoHContentType, &encryptedQuery, timeout)
+	if err != nil {
+		return nil, tls, rtt, err
+	}
+	response, err := queryContext.decryptResponse(encryptedResponse)
+	return response, tls, rtt, err
+}
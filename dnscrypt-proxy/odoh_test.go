@@ -0,0 +1,165 @@
+package main
+
+import (
+	crypto_rand "crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/powerman/check"
+	"golang.org/x/crypto/curve25519"
+)
+
+func odohTestHex(t *testing.T, s string) []byte {
+	bin, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bin
+}
+
+// odohTestReceiverContext is the target side of hpkeSetupBaseSender
+func odohTestReceiverContext(t *testing.T, skR []byte, enc []byte, info []byte) *hpkeSenderContext {
+	pkR, err := curve25519.X25519(skR, curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dh, err := curve25519.X25519(skR, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kemContext := append(append([]byte{}, enc...), pkR...)
+	eaePrk := hpkeLabeledExtract(hpkeKEMSuiteID, nil, "eae_prk", dh)
+	sharedSecret := hpkeLabeledExpand(hpkeKEMSuiteID, eaePrk, "shared_secret", kemContext, hpkeNh)
+	context, err := hpkeKeySchedule(sharedSecret, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return context
+}
+
+// RFC 9180 A.1.1: DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-128-GCM, base mode
+func TestHPKE(t *testing.T) {
+	c := check.T(t)
+	h := func(s string) []byte { return odohTestHex(t, s) }
+	info := h("4f6465206f6e2061204772656369616e2055726e")
+	skEm := h("52c4a758a802cd8b936eceea314432798d5baf2d7e9235dc084ab1b9cfa2f736")
+	skRm := h("4612c550263fc8ad58375df3f557aac531d26850903e55a9f23f21d8534e8ac8")
+	pkRm := h("3948cfe0ad1ddb695d780e59077195da6c56506b027329794ab02bca80815c4d")
+
+	enc, context, err := hpkeSetupBaseSenderWithKey(skEm, pkRm, info)
+	c.Must(c.Nil(err))
+	c.DeepEqual(enc, h("37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431"))
+	c.DeepEqual(context.baseNonce, h("56d890e5accaaf011cff4b7d"))
+	c.DeepEqual(context.exporterSecret, h("45ff1c2e220db587171952c0592d5f5ebe103f1561a2614e38f2ffd47e99e3f8"))
+
+	pt := h("4265617574792069732074727574682c20747275746820626561757479")
+	aad := h("436f756e742d30")
+	ct := h("f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a")
+	c.DeepEqual(context.seal(aad, pt), ct)
+
+	receiverContext := odohTestReceiverContext(t, skRm, enc, info)
+	opened, err := receiverContext.aead.Open(nil, receiverContext.baseNonce, ct, aad)
+	c.Nil(err)
+	c.DeepEqual(opened, pt)
+
+	for _, tt := range []struct {
+		exporterContext string
+		want            string
+	}{
+		{"", "3853fe2b4035195a573ffc53856e77058e15d9ea064de3e59f4961d0095250ee"},
+		{"00", "2e8f0b54673c7029649d4eb9d5e33bf1872cf76d623ff164ac185da9e88c21a5"},
+		{"54657374436f6e74657874", "e9e43065102c3836401bed8c3c3c75ae46be1639869391d62c61f1ec7af54931"},
+	} {
+		c.DeepEqual(context.export(h(tt.exporterContext), 32), h(tt.want), "Exporter context [%s]", tt.exporterContext)
+	}
+}
+
+// odohTestTarget answers an encrypted query the way a RFC 9230 target does
+func odohTestTarget(t *testing.T, skR []byte, message []byte, answer func(query []byte) []byte) []byte {
+	c := check.T(t)
+	c.Must(c.True(len(message) > 0 && message[0] == odohMessageTypeQuery, "Not an ODoH query"))
+	keyID, rest, err := readU16Prefixed(message[1:])
+	c.Must(c.Nil(err))
+	encryptedQuery, rest, err := readU16Prefixed(rest)
+	c.Must(c.Nil(err))
+	c.Must(c.Len(rest, 0))
+	c.Must(c.True(len(encryptedQuery) > curve25519.PointSize, "Short encrypted query"))
+	enc, ct := encryptedQuery[:curve25519.PointSize], encryptedQuery[curve25519.PointSize:]
+	context := odohTestReceiverContext(t, skR, enc, []byte("odoh query"))
+	aad := appendU16Prefixed([]byte{odohMessageTypeQuery}, keyID)
+	plaintext, err := context.aead.Open(nil, context.baseNonce, ct, aad)
+	c.Must(c.Nil(err))
+	query, padding, err := readU16Prefixed(plaintext)
+	c.Must(c.Nil(err))
+	padding, _, err = readU16Prefixed(padding)
+	c.Must(c.Nil(err))
+	c.Len(padding, 0)
+
+	secret := context.export([]byte("odoh response"), hpkeNk)
+	responseNonce := make([]byte, hpkeNk)
+	_, _ = crypto_rand.Read(responseNonce)
+	prk := hkdfExtract(append(append([]byte{}, encryptedQuery...), responseNonce...), secret)
+	aead, err := newAESGCM(hkdfExpand(prk, []byte("odoh key"), hpkeNk))
+	c.Must(c.Nil(err))
+	responsePlaintext := appendU16Prefixed(nil, answer(query))
+	responsePlaintext = appendU16Prefixed(responsePlaintext, make([]byte, 8))
+	responseAAD := appendU16Prefixed([]byte{odohMessageTypeResponse}, responseNonce)
+	encryptedResponse := aead.Seal(nil, hkdfExpand(prk, []byte("odoh nonce"), hpkeNn), responsePlaintext, responseAAD)
+	response := appendU16Prefixed([]byte{odohMessageTypeResponse}, responseNonce)
+	return appendU16Prefixed(response, encryptedResponse)
+}
+
+func TestODoH(t *testing.T) {
+	c := check.T(t)
+	skR := make([]byte, curve25519.ScalarSize)
+	_, _ = crypto_rand.Read(skR)
+	pkR, err := curve25519.X25519(skR, curve25519.Basepoint)
+	c.Must(c.Nil(err))
+
+	// An unsupported configuration, followed by the one we use
+	var contents []byte
+	contents = append(contents, 0x00, odohKEMX25519, 0x00, odohKDFSHA256, 0x00, odohAEADAES128GCM)
+	contents = appendU16Prefixed(contents, pkR)
+	configs := appendU16Prefixed([]byte{0x00, 0x02}, []byte{0x00, 0x00})
+	configs = appendU16Prefixed(append(configs, 0x00, ODoHVersion), contents)
+	targetConfigs, err := ParseODoHTargetConfigs(appendU16Prefixed(nil, configs))
+	c.Must(c.Nil(err))
+	c.Must(c.Len(targetConfigs, 1))
+	targetConfig := targetConfigs[0]
+	c.DeepEqual(targetConfig.publicKey, pkR)
+	c.DeepEqual(targetConfig.keyID, hkdfExpand(hkdfExtract(nil, contents), []byte("odoh key id"), hpkeNh))
+
+	msg := dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeA)
+	query, err := msg.Pack()
+	c.Must(c.Nil(err))
+	message, queryContext, err := targetConfig.encryptQuery(query)
+	c.Must(c.Nil(err))
+	var receivedQuery []byte
+	encryptedResponse := odohTestTarget(t, skR, message, func(query []byte) []byte {
+		receivedQuery = query
+		reply := dns.Msg{}
+		reply.SetReply(&msg)
+		packet, err := reply.Pack()
+		c.Must(c.Nil(err))
+		return packet
+	})
+	c.DeepEqual(receivedQuery, query)
+	response, err := queryContext.decryptResponse(encryptedResponse)
+	c.Must(c.Nil(err))
+	reply := dns.Msg{}
+	c.Nil(reply.Unpack(response))
+	c.Equal(reply.Id, msg.Id)
+	c.True(reply.Response)
+
+	tampered := append([]byte{}, encryptedResponse...)
+	tampered[len(tampered)-1] ^= 0xff
+	_, err = queryContext.decryptResponse(tampered)
+	c.Match(err, "Unable to decrypt the ODoH response")
+	_, err = queryContext.decryptResponse(encryptedResponse[:len(encryptedResponse)-1])
+	c.NotNil(err)
+
+	_, err = ParseODoHTargetConfigs(appendU16Prefixed(nil, []byte{0x00, 0x02, 0x00, 0x00}))
+	c.Match(err, "No supported ODoH configuration")
+}
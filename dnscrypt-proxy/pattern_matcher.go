@@ -4,6 +4,7 @@
 	"fmt"
 	"path/filepath"
 	"strings"
+	"unicode"
 
 	"github.com/k-sone/critbitgo"
 
@@ -159,3 +160,47 @@ func (patternMatcher *PatternMatcher) Eval(qName string) (reject bool, reason st
 
 	return false, "", nil
 }
+
+// loadNamePatterns reads a file of name patterns, each optionally followed by `@schedule`.
+// Invalid lines are logged and skipped; their number is returned so that callers can
+// decide whether a partially valid file is acceptable.
+func loadNamePatterns(fileName string, allWeeklyRanges *map[string]WeeklyRanges, rulesName string) (*PatternMatcher, int, error) {
+	bin, err := ReadTextFile(fileName)
+	if err != nil {
+		return nil, 0, err
+	}
+	patternMatcher := NewPatternMatcher()
+	syntaxErrors := 0
+	for lineNo, line := range strings.Split(string(bin), "\n") {
+		line = TrimAndStripInlineComments(line)
+		if len(line) == 0 {
+			continue
+		}
+		parts := strings.Split(line, "@")
+		timeRangeName := ""
+		if len(parts) == 2 {
+			line = strings.TrimFunc(parts[0], unicode.IsSpace)
+			timeRangeName = strings.TrimFunc(parts[1], unicode.IsSpace)
+		} else if len(parts) > 2 {
+			dlog.Errorf("Syntax error in %s rules at line %d -- Unexpected @ character", rulesName, 1+lineNo)
+			syntaxErrors++
+			continue
+		}
+		var weeklyRanges *WeeklyRanges
+		if len(timeRangeName) > 0 {
+			weeklyRangesX, ok := (*allWeeklyRanges)[timeRangeName]
+			if !ok {
+				dlog.Errorf("Time range [%s] not found at line %d", timeRangeName, 1+lineNo)
+				syntaxErrors++
+			} else {
+				weeklyRanges = &weeklyRangesX
+			}
+		}
+		if err := patternMatcher.Add(line, weeklyRanges, lineNo+1); err != nil {
+			dlog.Error(err)
+			syntaxErrors++
+			continue
+		}
+	}
+	return patternMatcher, syntaxErrors, nil
+}
@@ -14,6 +14,7 @@
 )
 
 type PluginBlockIP struct {
+	fileName        string
 	blockedPrefixes *iradix.Tree
 	blockedIPs      map[string]interface{}
 	logger          io.Writer
@@ -29,13 +30,31 @@ func (plugin *PluginBlockIP) Description() string {
 }
 
 func (plugin *PluginBlockIP) Init(proxy *Proxy) error {
-	dlog.Noticef("Loading the set of IP blocking rules from [%s]", proxy.blockIPFile)
-	bin, err := ReadTextFile(proxy.blockIPFile)
+	plugin.fileName = proxy.blockIPFile
+	dlog.Noticef("Loading the set of IP blocking rules from [%s]", plugin.fileName)
+	blockedPrefixes, blockedIPs, _, err := loadBlockedIPs(plugin.fileName)
 	if err != nil {
 		return err
 	}
-	plugin.blockedPrefixes = iradix.New()
-	plugin.blockedIPs = make(map[string]interface{})
+	plugin.blockedPrefixes = blockedPrefixes
+	plugin.blockedIPs = blockedIPs
+	if len(proxy.blockIPLogFile) == 0 {
+		return nil
+	}
+	plugin.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.blockIPLogFile)
+	plugin.format = proxy.blockIPFormat
+
+	return nil
+}
+
+func loadBlockedIPs(fileName string) (*iradix.Tree, map[string]interface{}, int, error) {
+	bin, err := ReadTextFile(fileName)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	blockedPrefixes := iradix.New()
+	blockedIPs := make(map[string]interface{})
+	syntaxErrors := 0
 	for lineNo, line := range strings.Split(string(bin), "\n") {
 		line = TrimAndStripInlineComments(line)
 		if len(line) == 0 {
@@ -45,6 +64,7 @@ func (plugin *PluginBlockIP) Init(proxy *Proxy) error {
 		trailingStar := strings.HasSuffix(line, "*")
 		if len(line) < 2 || (ip != nil && trailingStar) {
 			dlog.Errorf("Suspicious IP blocking rule [%s] at line %d", line, lineNo)
+			syntaxErrors++
 			continue
 		}
 		if trailingStar {
@@ -55,26 +75,22 @@ func (plugin *PluginBlockIP) Init(proxy *Proxy) error {
 		}
 		if len(line) == 0 {
 			dlog.Errorf("Empty IP blocking rule at line %d", lineNo)
+			syntaxErrors++
 			continue
 		}
 		if strings.Contains(line, "*") {
 			dlog.Errorf("Invalid rule: [%s] - wildcards can only be used as a suffix at line %d", line, lineNo)
+			syntaxErrors++
 			continue
 		}
 		line = strings.ToLower(line)
 		if trailingStar {
-			plugin.blockedPrefixes, _, _ = plugin.blockedPrefixes.Insert([]byte(line), 0)
+			blockedPrefixes, _, _ = blockedPrefixes.Insert([]byte(line), 0)
 		} else {
-			plugin.blockedIPs[line] = true
+			blockedIPs[line] = true
 		}
 	}
-	if len(proxy.blockIPLogFile) == 0 {
-		return nil
-	}
-	plugin.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.blockIPLogFile)
-	plugin.format = proxy.blockIPFormat
-
-	return nil
+	return blockedPrefixes, blockedIPs, syntaxErrors, nil
 }
 
 func (plugin *PluginBlockIP) Drop() error {
@@ -82,7 +98,22 @@ func (plugin *PluginBlockIP) Drop() error {
 }
 
 func (plugin *PluginBlockIP) Reload() error {
-	return nil
+	return reloadRules(plugin)
+}
+
+func (plugin *PluginBlockIP) loadRules() (func(), error) {
+	dlog.Noticef("Reloading the set of IP blocking rules from [%s]", plugin.fileName)
+	blockedPrefixes, blockedIPs, syntaxErrors, err := loadBlockedIPs(plugin.fileName)
+	if err != nil {
+		return nil, err
+	}
+	if syntaxErrors > 0 {
+		return nil, fmt.Errorf("%d invalid rule(s) in [%s]", syntaxErrors, plugin.fileName)
+	}
+	return func() {
+		plugin.blockedPrefixes = blockedPrefixes
+		plugin.blockedIPs = blockedIPs
+	}, nil
 }
 
 func (plugin *PluginBlockIP) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
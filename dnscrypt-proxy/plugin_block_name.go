@@ -5,9 +5,7 @@
 	"fmt"
 	"io"
 	"net"
-	"strings"
 	"time"
-	"unicode"
 
 	"github.com/jedisct1/dlog"
 	"github.com/miekg/dns"
@@ -73,6 +71,19 @@ func (blockedNames *BlockedNames) check(pluginsState *PluginsState, qName string
 // ---
 
 type PluginBlockName struct {
+	fileName        string
+	allWeeklyRanges *map[string]WeeklyRanges
+	clientGroups    *ClientGroups
+	logger          io.Writer
+	format          string
+}
+
+// blockedNamesFor returns the blocking rules applying to the client of a query
+func blockedNamesFor(pluginsState *PluginsState) *BlockedNames {
+	if group := pluginsState.clientGroup; group != nil && group.blockNameFile != nil {
+		return group.blockedNames
+	}
+	return blockedNames
 }
 
 func (plugin *PluginBlockName) Name() string {
@@ -83,51 +94,49 @@ func (plugin *PluginBlockName) Description() string {
 	return "Block DNS queries matching name patterns"
 }
 
-func (plugin *PluginBlockName) Init(proxy *Proxy) error {
-	dlog.Noticef("Loading the set of blocking rules from [%s]", proxy.blockNameFile)
-	bin, err := ReadTextFile(proxy.blockNameFile)
+func (plugin *PluginBlockName) loadBlockedNames(fileName string, allWeeklyRanges *map[string]WeeklyRanges, strict bool) (*BlockedNames, error) {
+	patternMatcher, syntaxErrors, err := loadNamePatterns(fileName, allWeeklyRanges, "block")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	xBlockedNames := BlockedNames{
-		allWeeklyRanges: proxy.allWeeklyRanges,
-		patternMatcher:  NewPatternMatcher(),
+	if strict && syntaxErrors > 0 {
+		return nil, fmt.Errorf("%d invalid rule(s) in [%s]", syntaxErrors, fileName)
 	}
-	for lineNo, line := range strings.Split(string(bin), "\n") {
-		line = TrimAndStripInlineComments(line)
-		if len(line) == 0 {
-			continue
+	return &BlockedNames{
+		allWeeklyRanges: allWeeklyRanges,
+		patternMatcher:  patternMatcher,
+		logger:          plugin.logger,
+		format:          plugin.format,
+	}, nil
+}
+
+func (plugin *PluginBlockName) Init(proxy *Proxy) error {
+	plugin.fileName = proxy.blockNameFile
+	plugin.allWeeklyRanges = proxy.allWeeklyRanges
+	plugin.clientGroups = proxy.clientGroups
+	if len(proxy.blockNameLogFile) > 0 {
+		plugin.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.blockNameLogFile)
+		plugin.format = proxy.blockNameFormat
+	}
+	if len(plugin.fileName) > 0 {
+		dlog.Noticef("Loading the set of blocking rules from [%s]", plugin.fileName)
+		xBlockedNames, err := plugin.loadBlockedNames(plugin.fileName, plugin.allWeeklyRanges, false)
+		if err != nil {
+			return err
 		}
-		parts := strings.Split(line, "@")
-		timeRangeName := ""
-		if len(parts) == 2 {
-			line = strings.TrimFunc(parts[0], unicode.IsSpace)
-			timeRangeName = strings.TrimFunc(parts[1], unicode.IsSpace)
-		} else if len(parts) > 2 {
-			dlog.Errorf("Syntax error in block rules at line %d -- Unexpected @ character", 1+lineNo)
+		blockedNames = xBlockedNames
+	}
+	for _, group := range plugin.clientGroups.list() {
+		if group.blockNameFile == nil || len(*group.blockNameFile) == 0 {
 			continue
 		}
-		var weeklyRanges *WeeklyRanges
-		if len(timeRangeName) > 0 {
-			weeklyRangesX, ok := (*xBlockedNames.allWeeklyRanges)[timeRangeName]
-			if !ok {
-				dlog.Errorf("Time range [%s] not found at line %d", timeRangeName, 1+lineNo)
-			} else {
-				weeklyRanges = &weeklyRangesX
-			}
-		}
-		if err := xBlockedNames.patternMatcher.Add(line, weeklyRanges, lineNo+1); err != nil {
-			dlog.Error(err)
-			continue
+		dlog.Noticef("Loading the set of blocking rules for the [%s] client group from [%s]", group.name, *group.blockNameFile)
+		xBlockedNames, err := plugin.loadBlockedNames(*group.blockNameFile, group.allWeeklyRanges, false)
+		if err != nil {
+			return err
 		}
+		group.blockedNames = xBlockedNames
 	}
-	blockedNames = &xBlockedNames
-	if len(proxy.blockNameLogFile) == 0 {
-		return nil
-	}
-	blockedNames.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.blockNameLogFile)
-	blockedNames.format = proxy.blockNameFormat
-
 	return nil
 }
 
@@ -136,10 +145,42 @@ func (plugin *PluginBlockName) Drop() error {
 }
 
 func (plugin *PluginBlockName) Reload() error {
-	return nil
+	return reloadRules(plugin)
+}
+
+func (plugin *PluginBlockName) loadRules() (func(), error) {
+	var xBlockedNames *BlockedNames
+	if len(plugin.fileName) > 0 {
+		dlog.Noticef("Reloading the set of blocking rules from [%s]", plugin.fileName)
+		var err error
+		if xBlockedNames, err = plugin.loadBlockedNames(plugin.fileName, plugin.allWeeklyRanges, true); err != nil {
+			return nil, err
+		}
+	}
+	groupsBlockedNames := make(map[*ClientGroup]*BlockedNames)
+	for _, group := range plugin.clientGroups.list() {
+		if group.blockNameFile == nil || len(*group.blockNameFile) == 0 {
+			continue
+		}
+		dlog.Noticef("Reloading the set of blocking rules for the [%s] client group from [%s]", group.name, *group.blockNameFile)
+		groupBlockedNames, err := plugin.loadBlockedNames(*group.blockNameFile, group.allWeeklyRanges, true)
+		if err != nil {
+			return nil, err
+		}
+		groupsBlockedNames[group] = groupBlockedNames
+	}
+	return func() {
+		if xBlockedNames != nil {
+			blockedNames = xBlockedNames
+		}
+		for group, groupBlockedNames := range groupsBlockedNames {
+			group.blockedNames = groupBlockedNames
+		}
+	}, nil
 }
 
 func (plugin *PluginBlockName) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	blockedNames := blockedNamesFor(pluginsState)
 	if blockedNames == nil || pluginsState.sessionData["whitelisted"] != nil {
 		return nil
 	}
@@ -153,7 +194,7 @@ type PluginBlockNameResponse struct {
 }
 
 func (plugin *PluginBlockNameResponse) Name() string {
-	return "block_name"
+	return "block_name_response"
 }
 
 func (plugin *PluginBlockNameResponse) Description() string {
@@ -173,6 +214,7 @@ func (plugin *PluginBlockNameResponse) Reload() error {
 }
 
 func (plugin *PluginBlockNameResponse) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	blockedNames := blockedNamesFor(pluginsState)
 	if blockedNames == nil || pluginsState.sessionData["whitelisted"] != nil {
 		return nil
 	}
@@ -1,37 +1,264 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"container/list"
 	"crypto/sha512"
 	"encoding/binary"
-	"encoding/gob"
-	"encoding/json"
-	"fmt"
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/jedisct1/dlog"
 	"github.com/miekg/dns"
 	"io"
-	"os"
+	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type CachedResponse struct {
 	expiration time.Time
 	msg        dns.Msg
+	size       int
 }
 
+const CacheShardsCount = 16
+
+// A CacheShard holds the responses whose key maps to it, with its own eviction.
+// The ARC cache has its own lock, so that lookups don't take the shard lock. Changes go
+// through the shard, whose lock protects the memory accounting and fetchLock.
+// The ARC cache evicts entries by itself once it holds maxEntries responses. Responses are
+// also kept in insertion order with their size, in order to evict the oldest ones when the
+// memory budget is exceeded. Entries evicted by the ARC cache are only dropped from that
+// order later, so bytes can briefly include their size.
+
+type CacheShard struct {
+	sync.Mutex
+	cache      *lru.ARCCache
+	ecsScopes  *lru.Cache
+	fetchLock  map[[32]byte]bool
+	maxEntries int
+	maxBytes   int
+	bytes      int
+	order      *list.List
+	elements   map[[32]byte]*list.Element
+}
+
+type cacheShardEntry struct {
+	key  [32]byte
+	size int
+}
+
+// CachedResponses splits the cache into shards, so that concurrent lookups for different
+// names don't contend on a single lock. Shards are created once, on first use.
+
 type CachedResponses struct {
-	sync.RWMutex
-	cache     *lru.ARCCache
-	fetchLock map[[32]byte]bool
+	sync.Mutex
+	shards atomic.Value
 }
 
 var cachedResponses CachedResponses
 
+func (cachedResponses *CachedResponses) getShards() []*CacheShard {
+	shards, _ := cachedResponses.shards.Load().([]*CacheShard)
+	return shards
+}
+
+func (cachedResponses *CachedResponses) initShards(cacheSize int, cacheMaxMemory int) ([]*CacheShard, error) {
+	if shards := cachedResponses.getShards(); shards != nil {
+		return shards, nil
+	}
+	cachedResponses.Lock()
+	defer cachedResponses.Unlock()
+	if shards := cachedResponses.getShards(); shards != nil {
+		return shards, nil
+	}
+	shardSize := Max(1, (cacheSize+CacheShardsCount-1)/CacheShardsCount)
+	// Each shard gets an equal part of the memory budget, which is also the maximum size of a cached response
+	shardMaxBytes := cacheMaxMemory / CacheShardsCount
+	if shardMaxBytes > 0 {
+		dlog.Noticef("Responses larger than %d bytes will not be cached (1/%d of cache_max_memory)", shardMaxBytes, CacheShardsCount)
+	}
+	shards := make([]*CacheShard, CacheShardsCount)
+	for i := range shards {
+		shard, err := newCacheShard(shardSize, shardMaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		shards[i] = shard
+	}
+	cachedResponses.shards.Store(shards)
+	return shards, nil
+}
+
+func newCacheShard(maxEntries int, maxBytes int) (*CacheShard, error) {
+	cache, err := lru.NewARC(maxEntries)
+	if err != nil {
+		return nil, err
+	}
+	ecsScopes, err := lru.New(maxEntries)
+	if err != nil {
+		return nil, err
+	}
+	return &CacheShard{
+		cache:      cache,
+		ecsScopes:  ecsScopes,
+		fetchLock:  make(map[[32]byte]bool),
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		order:      list.New(),
+		elements:   make(map[[32]byte]*list.Element),
+	}, nil
+}
+
+// shard returns the shard a cache key maps to, or nil if the cache hasn't been created yet
+func (cachedResponses *CachedResponses) shard(cacheKey [32]byte) *CacheShard {
+	shards := cachedResponses.getShards()
+	if shards == nil {
+		return nil
+	}
+	return shards[cacheShardIndex(cacheKey)]
+}
+
+func cacheShardIndex(cacheKey [32]byte) int {
+	return int(binary.BigEndian.Uint32(cacheKey[:4]) % CacheShardsCount)
+}
+
+func (cachedResponses *CachedResponses) Len() int {
+	count := 0
+	for _, shard := range cachedResponses.getShards() {
+		count += shard.cache.Len()
+	}
+	return count
+}
+
+// MemoryUsage returns the packed size of all the cached responses, which can briefly include
+// responses that have just been evicted by the ARC cache
+func (cachedResponses *CachedResponses) MemoryUsage() int {
+	bytes := 0
+	for _, shard := range cachedResponses.getShards() {
+		shard.Lock()
+		bytes += shard.bytes
+		shard.Unlock()
+	}
+	return bytes
+}
+
+// add stores a response, evicting the oldest entries first in order to stay within the memory budget
+// of the shard. Responses larger than the memory budget of a shard are not cached.
+func (shard *CacheShard) add(cacheKey [32]byte, cached CachedResponse) bool {
+	shard.Lock()
+	defer shard.Unlock()
+	if shard.maxBytes > 0 && cached.size > shard.maxBytes {
+		dlog.Debugf("Response too large to be cached (%d bytes, limit: %d bytes)", cached.size, shard.maxBytes)
+		shard.removeLocked(cacheKey)
+		return false
+	}
+	shard.forgetLocked(cacheKey)
+	if shard.maxBytes > 0 && shard.bytes+cached.size > shard.maxBytes {
+		// Entries already evicted by the ARC cache still count, so drop them before evicting live ones
+		shard.compactLocked()
+		for shard.bytes+cached.size > shard.maxBytes {
+			shard.removeLocked(shard.order.Front().Value.(cacheShardEntry).key)
+		}
+	}
+	shard.cache.Add(cacheKey, cached)
+	shard.elements[cacheKey] = shard.order.PushBack(cacheShardEntry{key: cacheKey, size: cached.size})
+	shard.bytes += cached.size
+	if shard.order.Len() > 2*shard.maxEntries {
+		shard.compactLocked()
+	}
+	return true
+}
+
+// forgetLocked removes an entry from the eviction order, without removing it from the cache
+func (shard *CacheShard) forgetLocked(cacheKey [32]byte) {
+	if element, ok := shard.elements[cacheKey]; ok {
+		shard.bytes -= shard.order.Remove(element).(cacheShardEntry).size
+		delete(shard.elements, cacheKey)
+	}
+}
+
+func (shard *CacheShard) removeLocked(cacheKey [32]byte) {
+	shard.cache.Remove(cacheKey)
+	shard.forgetLocked(cacheKey)
+}
+
+// compactLocked drops the entries that the ARC cache has evicted by itself from the eviction order.
+// It runs once the order holds twice as many entries as the cache, so that its cost is amortized.
+func (shard *CacheShard) compactLocked() {
+	for element := shard.order.Front(); element != nil; {
+		next := element.Next()
+		if cacheKey := element.Value.(cacheShardEntry).key; !shard.cache.Contains(cacheKey) {
+			shard.forgetLocked(cacheKey)
+		}
+		element = next
+	}
+}
+
+func (shard *CacheShard) remove(cacheKey [32]byte) {
+	shard.Lock()
+	shard.removeLocked(cacheKey)
+	shard.Unlock()
+}
+
+func (shard *CacheShard) purge() int {
+	shard.Lock()
+	defer shard.Unlock()
+	count := shard.cache.Len()
+	shard.cache.Purge()
+	shard.order.Init()
+	shard.elements = make(map[[32]byte]*list.Element)
+	shard.bytes = 0
+	return count
+}
+
+// ecsScope returns the scope prefix of the last response to a query with a client subnet,
+// or the source prefix if no responses were seen.
+func (cachedResponses *CachedResponses) ecsScope(cacheKey [32]byte, sourcePrefix int) int {
+	shard := cachedResponses.shard(cacheKey)
+	if shard == nil {
+		return sourcePrefix
+	}
+	if scope, ok := shard.ecsScopes.Get(cacheKey); ok {
+		return Min(scope.(int), sourcePrefix)
+	}
+	return sourcePrefix
+}
+
+func (cachedResponses *CachedResponses) setECSScope(cacheKey [32]byte, scope int) {
+	if shard := cachedResponses.shard(cacheKey); shard != nil {
+		shard.ecsScopes.Add(cacheKey, scope)
+	}
+}
+
+// isFrequent tells whether a response has already been refreshed from an expired entry
+func (shard *CacheShard) isFrequent(cacheKey [32]byte) bool {
+	shard.Lock()
+	_, frequent := shard.fetchLock[cacheKey]
+	shard.Unlock()
+	return frequent
+}
+
+// computeCacheKey returns the key of a query or response. Responses to queries with an EDNS client subnet
+// apply to the clients of that subnet, truncated to the scope prefix of the response. Before a response is
+// received, the scope prefix previously seen for the same query is used.
 func computeCacheKey(pluginsState *PluginsState, msg *dns.Msg) [32]byte {
+	cacheKey := computeSharedCacheKey(pluginsState, msg)
+	if pluginsState == nil {
+		return cacheKey
+	}
+	subnet := ednsClientSubnet(pluginsState.questionMsg)
+	if subnet == nil {
+		return cacheKey
+	}
+	scope := pluginsState.ecsScope
+	if scope < 0 {
+		scope = cachedResponses.ecsScope(cacheKey, int(subnet.SourceNetmask))
+	}
+	return computeSubnetCacheKey(cacheKey, subnet, scope)
+}
+
+func computeSharedCacheKey(pluginsState *PluginsState, msg *dns.Msg) [32]byte {
 	dnssec := false
 
 	if pluginsState == nil {
@@ -55,75 +282,55 @@ func computeCacheKey(pluginsState *PluginsState, msg *dns.Msg) [32]byte {
 	normalizedRawQName := []byte(question.Name)
 	NormalizeRawQName(&normalizedRawQName)
 	h.Write(normalizedRawQName)
+	// Client groups using their own servers or rules get their own cache entries
+	if pluginsState != nil && pluginsState.clientGroup != nil && pluginsState.clientGroup.hasOwnPolicy() {
+		h.Write([]byte{0})
+		h.Write([]byte(pluginsState.clientGroup.name))
+	}
 	var sum [32]byte
 	h.Sum(sum[:0])
 
 	return sum
 }
 
-type SavedResponse struct {
-	Expiration time.Time
-	Frequent   bool
-	Packet     []byte
-}
+func computeSubnetCacheKey(cacheKey [32]byte, subnet *dns.EDNS0_SUBNET, scope int) [32]byte {
+	address, bits := subnet.Address.To4(), 32
+	if subnet.Family != 1 {
+		address, bits = subnet.Address.To16(), 128
+	}
+	if address == nil {
+		return cacheKey
+	}
+	scope = Max(0, Min(scope, Min(int(subnet.SourceNetmask), bits)))
+	h := sha512.New512_256()
+	h.Write(cacheKey[:])
+	h.Write([]byte{byte(subnet.Family), byte(scope)})
+	h.Write(address.Mask(net.CIDRMask(scope, bits)))
+	var sum [32]byte
+	h.Sum(sum[:0])
 
-type CacheFileHeader struct {
-	Description      string    `json:"description"`
-	AppName          string    `json:"app_name"`
-	AppVersion       string    `json:"app_version"`
-	ProtoVersion     uint32    `json:"proto_version"`
-	TimeSaved        time.Time `json:"time_saved"`
-	ItemsCount       int       `json:"items_count"`
-	OriginalLocation string    `json:"original_location"`
-	Compressed       bool      `json:"compressed"`
-	Links            []string  `json:"links"`
+	return sum
 }
 
 func (cachedResponses *CachedResponses) LoadCache(proxy *Proxy, cacheFilename string) error {
 	startTime := time.Now()
-	loadFile, err := os.Open(cacheFilename)
-	if err != nil {
-		return err
-	}
-
-	defer loadFile.Close()
-
-	var header CacheFileHeader
-
-	reader := bufio.NewReader(loadFile)
-	jsonBuf, _ := reader.ReadBytes('\n')
-
-	err = json.Unmarshal(jsonBuf, &header)
+	cacheFile, err := OpenCacheFile(cacheFilename)
 	if err != nil {
 		return err
 	}
-	if header.ProtoVersion != 1 {
-		return fmt.Errorf("unknown protocol version [%d]", header.ProtoVersion)
-	}
+	defer cacheFile.Close()
 
+	header := cacheFile.header
 	if header.ItemsCount > 0 {
-		dlog.Noticef("Loading %d cached responses from [%s]", header.ItemsCount, cacheFilename)
-
-		dec := gob.NewDecoder(reader)
-
-		cachedResponses.Lock()
+		dlog.Noticef("Loading %d cached responses (%d bytes) from [%s]", header.ItemsCount, header.ItemsSize, cacheFilename)
 
-		if cachedResponses.cache == nil {
-
-			cachedResponses.cache, err = lru.NewARC(proxy.cacheSize)
-			cachedResponses.fetchLock = make(map[[32]byte]bool)
-
-			if err != nil {
-				return err
-			}
+		if _, err := cachedResponses.initShards(proxy.cacheSize, proxy.cacheMaxMemory); err != nil {
+			return err
 		}
-		cachedResponses.Unlock()
-		var savedResponse SavedResponse
-		var msg dns.Msg
 
 		i := 0
 		for {
-			err = dec.Decode(&savedResponse)
+			savedResponse, msg, err := cacheFile.Next()
 			if err != nil {
 				if err == io.EOF {
 					break
@@ -131,14 +338,10 @@ func (cachedResponses *CachedResponses) LoadCache(proxy *Proxy, cacheFilename st
 				return err
 			}
 
-			err = msg.Unpack(savedResponse.Packet)
-			if err != nil {
-				return err
-			}
-
 			cachedResponse := CachedResponse{
 				expiration: savedResponse.Expiration,
-				msg:        msg,
+				msg:        *msg,
+				size:       len(savedResponse.Packet),
 			}
 
 			if cachedResponse.expiration.After(startTime) || proxy.cacheForced {
@@ -147,16 +350,14 @@ func (cachedResponses *CachedResponses) LoadCache(proxy *Proxy, cacheFilename st
 					continue
 				}
 
-				cachedKey := computeCacheKey(nil, &msg)
-				cachedResponses.Lock()
-				if !cachedResponses.cache.Contains(cachedKey) {
-					cachedResponses.cache.Add(cachedKey, cachedResponse)
+				cachedKey := savedResponse.cacheKey(msg)
+				shard := cachedResponses.shard(cachedKey)
+				if !shard.cache.Contains(cachedKey) && shard.add(cachedKey, cachedResponse) {
 					if savedResponse.Frequent {
-						cachedResponses.cache.Get(cachedKey)
+						shard.cache.Get(cachedKey)
 					}
 					i++
 				}
-				cachedResponses.Unlock()
 			}
 
 		}
@@ -167,74 +368,85 @@ func (cachedResponses *CachedResponses) LoadCache(proxy *Proxy, cacheFilename st
 	return nil
 }
 
+// Flush removes the cached responses for a name, or for a name and its subdomains.
+// Everything is removed if the name is empty. Shards are processed one at a time.
+func (cachedResponses *CachedResponses) Flush(name string, suffix bool) int {
+	count := 0
+	for _, shard := range cachedResponses.getShards() {
+		if len(name) == 0 {
+			count += shard.purge()
+			continue
+		}
+		for _, key := range shard.cache.Keys() {
+			cachedAny, ok := shard.cache.Peek(key)
+			if !ok {
+				continue
+			}
+			cached := cachedAny.(CachedResponse)
+			if len(cached.msg.Question) == 0 {
+				continue
+			}
+			qName, err := NormalizeQName(cached.msg.Question[0].Name)
+			if err != nil {
+				continue
+			}
+			if qName == name || (suffix && strings.HasSuffix(qName, "."+name)) {
+				shard.remove(key.([32]byte))
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// SaveCache streams the cached responses to a temporary file, that replaces the previous cache file
+// once complete. Shards are copied one at a time, so that queries keep being served while saving.
 func (cachedResponses *CachedResponses) SaveCache(cacheFilename string) (err error) {
 	startTime := time.Now()
-	cachedResponses.RLock()
-	defer cachedResponses.RUnlock()
-
-	if cachedResponses.cache != nil && cachedResponses.cache.Len() > 0 {
-
-		var cacheSave bytes.Buffer
-
-		dlog.Noticef("Preparing to save %d cached responses", cachedResponses.cache.Len())
+	itemsCount := cachedResponses.Len()
+	if itemsCount == 0 {
+		dlog.Notice("No cache to save")
+		return nil
+	}
 
-		enc := gob.NewEncoder(&cacheSave)
+	dlog.Noticef("Preparing to save %d cached responses", itemsCount)
 
-		header := CacheFileHeader{
-			AppName:          "dnscrypt-proxy-home",
-			AppVersion:       AppVersion,
-			ProtoVersion:     1,
-			TimeSaved:        startTime,
-			OriginalLocation: cacheFilename,
-			ItemsCount:       cachedResponses.cache.Len(),
-			Compressed:       false,
-			Description:      "This is a file with saved cache of dnscrypt-proxy-home app. All data after the first line is binary (golang encoding/gob)",
-			Links:            []string{"https://github.com/antonme/dnscrypt-proxy-home", "https://github.com/DNSCrypt/dnscrypt-proxy"},
-		}
+	cacheFile, err := CreateCacheFile(cacheFilename, itemsCount, cachedResponses.MemoryUsage())
+	if err != nil {
+		return err
+	}
+	defer cacheFile.Close()
 
-		var packet []byte
+	var packet []byte
 
-		keys := cachedResponses.cache.Keys()
-		for keyNum := range keys {
-			cacheKey := keys[keyNum].([32]byte)
+	for _, shard := range cachedResponses.getShards() {
+		for _, key := range shard.cache.Keys() {
+			cacheKey := key.([32]byte)
 
-			cachedAny, _ := cachedResponses.cache.Peek(cacheKey)
+			cachedAny, ok := shard.cache.Peek(cacheKey)
+			if !ok {
+				continue
+			}
 			cached := cachedAny.(CachedResponse)
 			msg := cached.msg
 			//msg.Compress = false //Speed more important than space
 
-			_, valueExist := cachedResponses.fetchLock[cacheKey]
-
 			packet, _ = msg.PackBuffer(packet)
 
 			savedResponse := SavedResponse{
 				Expiration: cached.expiration,
 				Packet:     packet,
-				Frequent:   valueExist,
+				Frequent:   shard.isFrequent(cacheKey),
+				Key:        cacheKey,
 			}
 
-			err = enc.Encode(&savedResponse)
-			if err != nil {
+			if err = cacheFile.Write(&savedResponse); err != nil {
 				return err
 			}
 		}
-
-		saveFile, _ := os.Create(cacheFilename)
-		defer saveFile.Close()
-
-		jenc := json.NewEncoder(saveFile)
-		err = jenc.Encode(header)
-		if err != nil {
-			return err
-		}
-
-		_, err = saveFile.Write(cacheSave.Bytes())
-		if err != nil {
-			return err
-		}
-	} else {
-		dlog.Notice("No cache to save")
-		return nil
+	}
+	if err = cacheFile.Commit(); err != nil {
+		return err
 	}
 
 	dlog.Infof("Time spent saving: %s", time.Now().Sub(startTime))
@@ -270,16 +482,20 @@ func (plugin *PluginCache) Eval(pluginsState *PluginsState, msg *dns.Msg) error
 	if pluginsState.flushEnabled && strings.HasPrefix(msg.Question[0].Name, "flush\\@") {
 		return nil
 	}
+	if pluginsState.prefetch {
+		return nil
+	}
 	cacheKey := computeCacheKey(pluginsState, msg)
 
-	cachedResponses.RLock()
-	defer cachedResponses.RUnlock()
-	if cachedResponses.cache == nil {
+	shard := cachedResponses.shard(cacheKey)
+	if shard == nil {
+		pluginsState.metrics.countCacheMiss()
 		return nil
 	}
 
-	cachedAny, ok := cachedResponses.cache.Get(cacheKey)
+	cachedAny, ok := shard.cache.Get(cacheKey)
 	if !ok {
+		pluginsState.metrics.countCacheMiss()
 		return nil
 	}
 	cached := cachedAny.(CachedResponse)
@@ -293,14 +509,22 @@ func (plugin *PluginCache) Eval(pluginsState *PluginsState, msg *dns.Msg) error
 	if time.Now().After(cached.expiration) {
 		if pluginsState.cacheForced == false || pluginsState.forceRequest || strings.HasPrefix(msg.Question[0].Name, "_esni") {
 			pluginsState.sessionData["stale"] = &synth
+			pluginsState.staleSince = cached.expiration
+			pluginsState.metrics.countCacheStale()
 			return nil
 		}
 		timeSpend := time.Now().Sub(cached.expiration)
 		if pluginsState.cacheForcedMaxTTL > 0 && timeSpend > pluginsState.cacheForcedMaxTTL {
 			pluginsState.sessionData["stale"] = &synth
+			pluginsState.staleSince = cached.expiration
+			pluginsState.metrics.countCacheStale()
 			return nil
 		}
 		pluginsState.forceRequest = true
+		pluginsState.metrics.countCacheForced()
+	} else {
+		pluginsState.metrics.countCacheHit()
+		pluginsState.prefetcher.noticeHit(cacheKey, cached.expiration, pluginsState)
 	}
 
 	updateTTL(&cached.msg, cached.expiration)
@@ -316,6 +540,9 @@ func (plugin *PluginCache) Eval(pluginsState *PluginsState, msg *dns.Msg) error
 // ---
 
 type PluginCacheResponse struct {
+	sync.RWMutex
+	ttlRulesFile    string
+	ttlRulesMatcher *PatternMatcher
 }
 
 func (plugin *PluginCacheResponse) Name() string {
@@ -327,7 +554,16 @@ func (plugin *PluginCacheResponse) Description() string {
 }
 
 func (plugin *PluginCacheResponse) Init(proxy *Proxy) error {
-
+	plugin.ttlRulesFile = proxy.cacheTTLRulesFile
+	if len(plugin.ttlRulesFile) == 0 {
+		return nil
+	}
+	dlog.Noticef("Loading the set of cache TTL rules from [%s]", plugin.ttlRulesFile)
+	ttlRulesMatcher, err := loadCacheTTLRules(plugin.ttlRulesFile)
+	if err != nil {
+		return err
+	}
+	plugin.ttlRulesMatcher = ttlRulesMatcher
 	return nil
 }
 
@@ -336,7 +572,23 @@ func (plugin *PluginCacheResponse) Drop() error {
 }
 
 func (plugin *PluginCacheResponse) Reload() error {
-	return nil
+	return reloadRules(plugin)
+}
+
+func (plugin *PluginCacheResponse) loadRules() (func(), error) {
+	if len(plugin.ttlRulesFile) == 0 {
+		return nil, nil
+	}
+	dlog.Noticef("Reloading the set of cache TTL rules from [%s]", plugin.ttlRulesFile)
+	ttlRulesMatcher, err := loadCacheTTLRules(plugin.ttlRulesFile)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		plugin.Lock()
+		plugin.ttlRulesMatcher = ttlRulesMatcher
+		plugin.Unlock()
+	}, nil
 }
 
 func (plugin *PluginCacheResponse) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
@@ -352,36 +604,43 @@ func (plugin *PluginCacheResponse) Eval(pluginsState *PluginsState, msg *dns.Msg
 		msg.Question[0].Name = quest[7:]
 
 		cacheKey := computeCacheKey(pluginsState, msg)
-		cachedResponses.Lock()
-		cachedResponses.cache.Remove(cacheKey)
-		cachedResponses.Unlock()
+		if shard := cachedResponses.shard(cacheKey); shard != nil {
+			shard.remove(cacheKey)
+		}
 		msg.Question[0].Name = quest
 
 		pluginsState.action = PluginsActionFlush
 		return nil
 	}
 
+	plugin.RLock()
+	ttlRule := lookupCacheTTLRule(plugin.ttlRulesMatcher, pluginsState.qName, msg.Question[0].Qtype)
+	plugin.RUnlock()
+	minTTL, maxTTL, negMinTTL, negMaxTTL := ttlRule.limits(pluginsState.cacheMinTTL, pluginsState.cacheMaxTTL, pluginsState.cacheNegMinTTL, pluginsState.cacheNegMaxTTL)
+	if ttlRule != nil && ttlRule.noCache {
+		if ttlRule.maxTTL != nil {
+			setMaxTTL(msg, *ttlRule.maxTTL)
+		}
+		return nil
+	}
+
 	cacheKey := computeCacheKey(pluginsState, msg)
-	ttl := getMinTTL(msg, pluginsState.cacheMinTTL, pluginsState.cacheMaxTTL, pluginsState.cacheNegMinTTL, pluginsState.cacheNegMaxTTL)
+	ttl := getMinTTL(msg, minTTL, maxTTL, negMinTTL, negMaxTTL)
 
 	pluginsState.cachedTTL = ttl
 	cachedResponse := CachedResponse{
 		expiration: time.Now().Add(ttl),
 		msg:        *msg,
+		size:       msg.Len(),
 	}
 
-	cachedResponses.Lock()
-	if cachedResponses.cache == nil {
-		var err error
-		cachedResponses.cache, err = lru.NewARC(pluginsState.cacheSize)
-		cachedResponses.fetchLock = make(map[[32]byte]bool)
-		if err != nil {
-			cachedResponses.Unlock()
-			return err
-		}
+	if _, err := cachedResponses.initShards(pluginsState.cacheSize, pluginsState.cacheMaxMemory); err != nil {
+		return err
+	}
+	if pluginsState.ecsScope >= 0 {
+		cachedResponses.setECSScope(computeSharedCacheKey(pluginsState, msg), pluginsState.ecsScope)
 	}
-	cachedResponses.cache.Add(cacheKey, cachedResponse)
-	cachedResponses.Unlock()
+	cachedResponses.shard(cacheKey).add(cacheKey, cachedResponse)
 	pluginsState.forceRequest = false
 
 	updateTTL(msg, cachedResponse.expiration)
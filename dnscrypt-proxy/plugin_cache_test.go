@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/powerman/check"
+)
+
+func TestCacheKeyClientGroups(t *testing.T) {
+	c := check.T(t)
+	blockNameFile := "kids-blocked-names.txt"
+	kids := &ClientGroup{name: "kids", blockNameFile: &blockNameFile}
+	adults := &ClientGroup{name: "adults"}
+	msg := dns.Msg{}
+	msg.SetQuestion("tracker.example.com.", dns.TypeA)
+	key := func(group *ClientGroup) [32]byte {
+		return computeCacheKey(&PluginsState{clientGroup: group, questionMsg: &msg, ecsScope: -1}, &msg)
+	}
+	c.Equal(key(adults), key(nil), "A group without its own rules must share the cache")
+	c.NotEqual(key(kids), key(nil), "A group with its own rules must not share the cache")
+	c.NotEqual(key(kids), key(adults))
+
+	otherBlockNameFile := "teens-blocked-names.txt"
+	teens := &ClientGroup{name: "teens", blockNameFile: &otherBlockNameFile}
+	c.NotEqual(key(kids), key(teens), "Groups with their own rules must not share the cache")
+	withServers := &ClientGroup{name: "servers", serverNames: []string{"server"}}
+	c.NotEqual(key(withServers), key(nil))
+}
+
+func TestCacheShardMemoryBudget(t *testing.T) {
+	c := check.T(t)
+	shard, err := newCacheShard(2, 300)
+	c.Must(c.Nil(err))
+	key := func(i byte) [32]byte { return [32]byte{i} }
+	for i := byte(1); i <= 3; i++ {
+		c.True(shard.add(key(i), CachedResponse{size: 100}))
+	}
+	// The ARC cache evicted the first entry by itself, which is still accounted for
+	c.False(shard.cache.Contains(key(1)))
+	c.Equal(shard.bytes, 300)
+
+	c.True(shard.add(key(4), CachedResponse{size: 100}))
+	c.True(shard.cache.Contains(key(3)), "A live entry was evicted instead of an evicted one")
+	c.True(shard.cache.Contains(key(4)))
+	c.False(shard.cache.Contains(key(2)))
+	c.Equal(shard.order.Len(), 3)
+
+	c.True(shard.add(key(5), CachedResponse{size: 250}))
+	c.False(shard.cache.Contains(key(3)))
+	c.False(shard.cache.Contains(key(4)))
+	c.Equal(shard.bytes, 250)
+
+	c.False(shard.add(key(6), CachedResponse{size: 301}), "Larger than the memory budget")
+	c.False(shard.cache.Contains(key(6)))
+	c.Equal(shard.purge(), 1)
+	c.Equal(shard.bytes, 0)
+}
+
+func TestCachedResponsesShards(t *testing.T) {
+	c := check.T(t)
+	var cachedResponses CachedResponses
+	c.Nil(cachedResponses.shard([32]byte{}))
+	c.Zero(cachedResponses.Len())
+	// Shards are large enough to hold every name, so that the ARC cache doesn't evict anything
+	shards, err := cachedResponses.initShards(100*CacheShardsCount, 0)
+	c.Must(c.Nil(err))
+	c.Len(shards, CacheShardsCount)
+	c.Equal(shards[0].maxEntries, 100)
+	otherShards, err := cachedResponses.initShards(1, 0)
+	c.Nil(err)
+	c.Equal(&otherShards[0], &shards[0], "Shards must only be created once")
+
+	response := func(name string) ([32]byte, CachedResponse) {
+		msg := dns.Msg{}
+		msg.SetQuestion(name, dns.TypeA)
+		return computeSharedCacheKey(nil, &msg), CachedResponse{expiration: time.Now().Add(time.Minute), msg: msg, size: 100}
+	}
+	const namesCount = 5 * CacheShardsCount
+	var wg sync.WaitGroup
+	for i := 0; i < namesCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cacheKey, cached := response(fmt.Sprintf("host%d.example.com.", i))
+			shard := cachedResponses.shard(cacheKey)
+			shard.add(cacheKey, cached)
+			_, _ = shard.cache.Get(cacheKey)
+			_ = cachedResponses.Len()
+			_ = cachedResponses.MemoryUsage()
+		}(i)
+	}
+	wg.Wait()
+	c.Equal(cachedResponses.Len(), namesCount)
+	c.Equal(cachedResponses.MemoryUsage(), namesCount*100)
+	for i, shard := range shards {
+		c.True(shard.cache.Len() > 0, "Shard %d is empty", i)
+		for _, key := range shard.cache.Keys() {
+			c.Equal(cacheShardIndex(key.([32]byte)), i)
+		}
+	}
+
+	cacheKey, _ := response("HOST1.example.com.")
+	c.True(cachedResponses.shard(cacheKey).cache.Contains(cacheKey), "Names must map to the same shard regardless of their case")
+	c.Equal(cachedResponses.Flush("host1.example.com", false), 1)
+	c.False(cachedResponses.shard(cacheKey).cache.Contains(cacheKey))
+	c.Equal(cachedResponses.Flush("example.com", false), 0)
+	c.Equal(cachedResponses.Flush("example.com", true), namesCount-1)
+	c.Zero(cachedResponses.Len())
+	c.Zero(cachedResponses.MemoryUsage())
+
+	cacheKey, cached := response("example.com.")
+	cachedResponses.shard(cacheKey).add(cacheKey, cached)
+	c.Equal(cachedResponses.Flush("", false), 1)
+	c.Zero(cachedResponses.Len())
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"math/rand"
 	"net"
 	"strings"
@@ -23,7 +24,9 @@ type CloakedName struct {
 
 type PluginCloak struct {
 	sync.RWMutex
+	fileName       string
 	patternMatcher *PatternMatcher
+	clientGroups   *ClientGroups
 	ttl            uint32
 }
 
@@ -36,13 +39,38 @@ func (plugin *PluginCloak) Description() string {
 }
 
 func (plugin *PluginCloak) Init(proxy *Proxy) error {
-	dlog.Noticef("Loading the set of cloaking rules from [%s]", proxy.cloakFile)
-	bin, err := ReadTextFile(proxy.cloakFile)
+	plugin.fileName = proxy.cloakFile
+	plugin.ttl = proxy.cloakTTL
+	plugin.clientGroups = proxy.clientGroups
+	if len(plugin.fileName) > 0 {
+		dlog.Noticef("Loading the set of cloaking rules from [%s]", plugin.fileName)
+		patternMatcher, _, err := loadCloakingRules(plugin.fileName)
+		if err != nil {
+			return err
+		}
+		plugin.patternMatcher = patternMatcher
+	}
+	for _, group := range plugin.clientGroups.list() {
+		if group.cloakFile == nil || len(*group.cloakFile) == 0 {
+			continue
+		}
+		dlog.Noticef("Loading the set of cloaking rules for the [%s] client group from [%s]", group.name, *group.cloakFile)
+		patternMatcher, _, err := loadCloakingRules(*group.cloakFile)
+		if err != nil {
+			return err
+		}
+		group.cloakPatternMatcher = patternMatcher
+	}
+	return nil
+}
+
+func loadCloakingRules(fileName string) (*PatternMatcher, int, error) {
+	bin, err := ReadTextFile(fileName)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
-	plugin.ttl = proxy.cloakTTL
-	plugin.patternMatcher = NewPatternMatcher()
+	patternMatcher := NewPatternMatcher()
+	syntaxErrors := 0
 	cloakedNames := make(map[string]*CloakedName)
 	for lineNo, line := range strings.Split(string(bin), "\n") {
 		line = TrimAndStripInlineComments(line)
@@ -56,10 +84,12 @@ func (plugin *PluginCloak) Init(proxy *Proxy) error {
 			target = strings.TrimFunc(parts[1], unicode.IsSpace)
 		} else if len(parts) > 2 {
 			dlog.Errorf("Syntax error in cloaking rules at line %d -- Unexpected space character", 1+lineNo)
+			syntaxErrors++
 			continue
 		}
 		if len(line) == 0 || len(target) == 0 {
 			dlog.Errorf("Syntax error in cloaking rules at line %d -- Missing name or target", 1+lineNo)
+			syntaxErrors++
 			continue
 		}
 		line = strings.ToLower(line)
@@ -74,6 +104,7 @@ func (plugin *PluginCloak) Init(proxy *Proxy) error {
 				cloakedName.ipv6 = append((*cloakedName).ipv6, ipv6)
 			} else {
 				dlog.Errorf("Invalid IP address in cloaking rule at line %d", 1+lineNo)
+				syntaxErrors++
 				continue
 			}
 			cloakedName.isIP = true
@@ -84,11 +115,11 @@ func (plugin *PluginCloak) Init(proxy *Proxy) error {
 		cloakedNames[line] = cloakedName
 	}
 	for line, cloakedName := range cloakedNames {
-		if err := plugin.patternMatcher.Add(line, cloakedName, cloakedName.lineNo); err != nil {
-			return err
+		if err := patternMatcher.Add(line, cloakedName, cloakedName.lineNo); err != nil {
+			return nil, syntaxErrors, err
 		}
 	}
-	return nil
+	return patternMatcher, syntaxErrors, nil
 }
 
 func (plugin *PluginCloak) Drop() error {
@@ -96,7 +127,48 @@ func (plugin *PluginCloak) Drop() error {
 }
 
 func (plugin *PluginCloak) Reload() error {
-	return nil
+	return reloadRules(plugin)
+}
+
+func (plugin *PluginCloak) loadRules() (func(), error) {
+	var patternMatcher *PatternMatcher
+	if len(plugin.fileName) > 0 {
+		dlog.Noticef("Reloading the set of cloaking rules from [%s]", plugin.fileName)
+		var syntaxErrors int
+		var err error
+		patternMatcher, syntaxErrors, err = loadCloakingRules(plugin.fileName)
+		if err != nil {
+			return nil, err
+		}
+		if syntaxErrors > 0 {
+			return nil, fmt.Errorf("%d invalid rule(s) in [%s]", syntaxErrors, plugin.fileName)
+		}
+	}
+	groupsPatternMatchers := make(map[*ClientGroup]*PatternMatcher)
+	for _, group := range plugin.clientGroups.list() {
+		if group.cloakFile == nil || len(*group.cloakFile) == 0 {
+			continue
+		}
+		dlog.Noticef("Reloading the set of cloaking rules for the [%s] client group from [%s]", group.name, *group.cloakFile)
+		groupPatternMatcher, syntaxErrors, err := loadCloakingRules(*group.cloakFile)
+		if err != nil {
+			return nil, err
+		}
+		if syntaxErrors > 0 {
+			return nil, fmt.Errorf("%d invalid rule(s) in [%s]", syntaxErrors, *group.cloakFile)
+		}
+		groupsPatternMatchers[group] = groupPatternMatcher
+	}
+	return func() {
+		plugin.Lock()
+		if patternMatcher != nil {
+			plugin.patternMatcher = patternMatcher
+		}
+		for group, groupPatternMatcher := range groupsPatternMatchers {
+			group.cloakPatternMatcher = groupPatternMatcher
+		}
+		plugin.Unlock()
+	}, nil
 }
 
 func (plugin *PluginCloak) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
@@ -106,7 +178,15 @@ func (plugin *PluginCloak) Eval(pluginsState *PluginsState, msg *dns.Msg) error
 	}
 	now := time.Now()
 	plugin.RLock()
-	_, _, xcloakedName := plugin.patternMatcher.Eval(pluginsState.qName)
+	patternMatcher := plugin.patternMatcher
+	if group := pluginsState.clientGroup; group != nil && group.cloakFile != nil {
+		patternMatcher = group.cloakPatternMatcher
+	}
+	if patternMatcher == nil {
+		plugin.RUnlock()
+		return nil
+	}
+	_, _, xcloakedName := patternMatcher.Eval(pluginsState.qName)
 	if xcloakedName == nil {
 		plugin.RUnlock()
 		return nil
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+// PluginDNSSEC asks upstream servers to include DNSSEC records in their responses
+
+type PluginDNSSEC struct{}
+
+func (plugin *PluginDNSSEC) Name() string {
+	return "dnssec"
+}
+
+func (plugin *PluginDNSSEC) Description() string {
+	return "Request DNSSEC records in order to validate responses."
+}
+
+func (plugin *PluginDNSSEC) Init(proxy *Proxy) error {
+	return nil
+}
+
+func (plugin *PluginDNSSEC) Drop() error {
+	return nil
+}
+
+func (plugin *PluginDNSSEC) Reload() error {
+	return nil
+}
+
+func (plugin *PluginDNSSEC) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if edns0 := msg.IsEdns0(); edns0 != nil {
+		edns0.SetDo()
+	} else {
+		msg.SetEdns0(uint16(pluginsState.maxPayloadSize), true)
+	}
+	return nil
+}
+
+// ---
+
+type PluginDNSSECResponse struct {
+	validator *DNSSECValidator
+}
+
+func (plugin *PluginDNSSECResponse) Name() string {
+	return "dnssec_response"
+}
+
+func (plugin *PluginDNSSECResponse) Description() string {
+	return "Validate DNSSEC signatures of responses."
+}
+
+func (plugin *PluginDNSSECResponse) Init(proxy *Proxy) error {
+	validator, err := NewDNSSECValidator(proxy, proxy.dnssecTrustAnchors)
+	if err != nil {
+		return err
+	}
+	plugin.validator = validator
+	return nil
+}
+
+func (plugin *PluginDNSSECResponse) Drop() error {
+	return nil
+}
+
+func (plugin *PluginDNSSECResponse) Reload() error {
+	return nil
+}
+
+func (plugin *PluginDNSSECResponse) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	questionMsg := pluginsState.questionMsg
+	if questionMsg == nil || questionMsg.CheckingDisabled {
+		return nil
+	}
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		msg.AuthenticatedData = false
+		return nil
+	}
+	status, err := plugin.validator.validate(pluginsState, msg)
+	switch status {
+	case DNSSECBogus, DNSSECIndeterminate:
+		synth := EmptyResponseFromMessage(msg)
+		synth.Rcode = dns.RcodeServerFailure
+		if !pluginsState.dnssec {
+			if edns0 := synth.IsEdns0(); edns0 != nil {
+				edns0.SetDo(false)
+			}
+		}
+		pluginsState.synthResponse = synth
+		pluginsState.action = PluginsActionSynth
+		if status == DNSSECBogus {
+			dlog.Infof("DNSSEC validation failed for [%s]: %v", pluginsState.qName, err)
+			pluginsState.returnCode = PluginsReturnCodeDNSSECBogus
+		} else {
+			dlog.Infof("Unable to validate [%s]: %v", pluginsState.qName, err)
+			pluginsState.returnCode = PluginsReturnCodeServFail
+		}
+		return nil
+	case DNSSECSecure:
+		msg.AuthenticatedData = pluginsState.dnssec || questionMsg.AuthenticatedData
+	default:
+		msg.AuthenticatedData = false
+	}
+	if !pluginsState.dnssec {
+		removeDNSSECRecords(msg)
+	}
+	return nil
+}
+
+// removeDNSSECRecords removes the records a client didn't ask for, after validation
+func removeDNSSECRecords(msg *dns.Msg) {
+	qType := msg.Question[0].Qtype
+	isDNSSECRecord := func(rr dns.RR) bool {
+		switch rrType := rr.Header().Rrtype; rrType {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			return rrType != qType
+		}
+		return false
+	}
+	for _, section := range []*[]dns.RR{&msg.Answer, &msg.Ns} {
+		rrs := (*section)[:0]
+		for _, rr := range *section {
+			if !isDNSSECRecord(rr) {
+				rrs = append(rrs, rr)
+			}
+		}
+		*section = rrs
+	}
+	if edns0 := msg.IsEdns0(); edns0 != nil {
+		edns0.SetDo(false)
+	}
+}
@@ -7,8 +7,18 @@
 	"github.com/miekg/dns"
 )
 
+const (
+	ECSPolicyKeep    = "keep"
+	ECSPolicyStrip   = "strip"
+	ECSPolicyReplace = "replace"
+)
+
 type PluginECS struct {
-	nets []*net.IPNet
+	nets       []*net.IPNet
+	fromClient bool
+	prefixV4   int
+	prefixV6   int
+	policy     string
 }
 
 func (plugin *PluginECS) Name() string {
@@ -21,6 +31,10 @@ func (plugin *PluginECS) Description() string {
 
 func (plugin *PluginECS) Init(proxy *Proxy) error {
 	plugin.nets = proxy.ednsClientSubnets
+	plugin.fromClient = proxy.ednsClientSubnetFromClient
+	plugin.prefixV4 = proxy.ednsClientSubnetPrefixV4
+	plugin.prefixV6 = proxy.ednsClientSubnetPrefixV6
+	plugin.policy = proxy.ednsClientSubnetPolicy
 	return nil
 }
 
@@ -33,35 +47,60 @@ func (plugin *PluginECS) Reload() error {
 }
 
 func (plugin *PluginECS) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
-	var options *[]dns.EDNS0
-
-	for _, extra := range msg.Extra {
-		if extra.Header().Rrtype == dns.TypeOPT {
-			options = &extra.(*dns.OPT).Option
-			for _, option := range *options {
-				if option.Option() == dns.EDNS0SUBNET {
-					return nil
-				}
+	edns0 := msg.IsEdns0()
+	if edns0 != nil {
+		for i, option := range edns0.Option {
+			if option.Option() != dns.EDNS0SUBNET {
+				continue
+			}
+			if plugin.policy == ECSPolicyKeep {
+				return nil
+			}
+			edns0.Option = append(edns0.Option[:i], edns0.Option[i+1:]...)
+			if plugin.policy == ECSPolicyStrip {
+				return nil
 			}
 			break
 		}
 	}
-	if options == nil {
+	prr := plugin.clientSubnet(pluginsState)
+	if prr == nil {
+		return nil
+	}
+	if edns0 == nil {
 		msg.SetEdns0(uint16(pluginsState.maxPayloadSize), false)
-		for _, extra := range msg.Extra {
-			if extra.Header().Rrtype == dns.TypeOPT {
-				options = &extra.(*dns.OPT).Option
-				break
+		if edns0 = msg.IsEdns0(); edns0 == nil {
+			return nil
+		}
+	}
+	edns0.Option = append(edns0.Option, prr)
+
+	return nil
+}
+
+// clientSubnet returns the subnet to send: the client address truncated to the configured prefix,
+// or one of the configured networks, randomly chosen.
+// Addresses that are not public would be useless to upstream servers, and would leak the local network layout.
+func (plugin *PluginECS) clientSubnet(pluginsState *PluginsState) *dns.EDNS0_SUBNET {
+	if plugin.fromClient {
+		if clientIP := ExtractClientIP(pluginsState.clientAddr); clientIP != nil && clientIP.IsGlobalUnicast() && !clientIP.IsPrivate() {
+			if clientIP4 := clientIP.To4(); clientIP4 != nil {
+				return newECSOption(clientIP4.Mask(net.CIDRMask(plugin.prefixV4, 32)), plugin.prefixV4, 32)
 			}
+			return newECSOption(clientIP.Mask(net.CIDRMask(plugin.prefixV6, 128)), plugin.prefixV6, 128)
 		}
 	}
-	if options == nil {
+	if len(plugin.nets) == 0 {
 		return nil
 	}
-	prr := dns.EDNS0_SUBNET{}
-	prr.Code = dns.EDNS0SUBNET
 	net := plugin.nets[rand.Intn(len(plugin.nets))]
 	bits, totalSize := net.Mask.Size()
+	return newECSOption(net.IP, bits, totalSize)
+}
+
+func newECSOption(ip net.IP, bits int, totalSize int) *dns.EDNS0_SUBNET {
+	prr := dns.EDNS0_SUBNET{}
+	prr.Code = dns.EDNS0SUBNET
 	if totalSize == 32 {
 		prr.Family = 1
 	} else if totalSize == 128 {
@@ -71,8 +110,6 @@ func (plugin *PluginECS) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
 	}
 	prr.SourceNetmask = uint8(bits)
 	prr.SourceScope = 0
-	prr.Address = net.IP
-	*options = append(*options, &prr)
-
-	return nil
+	prr.Address = ip
+	return &prr
 }
@@ -1,23 +1,47 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"math/rand"
 	"net"
 	"strings"
+	"sync"
+	"time"
 	"unicode"
 
+	"github.com/VividCortex/ewma"
 	"github.com/jedisct1/dlog"
+	stamps "github.com/jedisct1/go-dnsstamps"
 	"github.com/miekg/dns"
 )
 
+// A forwarding server is either a plain DNS server address, the name of a
+// configured server, or a stamp. Encrypted servers use the same code paths
+// (and anonymization routes) as the main resolver.
+
+type PluginForwardServer struct {
+	address string
+	name    string
+	stamp   *stamps.ServerStamp
+}
+
 type PluginForwardEntry struct {
 	domain  string
-	servers []string
+	servers []PluginForwardServer
+}
+
+type forwardStampServer struct {
+	sync.Mutex
+	serverInfo *ServerInfo
+	lastFetch  time.Time
 }
 
 type PluginForward struct {
-	forwardMap []PluginForwardEntry
+	sync.Mutex
+	proxy        *Proxy
+	fileName     string
+	forwardMap   []PluginForwardEntry
+	stampServers map[string]*forwardStampServer
 }
 
 func (plugin *PluginForward) Name() string {
@@ -29,11 +53,24 @@ func (plugin *PluginForward) Description() string {
 }
 
 func (plugin *PluginForward) Init(proxy *Proxy) error {
-	dlog.Noticef("Loading the set of forwarding rules from [%s]", proxy.forwardFile)
-	bin, err := ReadTextFile(proxy.forwardFile)
+	plugin.proxy = proxy
+	plugin.fileName = proxy.forwardFile
+	plugin.stampServers = make(map[string]*forwardStampServer)
+	dlog.Noticef("Loading the set of forwarding rules from [%s]", plugin.fileName)
+	forwardMap, err := loadForwardingRules(proxy, plugin.fileName)
 	if err != nil {
 		return err
 	}
+	plugin.forwardMap = forwardMap
+	return nil
+}
+
+func loadForwardingRules(proxy *Proxy, fileName string) ([]PluginForwardEntry, error) {
+	bin, err := ReadTextFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var forwardMap []PluginForwardEntry
 	for lineNo, line := range strings.Split(string(bin), "\n") {
 		line = TrimAndStripInlineComments(line)
 		if len(line) == 0 {
@@ -41,29 +78,47 @@ func (plugin *PluginForward) Init(proxy *Proxy) error {
 		}
 		domain, serversStr, ok := StringTwoFields(line)
 		if !ok {
-			return fmt.Errorf(
+			return nil, fmt.Errorf(
 				"Syntax error for a forwarding rule at line %d. Expected syntax: example.com 9.9.9.9,8.8.8.8",
 				1+lineNo,
 			)
 		}
 		domain = strings.ToLower(domain)
-		var servers []string
+		var servers []PluginForwardServer
 		for _, server := range strings.Split(serversStr, ",") {
 			server = strings.TrimFunc(server, unicode.IsSpace)
-			if net.ParseIP(server) != nil {
-				server = fmt.Sprintf("%s:%d", server, 53)
+			if len(server) == 0 {
+				continue
+			}
+			if strings.HasPrefix(server, "sdns://") {
+				stamp, err := ParseServerStamp(server)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid stamp for a forwarding rule at line %d: %v", 1+lineNo, err)
+				}
+				name := stamp.ProviderName
+				if len(name) == 0 {
+					name = stamp.ServerAddrStr
+				}
+				servers = append(servers, PluginForwardServer{name: name, stamp: &stamp})
+			} else if net.ParseIP(server) != nil {
+				servers = append(servers, PluginForwardServer{address: fmt.Sprintf("%s:%d", server, 53)})
+			} else if strings.Contains(server, ":") {
+				servers = append(servers, PluginForwardServer{address: server})
+			} else if proxy.isRegisteredServer(server) {
+				servers = append(servers, PluginForwardServer{name: server})
+			} else {
+				return nil, fmt.Errorf("Unknown server [%s] for a forwarding rule at line %d", server, 1+lineNo)
 			}
-			servers = append(servers, server)
 		}
 		if len(servers) == 0 {
 			continue
 		}
-		plugin.forwardMap = append(plugin.forwardMap, PluginForwardEntry{
+		forwardMap = append(forwardMap, PluginForwardEntry{
 			domain:  domain,
 			servers: servers,
 		})
 	}
-	return nil
+	return forwardMap, nil
 }
 
 func (plugin *PluginForward) Drop() error {
@@ -71,13 +126,96 @@ func (plugin *PluginForward) Drop() error {
 }
 
 func (plugin *PluginForward) Reload() error {
-	return nil
+	return reloadRules(plugin)
+}
+
+func (plugin *PluginForward) loadRules() (func(), error) {
+	dlog.Noticef("Reloading the set of forwarding rules from [%s]", plugin.fileName)
+	forwardMap, err := loadForwardingRules(plugin.proxy, plugin.fileName)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		plugin.forwardMap = forwardMap
+	}, nil
+}
+
+// serverInfo returns the state of an encrypted forwarding server.
+// Servers given as stamps are fetched on first use, and whenever their certificates have to be refreshed.
+func (plugin *PluginForward) serverInfo(server PluginForwardServer) (*ServerInfo, error) {
+	proxy := plugin.proxy
+	if server.stamp == nil {
+		if serverInfo := proxy.serversInfo.getByName(server.name); serverInfo != nil {
+			return serverInfo, nil
+		}
+		return nil, fmt.Errorf("Server [%s] is not available", server.name)
+	}
+	key := ServerStampString(server.stamp)
+	plugin.Lock()
+	stampServer, ok := plugin.stampServers[key]
+	if !ok {
+		stampServer = &forwardStampServer{}
+		plugin.stampServers[key] = stampServer
+	}
+	plugin.Unlock()
+
+	// Concurrent queries for the same server wait for a single fetch, without blocking other servers
+	stampServer.Lock()
+	defer stampServer.Unlock()
+	if stampServer.serverInfo != nil && time.Since(stampServer.lastFetch) < proxy.certRefreshDelay {
+		return stampServer.serverInfo, nil
+	}
+	serverInfo, err := fetchServerInfo(proxy, server.name, *server.stamp, stampServer.serverInfo == nil)
+	if err != nil {
+		return nil, err
+	}
+	serverInfo.rtt = ewma.NewMovingAverage(RTTEwmaDecay)
+	serverInfo.rtt.Set(float64(serverInfo.initialRtt))
+	stampServer.serverInfo = &serverInfo
+	stampServer.lastFetch = time.Now()
+	return &serverInfo, nil
+}
+
+func (plugin *PluginForward) exchange(pluginsState *PluginsState, msg *dns.Msg, server PluginForwardServer, timeout time.Duration) (*dns.Msg, error) {
+	if len(server.address) > 0 {
+		client := dns.Client{Net: pluginsState.serverProto, Timeout: timeout}
+		respMsg, _, err := client.Exchange(msg, server.address)
+		if err != nil {
+			return nil, err
+		}
+		if respMsg.Truncated {
+			client.Net = "tcp"
+			respMsg, _, err = client.Exchange(msg, server.address)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return respMsg, nil
+	}
+	serverInfo, err := plugin.serverInfo(server)
+	if err != nil {
+		return nil, err
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	response, _, err := plugin.proxy.exchangeWithServer(serverInfo, query, pluginsState.serverProto, timeout)
+	serverInfo.noticeResponse(plugin.proxy, response, err, pluginsState.dnssec)
+	if err != nil {
+		return nil, err
+	}
+	respMsg := dns.Msg{}
+	if err := respMsg.Unpack(response); err != nil {
+		return nil, err
+	}
+	return &respMsg, nil
 }
 
 func (plugin *PluginForward) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
 	qName := pluginsState.qName
 	qNameLen := len(qName)
-	var servers []string
+	var servers []PluginForwardServer
 	for _, candidate := range plugin.forwardMap {
 		candidateLen := len(candidate.domain)
 		if candidateLen > qNameLen {
@@ -91,19 +229,38 @@ func (plugin *PluginForward) Eval(pluginsState *PluginsState, msg *dns.Msg) erro
 	if len(servers) == 0 {
 		return nil
 	}
-	server := servers[rand.Intn(len(servers))]
-	pluginsState.serverName = server
-	client := dns.Client{Net: pluginsState.serverProto, Timeout: pluginsState.timeout}
-	respMsg, _, err := client.Exchange(msg, server)
-	if err != nil {
-		return err
-	}
-	if respMsg.Truncated {
-		client.Net = "tcp"
-		respMsg, _, err = client.Exchange(msg, server)
+	var respMsg *dns.Msg
+	err := errors.New("No forwarding server available")
+	for i, server := range servers {
+		timeout := pluginsState.timeout
+		if i > 0 {
+			remaining := plugin.proxy.clientDeadline - time.Since(pluginsState.requestStart)
+			if remaining < MinRetryTimeout {
+				break
+			}
+			if remaining < timeout {
+				timeout = remaining
+			}
+		}
+		serverName := server.address
+		if len(serverName) == 0 {
+			serverName = server.name
+		}
+		pluginsState.serverName = serverName
+		var serverRespMsg *dns.Msg
+		serverRespMsg, err = plugin.exchange(pluginsState, msg, server, timeout)
 		if err != nil {
-			return err
+			dlog.Debugf("Unable to forward [%s] to [%s]: %v", qName, serverName, err)
+			continue
+		}
+		respMsg = serverRespMsg
+		if respMsg.Rcode != dns.RcodeServerFailure {
+			break
 		}
+		dlog.Debugf("Server [%s] returned SERVFAIL for forwarded name [%s]", serverName, qName)
+	}
+	if respMsg == nil {
+		return err
 	}
 	if edns0 := respMsg.IsEdns0(); edns0 == nil || !edns0.Do() {
 		respMsg.AuthenticatedData = false
@@ -17,6 +17,7 @@ type PluginQueryLog struct {
 	logger        io.Writer
 	format        string
 	ignoredQtypes []string
+	logRetries    bool
 }
 
 func (plugin *PluginQueryLog) Name() string {
@@ -31,6 +32,7 @@ func (plugin *PluginQueryLog) Init(proxy *Proxy) error {
 	plugin.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.queryLogFile)
 	plugin.format = proxy.queryLogFormat
 	plugin.ignoredQtypes = proxy.queryLogIgnoredQtypes
+	plugin.logRetries = proxy.queryLogRetries
 
 	return nil
 }
@@ -77,20 +79,11 @@ func (plugin *PluginQueryLog) Eval(pluginsState *PluginsState, msg *dns.Msg) err
 	}
 	qName := pluginsState.qName
 
-	if pluginsState.cacheHit && !pluginsState.forceRequest {
+	switch pluginsState.returnCode {
+	case PluginsReturnCodeSynth, PluginsReturnCodeCloak, PluginsReturnCodeParseError:
 		pluginsState.serverName = "-"
-		pluginsState.returnCode = PluginsReturnCodeCacheHit
-	} else if pluginsState.cacheHit {
-		pluginsState.serverName = "-"
-		pluginsState.returnCode = PluginsReturnCodeForcedCache
-	} else {
-		switch pluginsState.returnCode {
-		case PluginsReturnCodeSynth, PluginsReturnCodeCloak, PluginsReturnCodeParseError:
-			pluginsState.serverName = "-"
-		case PluginsReturnCodePostfetch:
-			clientIPStr = "-"
-		}
-
+	case PluginsReturnCodePostfetch:
+		clientIPStr = "-"
 	}
 
 	returnCode, ok := PluginsReturnCodeToString[pluginsState.returnCode]
@@ -114,15 +107,20 @@ func (plugin *PluginQueryLog) Eval(pluginsState *PluginsState, msg *dns.Msg) err
 		millis := time.Now().Nanosecond() / 1000
 		ttl := pluginsState.cachedTTL / time.Second
 		tsStr := fmt.Sprintf("[%d-%02d-%02d %02d:%02d:%02d.%06d]", year, int(month), day, hour, minute, second, millis)
-		line = fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%dms\t%d\t%s\n", tsStr, clientIPStr, StringQuote(qName), qType, returnCode, requestDuration/time.Millisecond,
+		line = fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%dms\t%d\t%s", tsStr, clientIPStr, StringQuote(qName), qType, returnCode, requestDuration/time.Millisecond,
 			ttl, StringQuote(pluginsState.serverName))
+		// The number of retries is an optional extra column, so that existing parsers keep working
+		if plugin.logRetries {
+			line += fmt.Sprintf("\t%d", pluginsState.retries)
+		}
+		line += "\n"
 	} else if plugin.format == "ltsv" {
 		cached := 0
 		if pluginsState.cacheHit {
 			cached = 1
 		}
-		line = fmt.Sprintf("time:%d\thost:%s\tmessage:%s\ttype:%s\treturn:%s\tcached:%d\tduration:%d\tserver:%s\n",
-			time.Now().Unix(), clientIPStr, StringQuote(qName), qType, returnCode, cached, requestDuration/time.Millisecond, StringQuote(pluginsState.serverName))
+		line = fmt.Sprintf("time:%d\thost:%s\tmessage:%s\ttype:%s\treturn:%s\tcached:%d\tduration:%d\tserver:%s\tretries:%d\n",
+			time.Now().Unix(), clientIPStr, StringQuote(qName), qType, returnCode, cached, requestDuration/time.Millisecond, StringQuote(pluginsState.serverName), pluginsState.retries)
 	} else {
 		dlog.Fatalf("Unexpected log format: [%s]", plugin.format)
 	}
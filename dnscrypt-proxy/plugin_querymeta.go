@@ -9,11 +9,11 @@ type PluginQueryMeta struct {
 }
 
 func (plugin *PluginQueryMeta) Name() string {
-	return "query_log"
+	return "query_meta"
 }
 
 func (plugin *PluginQueryMeta) Description() string {
-	return "Log DNS queries."
+	return "Add metadata to DNS queries."
 }
 
 func (plugin *PluginQueryMeta) Init(proxy *Proxy) error {
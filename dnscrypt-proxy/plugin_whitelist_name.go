@@ -5,17 +5,17 @@
 	"fmt"
 	"io"
 	"net"
-	"strings"
 	"time"
-	"unicode"
 
 	"github.com/jedisct1/dlog"
 	"github.com/miekg/dns"
 )
 
 type PluginWhitelistName struct {
+	fileName        string
 	allWeeklyRanges *map[string]WeeklyRanges
 	patternMatcher  *PatternMatcher
+	clientGroups    *ClientGroups
 	logger          io.Writer
 	format          string
 }
@@ -29,40 +29,27 @@ func (plugin *PluginWhitelistName) Description() string {
 }
 
 func (plugin *PluginWhitelistName) Init(proxy *Proxy) error {
-	dlog.Noticef("Loading the set of whitelisting rules from [%s]", proxy.whitelistNameFile)
-	bin, err := ReadTextFile(proxy.whitelistNameFile)
-	if err != nil {
-		return err
-	}
+	plugin.fileName = proxy.whitelistNameFile
 	plugin.allWeeklyRanges = proxy.allWeeklyRanges
-	plugin.patternMatcher = NewPatternMatcher()
-	for lineNo, line := range strings.Split(string(bin), "\n") {
-		line = TrimAndStripInlineComments(line)
-		if len(line) == 0 {
-			continue
+	plugin.clientGroups = proxy.clientGroups
+	if len(plugin.fileName) > 0 {
+		dlog.Noticef("Loading the set of whitelisting rules from [%s]", plugin.fileName)
+		patternMatcher, _, err := loadNamePatterns(plugin.fileName, plugin.allWeeklyRanges, "whitelist")
+		if err != nil {
+			return err
 		}
-		parts := strings.Split(line, "@")
-		timeRangeName := ""
-		if len(parts) == 2 {
-			line = strings.TrimFunc(parts[0], unicode.IsSpace)
-			timeRangeName = strings.TrimFunc(parts[1], unicode.IsSpace)
-		} else if len(parts) > 2 {
-			dlog.Errorf("Syntax error in whitelist rules at line %d -- Unexpected @ character", 1+lineNo)
+		plugin.patternMatcher = patternMatcher
+	}
+	for _, group := range plugin.clientGroups.list() {
+		if group.whitelistNameFile == nil || len(*group.whitelistNameFile) == 0 {
 			continue
 		}
-		var weeklyRanges *WeeklyRanges
-		if len(timeRangeName) > 0 {
-			weeklyRangesX, ok := (*plugin.allWeeklyRanges)[timeRangeName]
-			if !ok {
-				dlog.Errorf("Time range [%s] not found at line %d", timeRangeName, 1+lineNo)
-			} else {
-				weeklyRanges = &weeklyRangesX
-			}
-		}
-		if err := plugin.patternMatcher.Add(line, weeklyRanges, lineNo+1); err != nil {
-			dlog.Error(err)
-			continue
+		dlog.Noticef("Loading the set of whitelisting rules for the [%s] client group from [%s]", group.name, *group.whitelistNameFile)
+		patternMatcher, _, err := loadNamePatterns(*group.whitelistNameFile, group.allWeeklyRanges, "whitelist")
+		if err != nil {
+			return err
 		}
+		group.whitelistPatternMatcher = patternMatcher
 	}
 	if len(proxy.whitelistNameLogFile) == 0 {
 		return nil
@@ -78,12 +65,58 @@ func (plugin *PluginWhitelistName) Drop() error {
 }
 
 func (plugin *PluginWhitelistName) Reload() error {
-	return nil
+	return reloadRules(plugin)
+}
+
+func (plugin *PluginWhitelistName) loadRules() (func(), error) {
+	var patternMatcher *PatternMatcher
+	if len(plugin.fileName) > 0 {
+		dlog.Noticef("Reloading the set of whitelisting rules from [%s]", plugin.fileName)
+		var syntaxErrors int
+		var err error
+		patternMatcher, syntaxErrors, err = loadNamePatterns(plugin.fileName, plugin.allWeeklyRanges, "whitelist")
+		if err != nil {
+			return nil, err
+		}
+		if syntaxErrors > 0 {
+			return nil, fmt.Errorf("%d invalid rule(s) in [%s]", syntaxErrors, plugin.fileName)
+		}
+	}
+	groupsPatternMatchers := make(map[*ClientGroup]*PatternMatcher)
+	for _, group := range plugin.clientGroups.list() {
+		if group.whitelistNameFile == nil || len(*group.whitelistNameFile) == 0 {
+			continue
+		}
+		dlog.Noticef("Reloading the set of whitelisting rules for the [%s] client group from [%s]", group.name, *group.whitelistNameFile)
+		groupPatternMatcher, syntaxErrors, err := loadNamePatterns(*group.whitelistNameFile, group.allWeeklyRanges, "whitelist")
+		if err != nil {
+			return nil, err
+		}
+		if syntaxErrors > 0 {
+			return nil, fmt.Errorf("%d invalid rule(s) in [%s]", syntaxErrors, *group.whitelistNameFile)
+		}
+		groupsPatternMatchers[group] = groupPatternMatcher
+	}
+	return func() {
+		if patternMatcher != nil {
+			plugin.patternMatcher = patternMatcher
+		}
+		for group, groupPatternMatcher := range groupsPatternMatchers {
+			group.whitelistPatternMatcher = groupPatternMatcher
+		}
+	}, nil
 }
 
 func (plugin *PluginWhitelistName) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	patternMatcher := plugin.patternMatcher
+	if group := pluginsState.clientGroup; group != nil && group.whitelistNameFile != nil {
+		patternMatcher = group.whitelistPatternMatcher
+	}
+	if patternMatcher == nil {
+		return nil
+	}
 	qName := pluginsState.qName
-	whitelist, reason, xweeklyRanges := plugin.patternMatcher.Eval(qName)
+	whitelist, reason, xweeklyRanges := patternMatcher.Eval(qName)
 	var weeklyRanges *WeeklyRanges
 	if xweeklyRanges != nil {
 		weeklyRanges = xweeklyRanges.(*WeeklyRanges)
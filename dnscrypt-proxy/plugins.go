@@ -2,6 +2,7 @@
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"strings"
 	"sync"
@@ -25,6 +26,7 @@
 
 type PluginsGlobals struct {
 	sync.RWMutex
+	reloadLock             sync.Mutex
 	queryPlugins           *[]Plugin
 	responsePlugins        *[]Plugin
 	loggingPlugins         *[]Plugin
@@ -51,6 +53,10 @@ type PluginsGlobals struct {
 	PluginsReturnCodePostfetch
 	PluginsReturnCodeCacheHit
 	PluginsReturnCodeForcedCache
+	PluginsReturnCodeDNSSECBogus
+	PluginsReturnCodePrefetch
+	PluginsReturnCodeStale
+	PluginsReturnCodeCoalesced
 )
 
 var PluginsReturnCodeToString = map[PluginsReturnCode]string{
@@ -69,6 +75,10 @@ type PluginsGlobals struct {
 	PluginsReturnCodePostfetch:     "POSTFETCH",
 	PluginsReturnCodeCacheHit:      "CACHE_HIT",
 	PluginsReturnCodeForcedCache:   "FORCED_CACHE",
+	PluginsReturnCodeDNSSECBogus:   "DNSSEC_BOGUS",
+	PluginsReturnCodePrefetch:      "PREFETCH",
+	PluginsReturnCodeStale:         "STALE",
+	PluginsReturnCodeCoalesced:     "COALESCED",
 }
 
 type PluginsState struct {
@@ -82,6 +92,8 @@ type PluginsState struct {
 	synthResponse                    *dns.Msg
 	dnssec                           bool
 	cacheSize                        int
+	ecsScope                         int
+	cacheMaxMemory                   int
 	cacheForcedMaxTTL                time.Duration
 	cacheNegMinTTL                   uint32
 	cacheNegMaxTTL                   uint32
@@ -90,77 +102,257 @@ type PluginsState struct {
 	rejectTTL                        uint32
 	questionMsg                      *dns.Msg
 	cachedTTL                        time.Duration
+	staleSince                       time.Time
 	qName                            string
 	requestStart                     time.Time
 	requestEnd                       time.Time
 	cacheHit                         bool
 	forceRequest                     bool
+	prefetch                         bool
+	prefetcher                       *CachePrefetcher
+	rawQuery                         []byte
 	cacheForced                      bool
 	flushEnabled                     bool
 	returnCode                       PluginsReturnCode
 	serverName                       string
 	serverProto                      string
 	timeout                          time.Duration
+	metrics                          *Metrics
+	clientGroup                      *ClientGroup
+	retries                          int
 }
 
-func (proxy *Proxy) InitPluginsGlobals() error {
-	queryPlugins := &[]Plugin{}
+const (
+	PluginsChainQuery    = "query"
+	PluginsChainResponse = "response"
+	PluginsChainLogging  = "logging"
+)
 
-	if len(proxy.queryMeta) != 0 {
-		*queryPlugins = append(*queryPlugins, Plugin(new(PluginQueryMeta)))
-	}
-	if len(proxy.whitelistNameFile) != 0 {
-		*queryPlugins = append(*queryPlugins, Plugin(new(PluginWhitelistName)))
-	}
+type PluginDefinition struct {
+	chain      string
+	newPlugin  func() Plugin
+	configured func(proxy *Proxy) bool
+	requires   []string // plugins that must be enabled, and run first when in the same chain
+}
+
+var PluginDefinitions = map[string]PluginDefinition{
+	"query_meta": {
+		chain:      PluginsChainQuery,
+		newPlugin:  func() Plugin { return new(PluginQueryMeta) },
+		configured: func(proxy *Proxy) bool { return len(proxy.queryMeta) != 0 },
+	},
+	"whitelist_name": {
+		chain:     PluginsChainQuery,
+		newPlugin: func() Plugin { return new(PluginWhitelistName) },
+		configured: func(proxy *Proxy) bool {
+			return len(proxy.whitelistNameFile) != 0 ||
+				proxy.clientGroups.hasFiles(func(group *ClientGroup) *string { return group.whitelistNameFile })
+		},
+	},
+	"admin_names": {
+		chain:      PluginsChainQuery,
+		newPlugin:  func() Plugin { return new(PluginAdminNames) },
+		configured: func(proxy *Proxy) bool { return len(proxy.adminAPIListenAddress) != 0 },
+	},
+	"firefox": {
+		chain:      PluginsChainQuery,
+		newPlugin:  func() Plugin { return new(PluginFirefox) },
+		configured: func(proxy *Proxy) bool { return true },
+	},
+	"ecs": {
+		chain:     PluginsChainQuery,
+		newPlugin: func() Plugin { return new(PluginECS) },
+		configured: func(proxy *Proxy) bool {
+			return len(proxy.ednsClientSubnets) != 0 || proxy.ednsClientSubnetFromClient || proxy.ednsClientSubnetPolicy != ECSPolicyKeep
+		},
+	},
+	"block_name": {
+		chain:     PluginsChainQuery,
+		newPlugin: func() Plugin { return new(PluginBlockName) },
+		configured: func(proxy *Proxy) bool {
+			return len(proxy.blockNameFile) != 0 ||
+				proxy.clientGroups.hasFiles(func(group *ClientGroup) *string { return group.blockNameFile })
+		},
+	},
+	"block_ipv6": {
+		chain:      PluginsChainQuery,
+		newPlugin:  func() Plugin { return new(PluginBlockIPv6) },
+		configured: func(proxy *Proxy) bool { return proxy.pluginBlockIPv6 },
+	},
+	"cloak": {
+		chain:     PluginsChainQuery,
+		newPlugin: func() Plugin { return new(PluginCloak) },
+		configured: func(proxy *Proxy) bool {
+			return len(proxy.cloakFile) != 0 ||
+				proxy.clientGroups.hasFiles(func(group *ClientGroup) *string { return group.cloakFile })
+		},
+	},
+	"get_set_payload_size": {
+		chain:      PluginsChainQuery,
+		newPlugin:  func() Plugin { return new(PluginGetSetPayloadSize) },
+		configured: func(proxy *Proxy) bool { return true },
+	},
+	"dnssec": {
+		chain:      PluginsChainQuery,
+		newPlugin:  func() Plugin { return new(PluginDNSSEC) },
+		configured: func(proxy *Proxy) bool { return proxy.dnssecValidation },
+		requires:   []string{"get_set_payload_size", "dnssec_response"},
+	},
+	"cache": {
+		chain:      PluginsChainQuery,
+		newPlugin:  func() Plugin { return new(PluginCache) },
+		configured: func(proxy *Proxy) bool { return proxy.cache },
+		requires:   []string{"get_set_payload_size", "cache_response"},
+	},
+	"forward": {
+		chain:      PluginsChainQuery,
+		newPlugin:  func() Plugin { return new(PluginForward) },
+		configured: func(proxy *Proxy) bool { return len(proxy.forwardFile) != 0 },
+	},
+	"block_unqualified": {
+		chain:      PluginsChainQuery,
+		newPlugin:  func() Plugin { return new(PluginBlockUnqualified) },
+		configured: func(proxy *Proxy) bool { return proxy.pluginBlockUnqualified },
+	},
+	"block_undelegated": {
+		chain:      PluginsChainQuery,
+		newPlugin:  func() Plugin { return new(PluginBlockUndelegated) },
+		configured: func(proxy *Proxy) bool { return proxy.pluginBlockUndelegated },
+	},
+	"dnssec_response": {
+		chain:      PluginsChainResponse,
+		newPlugin:  func() Plugin { return new(PluginDNSSECResponse) },
+		configured: func(proxy *Proxy) bool { return proxy.dnssecValidation },
+		requires:   []string{"dnssec"},
+	},
+	"nx_log": {
+		chain:      PluginsChainResponse,
+		newPlugin:  func() Plugin { return new(PluginNxLog) },
+		configured: func(proxy *Proxy) bool { return len(proxy.nxLogFile) != 0 },
+	},
+	"block_name_response": {
+		chain:     PluginsChainResponse,
+		newPlugin: func() Plugin { return new(PluginBlockNameResponse) },
+		configured: func(proxy *Proxy) bool {
+			return len(proxy.blockNameFile) != 0 ||
+				proxy.clientGroups.hasFiles(func(group *ClientGroup) *string { return group.blockNameFile })
+		},
+		requires: []string{"block_name"},
+	},
+	"block_ip": {
+		chain:      PluginsChainResponse,
+		newPlugin:  func() Plugin { return new(PluginBlockIP) },
+		configured: func(proxy *Proxy) bool { return len(proxy.blockIPFile) != 0 },
+	},
+	"dns64": {
+		chain:      PluginsChainResponse,
+		newPlugin:  func() Plugin { return new(PluginDNS64) },
+		configured: func(proxy *Proxy) bool { return len(proxy.dns64Resolvers) != 0 || len(proxy.dns64Prefixes) != 0 },
+	},
+	"cache_response": {
+		chain:      PluginsChainResponse,
+		newPlugin:  func() Plugin { return new(PluginCacheResponse) },
+		configured: func(proxy *Proxy) bool { return proxy.cache },
+		requires:   []string{"cache"},
+	},
+	"query_log": {
+		chain:      PluginsChainLogging,
+		newPlugin:  func() Plugin { return new(PluginQueryLog) },
+		configured: func(proxy *Proxy) bool { return len(proxy.queryLogFile) != 0 },
+	},
+}
 
-	*queryPlugins = append(*queryPlugins, Plugin(new(PluginFirefox)))
+var DefaultPluginsOrder = map[string][]string{
+	PluginsChainQuery: {
+		"query_meta", "whitelist_name", "admin_names", "firefox", "ecs", "block_name", "block_ipv6", "cloak",
+		"get_set_payload_size", "dnssec", "cache", "forward", "block_unqualified", "block_undelegated",
+	},
+	PluginsChainResponse: {"dnssec_response", "nx_log", "block_name_response", "block_ip", "dns64", "cache_response"},
+	PluginsChainLogging:  {"query_log"},
+}
 
-	if len(proxy.ednsClientSubnets) != 0 {
-		*queryPlugins = append(*queryPlugins, Plugin(new(PluginECS)))
-	}
-	if len(proxy.blockNameFile) != 0 {
-		*queryPlugins = append(*queryPlugins, Plugin(new(PluginBlockName)))
-	}
-	if proxy.pluginBlockIPv6 {
-		*queryPlugins = append(*queryPlugins, Plugin(new(PluginBlockIPv6)))
-	}
-	if len(proxy.cloakFile) != 0 {
-		*queryPlugins = append(*queryPlugins, Plugin(new(PluginCloak)))
-	}
-	*queryPlugins = append(*queryPlugins, Plugin(new(PluginGetSetPayloadSize)))
-	if proxy.cache {
-		*queryPlugins = append(*queryPlugins, Plugin(new(PluginCache)))
-	}
-	if len(proxy.forwardFile) != 0 {
-		*queryPlugins = append(*queryPlugins, Plugin(new(PluginForward)))
+// pluginsChain returns the names of the plugins to run in a chain, in order.
+// Plugins listed in the configuration but not configured are skipped.
+func (proxy *Proxy) pluginsChain(chain string) ([]string, error) {
+	names, explicit := proxy.pluginsOrder[chain], true
+	if names == nil {
+		names, explicit = DefaultPluginsOrder[chain], false
+	}
+	seen := make(map[string]bool)
+	var enabledNames []string
+	for _, name := range names {
+		definition, found := PluginDefinitions[name]
+		if !found {
+			return nil, fmt.Errorf("Unknown plugin [%s] in the %s plugins chain", name, chain)
+		}
+		if definition.chain != chain {
+			return nil, fmt.Errorf("Plugin [%s] belongs to the %s plugins chain, not to the %s one", name, definition.chain, chain)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("Plugin [%s] is listed more than once in the %s plugins chain", name, chain)
+		}
+		seen[name] = true
+		if !definition.configured(proxy) {
+			if explicit {
+				dlog.Noticef("Plugin [%s] is not configured -- skipping", name)
+			}
+			continue
+		}
+		enabledNames = append(enabledNames, name)
 	}
-	if proxy.pluginBlockUnqualified {
-		*queryPlugins = append(*queryPlugins, Plugin(new(PluginBlockUnqualified)))
+	return enabledNames, nil
+}
+
+func checkPluginsDependencies(chains map[string][]string) error {
+	positions := make(map[string]int)
+	for _, names := range chains {
+		for position, name := range names {
+			positions[name] = position
+		}
 	}
-	if proxy.pluginBlockUndelegated {
-		*queryPlugins = append(*queryPlugins, Plugin(new(PluginBlockUndelegated)))
+	for _, chain := range []string{PluginsChainQuery, PluginsChainResponse, PluginsChainLogging} {
+		for position, name := range chains[chain] {
+			for _, required := range PluginDefinitions[name].requires {
+				requiredPosition, enabled := positions[required]
+				if !enabled {
+					return fmt.Errorf("Plugin [%s] requires the [%s] plugin", name, required)
+				}
+				if PluginDefinitions[required].chain == chain && requiredPosition > position {
+					return fmt.Errorf("Plugin [%s] must come after the [%s] plugin", name, required)
+				}
+			}
+		}
 	}
+	return nil
+}
 
-	responsePlugins := &[]Plugin{}
-	if len(proxy.nxLogFile) != 0 {
-		*responsePlugins = append(*responsePlugins, Plugin(new(PluginNxLog)))
-	}
-	if len(proxy.blockNameFile) != 0 {
-		*responsePlugins = append(*responsePlugins, Plugin(new(PluginBlockNameResponse)))
+func (proxy *Proxy) InitPluginsGlobals() error {
+	chains := make(map[string][]string)
+	for _, chain := range []string{PluginsChainQuery, PluginsChainResponse, PluginsChainLogging} {
+		names, err := proxy.pluginsChain(chain)
+		if err != nil {
+			return err
+		}
+		chains[chain] = names
 	}
-	if len(proxy.blockIPFile) != 0 {
-		*responsePlugins = append(*responsePlugins, Plugin(new(PluginBlockIP)))
+	if err := checkPluginsDependencies(chains); err != nil {
+		return err
 	}
-	if len(proxy.dns64Resolvers) != 0 || len(proxy.dns64Prefixes) != 0 {
-		*responsePlugins = append(*responsePlugins, Plugin(new(PluginDNS64)))
+
+	queryPlugins := &[]Plugin{}
+	for _, name := range chains[PluginsChainQuery] {
+		*queryPlugins = append(*queryPlugins, PluginDefinitions[name].newPlugin())
 	}
-	if proxy.cache {
-		*responsePlugins = append(*responsePlugins, Plugin(new(PluginCacheResponse)))
+	responsePlugins := &[]Plugin{}
+	for _, name := range chains[PluginsChainResponse] {
+		*responsePlugins = append(*responsePlugins, PluginDefinitions[name].newPlugin())
 	}
-
 	loggingPlugins := &[]Plugin{}
-	if len(proxy.queryLogFile) != 0 {
-		*loggingPlugins = append(*loggingPlugins, Plugin(new(PluginQueryLog)))
+	for _, name := range chains[PluginsChainLogging] {
+		*loggingPlugins = append(*loggingPlugins, PluginDefinitions[name].newPlugin())
+	}
+	for _, chain := range []string{PluginsChainQuery, PluginsChainResponse, PluginsChainLogging} {
+		dlog.Debugf("Plugins %s chain: %v", chain, chains[chain])
 	}
 
 	for _, plugin := range *queryPlugins {
@@ -188,6 +380,68 @@ func (proxy *Proxy) InitPluginsGlobals() error {
 	return nil
 }
 
+// ReloadPlugins asks every plugin to reload its rules. Rules files are parsed without holding
+// the plugins lock, which is only taken to install the new rules all at once, so that queries
+// never see a partially updated set of rules.
+// A plugin failing to reload keeps its previous state.
+func (proxy *Proxy) ReloadPlugins() {
+	pluginsGlobals := &proxy.pluginsGlobals
+	pluginsGlobals.reloadLock.Lock()
+	defer pluginsGlobals.reloadLock.Unlock()
+	pluginsGlobals.RLock()
+	chains := []*[]Plugin{pluginsGlobals.queryPlugins, pluginsGlobals.responsePlugins, pluginsGlobals.loggingPlugins}
+	pluginsGlobals.RUnlock()
+	var installs []func()
+	var otherPlugins []Plugin
+	for _, plugins := range chains {
+		if plugins == nil {
+			continue
+		}
+		for _, plugin := range *plugins {
+			loader, ok := plugin.(rulesLoader)
+			if !ok {
+				otherPlugins = append(otherPlugins, plugin)
+				continue
+			}
+			install, err := loader.loadRules()
+			if err != nil {
+				dlog.Errorf("Unable to reload [%s]: %v -- Keeping the previous rules", plugin.Name(), err)
+				continue
+			}
+			if install != nil {
+				installs = append(installs, install)
+			}
+		}
+	}
+	pluginsGlobals.Lock()
+	defer pluginsGlobals.Unlock()
+	for _, install := range installs {
+		install()
+	}
+	for _, plugin := range otherPlugins {
+		if err := plugin.Reload(); err != nil {
+			dlog.Errorf("Unable to reload [%s]: %v -- Keeping the previous rules", plugin.Name(), err)
+		}
+	}
+}
+
+// rulesLoader is implemented by plugins whose rules can be loaded without affecting queries.
+// loadRules returns a function installing the new rules, or nil if there is nothing to install.
+type rulesLoader interface {
+	loadRules() (func(), error)
+}
+
+func reloadRules(loader rulesLoader) error {
+	install, err := loader.loadRules()
+	if err != nil {
+		return err
+	}
+	if install != nil {
+		install()
+	}
+	return nil
+}
+
 // blockedQueryResponse can be 'refused', 'hinfo' or IP responses 'a:IPv4,aaaa:IPv6
 func parseBlockedQueryResponse(blockedResponse string, pluginsGlobals *PluginsGlobals) {
 	blockedResponse = StringStripSpaces(strings.ToLower(blockedResponse))
@@ -251,6 +505,8 @@ func NewPluginsState(proxy *Proxy, clientProto string, clientAddr *net.Addr, ser
 		clientProto:                      clientProto,
 		clientAddr:                       clientAddr,
 		cacheSize:                        proxy.cacheSize,
+		ecsScope:                         -1,
+		cacheMaxMemory:                   proxy.cacheMaxMemory,
 		cacheForced:                      proxy.cacheForced,
 		flushEnabled:                     proxy.cacheFlushEnabled,
 		cacheNegMinTTL:                   proxy.cacheNegMinTTL,
@@ -268,6 +524,9 @@ func NewPluginsState(proxy *Proxy, clientProto string, clientAddr *net.Addr, ser
 		maxUnencryptedUDPSafePayloadSize: MaxDNSUDPSafePacketSize,
 		sessionData:                      make(map[string]interface{}),
 		forceRequest:                     false,
+		prefetch:                         clientProto == PrefetchClient,
+		prefetcher:                       proxy.cachePrefetcher,
+		metrics:                          proxy.metrics,
 	}
 }
 
@@ -286,6 +545,7 @@ func (pluginsState *PluginsState) ApplyQueryPlugins(pluginsGlobals *PluginsGloba
 	dlog.Debugf("Handling query for [%v]", qName)
 	pluginsState.qName = qName
 	pluginsState.questionMsg = &msg
+	pluginsState.rawQuery = packet
 	if len(*pluginsGlobals.queryPlugins) == 0 && len(*pluginsGlobals.loggingPlugins) == 0 {
 		return packet, nil
 	}
@@ -336,6 +596,14 @@ func (pluginsState *PluginsState) ApplyResponsePlugins(pluginsGlobals *PluginsGl
 	default:
 		pluginsState.returnCode = PluginsReturnCodeResponseError
 	}
+	// A response to a query with a client subnet applies to the clients of the same subnet, truncated to its scope prefix
+	if querySubnet := ednsClientSubnet(pluginsState.questionMsg); querySubnet != nil {
+		scope := 0
+		if responseSubnet := ednsClientSubnet(&msg); responseSubnet != nil {
+			scope = int(responseSubnet.SourceScope)
+		}
+		pluginsState.ecsScope = Min(scope, int(querySubnet.SourceNetmask))
+	}
 	removeEDNS0Options(&msg)
 	pluginsGlobals.RLock()
 	defer pluginsGlobals.RUnlock()
@@ -367,6 +635,17 @@ func (pluginsState *PluginsState) ApplyResponsePlugins(pluginsGlobals *PluginsGl
 }
 
 func (pluginsState *PluginsState) ApplyLoggingPlugins(pluginsGlobals *PluginsGlobals) error {
+	if pluginsState.cacheHit {
+		pluginsState.serverName = "-"
+		if pluginsState.forceRequest {
+			pluginsState.returnCode = PluginsReturnCodeForcedCache
+		} else {
+			pluginsState.returnCode = PluginsReturnCodeCacheHit
+		}
+	} else if pluginsState.prefetch && pluginsState.returnCode == PluginsReturnCodePass {
+		pluginsState.returnCode = PluginsReturnCodePrefetch
+	}
+	pluginsState.metrics.countReturnCode(pluginsState.returnCode)
 	if len(*pluginsGlobals.loggingPlugins) == 0 {
 		return nil
 	}
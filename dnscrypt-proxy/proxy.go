@@ -3,9 +3,11 @@
 import (
 	cryptorand "crypto/rand"
 	"encoding/binary"
+	"errors"
 	"net"
 	"os"
 	"runtime"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -16,6 +18,10 @@
 	"golang.org/x/crypto/curve25519"
 )
 
+const (
+	MinRetryTimeout = 100 * time.Millisecond
+)
+
 type Proxy struct {
 	udpListeners                   []*net.UDPConn
 	tcpListeners                   []*net.TCPListener
@@ -31,20 +37,32 @@ type Proxy struct {
 	certRefreshDelay               time.Duration
 	certRefreshDelayAfterFailure   time.Duration
 	certIgnoreTimestamp            bool
+	serversRefreshLock             sync.Mutex
 	mainProto                      string
 	listenAddresses                []string
 	localDoHListenAddresses        []string
 	localDoHPath                   string
 	localDoHCertFile               string
 	localDoHCertKeyFile            string
+	metrics                        *Metrics
+	metricsListenAddress           string
+	metricsPath                    string
+	adminAPIListenAddress          string
+	adminAPIToken                  string
+	adminBlockedNames              *AdminNames
+	adminAllowedNames              *AdminNames
 	daemonize                      bool
 	registeredServers              []RegisteredServer
 	registeredRelays               []RegisteredServer
 	pluginBlockIPv6                bool
 	pluginBlockUnqualified         bool
 	pluginBlockUndelegated         bool
+	dnssecValidation               bool
+	dnssecTrustAnchors             []string
 	cache                          bool
 	cacheSize                      int
+	cacheMaxMemory                 int
+	cacheTTLRulesFile              string
 	cacheForced                    bool
 	cacheFlushEnabled              bool
 	cachePersistent                bool
@@ -54,11 +72,17 @@ type Proxy struct {
 	cacheMinTTL                    uint32
 	cacheMaxTTL                    uint32
 	cacheForcedMaxTTL              time.Duration
+	cachePrefetcher                *CachePrefetcher
+	staleAnswerClientTimeout       time.Duration
+	staleAnswerTTL                 time.Duration
+	staleAnswerMaxAge              time.Duration
+	inflightQueries                InflightQueries
 	rejectTTL                      uint32
 	cloakTTL                       uint32
 	queryLogFile                   string
 	queryLogFormat                 string
 	queryLogIgnoredQtypes          []string
+	queryLogRetries                bool
 	cacheFilename                  string
 	extraCacheFiles                []string
 	nxLogFile                      string
@@ -75,12 +99,18 @@ type Proxy struct {
 	forwardFile                    string
 	cloakFile                      string
 	captivePortalFile              string
+	reloadRulesOnChange            bool
 	pluginsGlobals                 PluginsGlobals
 	sources                        []*Source
 	clientsCount                   uint32
 	maxClients                     uint32
 	xTransport                     *XTransport
+	udpSocketPools                 *UDPSocketPools
 	allWeeklyRanges                *map[string]WeeklyRanges
+	clientGroups                   *ClientGroups
+	upstreamRetries                int
+	clientDeadline                 time.Duration
+	pluginsOrder                   map[string][]string
 	logMaxSize                     int
 	logMaxAge                      int
 	logMaxBackups                  int
@@ -95,6 +125,10 @@ type Proxy struct {
 	dns64Prefixes                  []string
 	dns64Resolvers                 []string
 	ednsClientSubnets              []*net.IPNet
+	ednsClientSubnetFromClient     bool
+	ednsClientSubnetPrefixV4       int
+	ednsClientSubnetPrefixV6       int
+	ednsClientSubnetPolicy         string
 }
 
 func (proxy *Proxy) registerUDPListener(conn *net.UDPConn) {
@@ -219,6 +253,18 @@ func (proxy *Proxy) addLocalDoHListener(listenAddrStr string) {
 	dlog.Noticef("Now listening to https://%v%v [DoH]", listenAddrStr, proxy.localDoHPath)
 }
 
+// refreshServers refreshes the certificates and configurations of all the servers.
+// Refreshes requested using the admin API never run at the same time as periodic refreshes.
+func (proxy *Proxy) refreshServers() (int, error) {
+	proxy.serversRefreshLock.Lock()
+	defer proxy.serversRefreshLock.Unlock()
+	liveServers, err := proxy.serversInfo.refresh(proxy)
+	if liveServers > 0 {
+		proxy.certIgnoreTimestamp = false
+	}
+	return liveServers, err
+}
+
 func (proxy *Proxy) StartProxy() {
 	proxy.questionSizeEstimator = NewQuestionSizeEstimator()
 	if _, err := cryptorand.Read(proxy.proxySecretKey[:]); err != nil {
@@ -229,11 +275,17 @@ func (proxy *Proxy) StartProxy() {
 		proxy.serversInfo.registerServer(registeredServer.name, registeredServer.stamp)
 	}
 	proxy.startAcceptingClients()
-	liveServers, err := proxy.serversInfo.refresh(proxy)
-
-	if liveServers > 0 {
-		proxy.certIgnoreTimestamp = false
+	if proxy.metrics != nil {
+		proxy.startMetricsListener()
 	}
+	if len(proxy.adminAPIListenAddress) > 0 {
+		proxy.startAdminAPIListener()
+	}
+	proxy.reloadOnSignal()
+	if proxy.reloadRulesOnChange {
+		proxy.watchRulesFiles()
+	}
+	liveServers, err := proxy.refreshServers()
 	if proxy.showCerts {
 		os.Exit(0)
 	}
@@ -275,14 +327,14 @@ func (proxy *Proxy) StartProxy() {
 					delay = proxy.certRefreshDelayAfterFailure
 				}
 				clocksmith.Sleep(delay)
-				liveServers, _ = proxy.serversInfo.refresh(proxy)
-				if liveServers > 0 {
-					proxy.certIgnoreTimestamp = false
-				}
+				liveServers, _ = proxy.refreshServers()
 				runtime.GC()
 			}
 		}()
 	}
+	if proxy.cachePrefetcher != nil {
+		go proxy.cachePrefetcher.run(proxy)
+	}
 	if proxy.cachePersistent && proxy.cacheAutoSave > 0 && len(proxy.serversInfo.registeredServers) > 0 {
 		go func() {
 			for {
@@ -340,7 +392,7 @@ func (proxy *Proxy) tcpListener(acceptPc *net.TCPListener) {
 				return
 			}
 			defer proxy.clientsCountDec()
-			if err := clientPc.SetDeadline(time.Now().Add(proxy.timeout)); err != nil {
+			if err := clientPc.SetDeadline(time.Now().Add(proxy.clientDeadline)); err != nil {
 				return
 			}
 			packet, err := ReadPrefixed(&clientPc)
@@ -398,29 +450,28 @@ func (proxy *Proxy) prepareForRelay(ip net.IP, port int, encryptedQuery *[]byte)
 	*encryptedQuery = relayedQuery
 }
 
-func (proxy *Proxy) exchangeWithUDPServer(serverInfo *ServerInfo, sharedKey *[32]byte, encryptedQuery []byte, clientNonce []byte) ([]byte, error) {
+func (proxy *Proxy) exchangeWithUDPServer(serverInfo *ServerInfo, sharedKey *[32]byte, encryptedQuery []byte, clientNonce []byte, timeout time.Duration) ([]byte, error) {
 	upstreamAddr := serverInfo.UDPAddr
 	if serverInfo.RelayUDPAddr != nil {
 		upstreamAddr = serverInfo.RelayUDPAddr
+		proxy.prepareForRelay(serverInfo.UDPAddr.IP, serverInfo.UDPAddr.Port, &encryptedQuery)
 	}
-	var err error
-	var pc net.Conn
 	proxyDialer := proxy.xTransport.proxyDialer
 	if proxyDialer == nil {
-		pc, err = net.DialUDP("udp", nil, upstreamAddr)
-	} else {
-		pc, err = (*proxyDialer).Dial("udp", upstreamAddr.String())
+		encryptedResponse, err := proxy.udpSocketPools.get(upstreamAddr).Exchange(encryptedQuery, clientNonce, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return proxy.Decrypt(serverInfo, sharedKey, encryptedResponse, clientNonce)
 	}
+	pc, err := (*proxyDialer).Dial("udp", upstreamAddr.String())
 	if err != nil {
 		return nil, err
 	}
 	defer pc.Close()
-	if err := pc.SetDeadline(time.Now().Add(serverInfo.Timeout)); err != nil {
+	if err := pc.SetDeadline(time.Now().Add(timeout)); err != nil {
 		return nil, err
 	}
-	if serverInfo.RelayUDPAddr != nil {
-		proxy.prepareForRelay(serverInfo.UDPAddr.IP, serverInfo.UDPAddr.Port, &encryptedQuery)
-	}
 	encryptedResponse := make([]byte, MaxDNSPacketSize)
 	for tries := 2; tries > 0; tries-- {
 		if _, err := pc.Write(encryptedQuery); err != nil {
@@ -436,7 +487,7 @@ func (proxy *Proxy) exchangeWithUDPServer(serverInfo *ServerInfo, sharedKey *[32
 	return proxy.Decrypt(serverInfo, sharedKey, encryptedResponse, clientNonce)
 }
 
-func (proxy *Proxy) exchangeWithTCPServer(serverInfo *ServerInfo, sharedKey *[32]byte, encryptedQuery []byte, clientNonce []byte) ([]byte, error) {
+func (proxy *Proxy) exchangeWithTCPServer(serverInfo *ServerInfo, sharedKey *[32]byte, encryptedQuery []byte, clientNonce []byte, timeout time.Duration) ([]byte, error) {
 	upstreamAddr := serverInfo.TCPAddr
 	if serverInfo.RelayUDPAddr != nil {
 		upstreamAddr = serverInfo.RelayTCPAddr
@@ -453,7 +504,7 @@ func (proxy *Proxy) exchangeWithTCPServer(serverInfo *ServerInfo, sharedKey *[32
 		return nil, err
 	}
 	defer pc.Close()
-	if err := pc.SetDeadline(time.Now().Add(serverInfo.Timeout)); err != nil {
+	if err := pc.SetDeadline(time.Now().Add(timeout)); err != nil {
 		return nil, err
 	}
 	if serverInfo.RelayTCPAddr != nil {
@@ -473,6 +524,174 @@ func (proxy *Proxy) exchangeWithTCPServer(serverInfo *ServerInfo, sharedKey *[32
 	return proxy.Decrypt(serverInfo, sharedKey, encryptedResponse, clientNonce)
 }
 
+// exchangeWithServer sends a query to a single server, and returns its response.
+// The timeout can only be shorter than the server's own timeout.
+// On error, the return code tells why the query failed.
+func (proxy *Proxy) exchangeWithServer(serverInfo *ServerInfo, query []byte, serverProto string, timeout time.Duration) ([]byte, PluginsReturnCode, error) {
+	var response []byte
+	var err error
+	if timeout <= 0 || timeout > serverInfo.Timeout {
+		timeout = serverInfo.Timeout
+	}
+	if serverInfo.Proto == stamps.StampProtoTypeDNSCrypt {
+		sharedKey, encryptedQuery, clientNonce, err := proxy.Encrypt(serverInfo, query, serverProto)
+		if err != nil && serverProto == "udp" {
+			dlog.Debug("Unable to pad for UDP, re-encrypting query for TCP")
+			serverProto = "tcp"
+			sharedKey, encryptedQuery, clientNonce, err = proxy.Encrypt(serverInfo, query, serverProto)
+		}
+		if err != nil {
+			return nil, PluginsReturnCodeParseError, err
+		}
+		serverInfo.noticeBegin(proxy)
+		if serverProto == "udp" {
+			response, err = proxy.exchangeWithUDPServer(serverInfo, sharedKey, encryptedQuery, clientNonce, timeout)
+			retryOverTCP := false
+			if err == nil && len(response) >= MinDNSPacketSize && response[2]&0x02 == 0x02 {
+				retryOverTCP = true
+			} else if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+				dlog.Debugf("[%v] Retry over TCP after UDP timeouts", serverInfo.Name)
+				retryOverTCP = true
+			}
+			if retryOverTCP {
+				serverProto = "tcp"
+				sharedKey, encryptedQuery, clientNonce, err = proxy.Encrypt(serverInfo, query, serverProto)
+				if err != nil {
+					return nil, PluginsReturnCodeParseError, err
+				}
+				response, err = proxy.exchangeWithTCPServer(serverInfo, sharedKey, encryptedQuery, clientNonce, timeout)
+			}
+		} else {
+			response, err = proxy.exchangeWithTCPServer(serverInfo, sharedKey, encryptedQuery, clientNonce, timeout)
+		}
+		if err != nil {
+			return nil, networkErrorReturnCode(err), err
+		}
+	} else if serverInfo.Proto == stamps.StampProtoTypeDoH {
+		tid := TransactionID(query)
+		SetTransactionID(query, 0)
+		serverInfo.noticeBegin(proxy)
+		response, _, _, err = serverInfo.httpTransport.DoHQuery(serverInfo.useGet, serverInfo.URL, query, timeout)
+		SetTransactionID(query, tid)
+		if err != nil {
+			return nil, networkErrorReturnCode(err), err
+		}
+		if len(response) >= MinDNSPacketSize {
+			SetTransactionID(response, tid)
+		}
+	} else if serverInfo.Proto == stamps.StampProtoTypeTLS {
+		serverInfo.noticeBegin(proxy)
+		response, err = serverInfo.dotTransport.Exchange(query, timeout)
+		if err != nil {
+			return nil, networkErrorReturnCode(err), err
+		}
+	} else if serverInfo.Proto == StampProtoTypeDoQ {
+		serverInfo.noticeBegin(proxy)
+		response, err = serverInfo.doqTransport.Exchange(query, timeout)
+		if err != nil {
+			return nil, networkErrorReturnCode(err), err
+		}
+	} else if serverInfo.Proto == StampProtoTypeODoHTarget {
+		tid := TransactionID(query)
+		SetTransactionID(query, 0)
+		serverInfo.noticeBegin(proxy)
+		queryURL := serverInfo.URL
+		if serverInfo.odohRelayURL != nil {
+			queryURL = serverInfo.odohRelayURL
+		}
+		response, _, _, err = serverInfo.httpTransport.ODoHQuery(&serverInfo.odohTargetConfigs[0], queryURL, query, timeout)
+		SetTransactionID(query, tid)
+		if err != nil {
+			return nil, networkErrorReturnCode(err), err
+		}
+		if len(response) >= MinDNSPacketSize {
+			SetTransactionID(response, tid)
+		}
+	} else {
+		dlog.Fatal("Unsupported protocol")
+	}
+	if len(response) < MinDNSPacketSize || len(response) > MaxDNSPacketSize {
+		return nil, PluginsReturnCodeParseError, errors.New("Invalid response size")
+	}
+	return response, PluginsReturnCodePass, nil
+}
+
+func networkErrorReturnCode(err error) PluginsReturnCode {
+	if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+		return PluginsReturnCodeServerTimeout
+	}
+	return PluginsReturnCodeNetworkError
+}
+
+// noticeResponse updates the statistics of a server after an exchange
+func (serverInfo *ServerInfo) noticeResponse(proxy *Proxy, response []byte, err error, dnssec bool) {
+	if err != nil {
+		serverInfo.noticeFailure(proxy)
+	} else if rcode := Rcode(response); rcode == dns.RcodeServerFailure { // SERVFAIL
+		if dnssec {
+			dlog.Debug("A response had an invalid DNSSEC signature")
+		} else {
+			dlog.Infof("Server [%v] returned temporary error code SERVFAIL -- Invalid DNSSEC signature received or server may be experiencing connectivity issues", serverInfo.Name)
+			serverInfo.noticeFailure(proxy)
+		}
+	} else {
+		serverInfo.noticeSuccess(proxy)
+	}
+}
+
+type raceResult struct {
+	serverInfo *ServerInfo
+	response   []byte
+	returnCode PluginsReturnCode
+	err        error
+}
+
+// exchangeWithServers sends a query to one or more servers, and returns the first valid response.
+// With more than one server, queries are sent at once, or staggered by the hedge delay of the
+// racing strategy. Every response, even a late one, updates the statistics of its server.
+func (proxy *Proxy) exchangeWithServers(serverInfos []*ServerInfo, query []byte, serverProto string, dnssec bool, timeout time.Duration) (*ServerInfo, []byte, PluginsReturnCode, error) {
+	if len(serverInfos) == 1 {
+		serverInfo := serverInfos[0]
+		response, returnCode, err := proxy.exchangeWithServer(serverInfo, query, serverProto, timeout)
+		serverInfo.noticeResponse(proxy, response, err, dnssec)
+		return serverInfo, response, returnCode, err
+	}
+	var hedgeDelay time.Duration
+	if strategy, ok := proxy.serversInfo.lbStrategy.(LBStrategyRace); ok {
+		hedgeDelay = strategy.hedgeDelay
+	}
+	results := make(chan raceResult, len(serverInfos))
+	done := make(chan struct{})
+	for i, serverInfo := range serverInfos {
+		go func(serverInfo *ServerInfo, delay time.Duration) {
+			if delay > 0 {
+				select {
+				case <-done:
+					results <- raceResult{serverInfo: serverInfo, returnCode: PluginsReturnCodeServerTimeout, err: errors.New("Not sent")}
+					return
+				case <-time.After(delay):
+				}
+			}
+			response, returnCode, err := proxy.exchangeWithServer(serverInfo, append([]byte{}, query...), serverProto, timeout)
+			serverInfo.noticeResponse(proxy, response, err, dnssec)
+			results <- raceResult{serverInfo: serverInfo, response: response, returnCode: returnCode, err: err}
+		}(serverInfo, time.Duration(i)*hedgeDelay)
+	}
+	defer close(done)
+	var fallback *raceResult
+	for range serverInfos {
+		result := <-results
+		if result.err == nil && Rcode(result.response) != dns.RcodeServerFailure {
+			dlog.Debugf("[%v] won the race", result.serverInfo.Name)
+			return result.serverInfo, result.response, result.returnCode, nil
+		}
+		if fallback == nil || (fallback.err != nil && result.err == nil) {
+			fallback = &result
+		}
+	}
+	return fallback.serverInfo, fallback.response, fallback.returnCode, fallback.err
+}
+
 func (proxy *Proxy) clientsCountInc() bool {
 	for {
 		count := atomic.LoadUint32(&proxy.clientsCount)
@@ -494,6 +713,162 @@ func (proxy *Proxy) clientsCountDec() {
 	}
 }
 
+// resolveQuery sends a query to upstream servers, tries other servers after a failure, and applies
+// the response plugins. A nil response is returned, after logging, if the query failed or was dropped.
+func (proxy *Proxy) resolveQuery(pluginsState *PluginsState, serverInfos []*ServerInfo, groupServerNames []string, query []byte, serverProto string, start time.Time) (*ServerInfo, []byte) {
+	serverInfo, response, returnCode, err := proxy.exchangeWithRetries(pluginsState, serverInfos, groupServerNames, query, serverProto, start)
+	return proxy.processUpstreamResponse(pluginsState, serverInfo, response, returnCode, err)
+}
+
+// exchangeWithRetries sends a query to upstream servers, and tries other servers after a failure.
+// If no server sent a usable response, the last SERVFAIL response received, if any, is returned.
+func (proxy *Proxy) exchangeWithRetries(pluginsState *PluginsState, serverInfos []*ServerInfo, groupServerNames []string, query []byte, serverProto string, start time.Time) (*ServerInfo, []byte, PluginsReturnCode, error) {
+	serverInfo, response, returnCode, err := proxy.exchangeWithServers(serverInfos, query, serverProto, pluginsState.dnssec, 0)
+	var servFailResponse []byte
+	var triedNames []string
+	for pluginsState.retries < proxy.upstreamRetries {
+		if err == nil {
+			if Rcode(response) != dns.RcodeServerFailure {
+				break
+			}
+			servFailResponse = response
+		}
+		timeout := proxy.clientDeadline - time.Since(start)
+		if timeout < MinRetryTimeout {
+			break
+		}
+		for _, triedServerInfo := range serverInfos {
+			triedNames = append(triedNames, triedServerInfo.Name)
+		}
+		if serverInfos = proxy.serversInfo.getServers(groupServerNames, triedNames); len(serverInfos) == 0 {
+			break
+		}
+		pluginsState.retries++
+		dlog.Debugf("Retrying [%s] after a failure of [%s]", pluginsState.qName, serverInfo.Name)
+		serverInfo, response, returnCode, err = proxy.exchangeWithServers(serverInfos, query, serverProto, pluginsState.dnssec, timeout)
+	}
+	if err != nil && servFailResponse != nil {
+		response, err = servFailResponse, nil
+	}
+	return serverInfo, response, returnCode, err
+}
+
+// processUpstreamResponse applies the response plugins to the response of an upstream server,
+// or serves a stale response if the exchange failed
+func (proxy *Proxy) processUpstreamResponse(pluginsState *PluginsState, serverInfo *ServerInfo, response []byte, returnCode PluginsReturnCode, err error) (*ServerInfo, []byte) {
+	var ttl *uint32
+	pluginsState.serverName = serverInfo.Name
+	if err != nil {
+		if stale, ok := pluginsState.sessionData["stale"]; ok {
+			dlog.Debug("Serving stale response")
+			response, err = (stale.(*dns.Msg)).Pack()
+		}
+	}
+	if err != nil {
+		pluginsState.returnCode = returnCode
+		pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+		return nil, nil
+	}
+	response, err = pluginsState.ApplyResponsePlugins(&proxy.pluginsGlobals, response, ttl)
+	if err != nil {
+		pluginsState.returnCode = PluginsReturnCodeParseError
+		pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+		serverInfo.noticeFailure(proxy)
+		return nil, nil
+	}
+	if pluginsState.action == PluginsActionDrop {
+		pluginsState.returnCode = PluginsReturnCodeDrop
+		pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+		return nil, nil
+	}
+	if pluginsState.synthResponse != nil {
+		response, err = pluginsState.synthResponse.PackBuffer(response)
+		if err != nil {
+			pluginsState.returnCode = PluginsReturnCodeParseError
+			pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+			return nil, nil
+		}
+	}
+	return serverInfo, response
+}
+
+// canServeStale tells whether the cached response of an expired query can be served if servers are slow
+func (proxy *Proxy) canServeStale(pluginsState *PluginsState) bool {
+	if _, ok := pluginsState.sessionData["stale"]; !ok || proxy.staleAnswerClientTimeout <= 0 || pluginsState.prefetch {
+		return false
+	}
+	return proxy.staleAnswerMaxAge <= 0 || time.Since(pluginsState.staleSince) <= proxy.staleAnswerMaxAge
+}
+
+// resolveQueryOrServeStale resolves a query for which a stale response is cached (RFC 8767).
+// If upstream servers don't respond within the stale answer client timeout, the stale response is
+// returned, while the query keeps running in order to update the cache.
+// The failure of a query whose response is no longer waited for is not logged.
+func (proxy *Proxy) resolveQueryOrServeStale(pluginsState *PluginsState, serverInfos []*ServerInfo, groupServerNames []string, query []byte, serverProto string, start time.Time) (*ServerInfo, []byte) {
+	type exchangeResult struct {
+		serverInfo *ServerInfo
+		response   []byte
+		returnCode PluginsReturnCode
+		err        error
+	}
+	backgroundState := *pluginsState
+	backgroundState.sessionData = make(map[string]interface{})
+	for key, value := range pluginsState.sessionData {
+		backgroundState.sessionData[key] = value
+	}
+	var lock sync.Mutex
+	abandoned := false
+	done := make(chan exchangeResult, 1)
+	go func() {
+		serverInfo, response, returnCode, err := proxy.exchangeWithRetries(&backgroundState, serverInfos, groupServerNames, query, serverProto, start)
+		lock.Lock()
+		defer lock.Unlock()
+		if !abandoned {
+			done <- exchangeResult{serverInfo: serverInfo, response: response, returnCode: returnCode, err: err}
+			return
+		}
+		if err != nil || Rcode(response) == dns.RcodeServerFailure {
+			dlog.Debugf("Unable to update the stale response for [%s]", backgroundState.qName)
+			return
+		}
+		if _, response = proxy.processUpstreamResponse(&backgroundState, serverInfo, response, returnCode, err); response != nil {
+			backgroundState.returnCode = PluginsReturnCodePostfetch
+			backgroundState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+		}
+	}()
+	timer := time.NewTimer(proxy.staleAnswerClientTimeout)
+	defer timer.Stop()
+	var result exchangeResult
+	select {
+	case result = <-done:
+	case <-timer.C:
+		lock.Lock()
+		select {
+		case result = <-done:
+		default:
+			abandoned = true
+		}
+		lock.Unlock()
+	}
+	if !abandoned {
+		*pluginsState = backgroundState
+		return proxy.processUpstreamResponse(pluginsState, result.serverInfo, result.response, result.returnCode, result.err)
+	}
+	dlog.Debugf("Serving a stale response for [%s]", pluginsState.qName)
+	stale := pluginsState.sessionData["stale"].(*dns.Msg).Copy()
+	updateTTL(stale, time.Now().Add(proxy.staleAnswerTTL))
+	response, err := stale.Pack()
+	if err != nil {
+		pluginsState.returnCode = PluginsReturnCodeParseError
+		pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+		return nil, nil
+	}
+	pluginsState.serverName = "-"
+	pluginsState.returnCode = PluginsReturnCodeStale
+	pluginsState.cachedTTL = proxy.staleAnswerTTL
+	return nil, response
+}
+
 func (proxy *Proxy) processIncomingQuery(clientProto string, serverProto string, query []byte, clientAddr *net.Addr, clientPc net.Conn, start time.Time) (response []byte) {
 	return proxy.processIncomingQueryEx(clientProto, serverProto, query, clientAddr, clientPc, start, false)
 }
@@ -504,13 +879,18 @@ func (proxy *Proxy) processIncomingQueryEx(clientProto string, serverProto strin
 	}
 	pluginsState := NewPluginsState(proxy, clientProto, clientAddr, serverProto, start)
 	pluginsState.forceRequest = forceRequest
-	serverName := "-"
+	var groupServerNames []string
+	if pluginsState.clientGroup = proxy.clientGroups.match(clientAddr, clientPc); pluginsState.clientGroup != nil {
+		groupServerNames = pluginsState.clientGroup.serverNames
+	}
 	needsEDNS0Padding := false
-	serverInfo := proxy.serversInfo.getOne()
-	if serverInfo != nil {
-		serverName = serverInfo.Name
-		needsEDNS0Padding = (serverInfo.Proto == stamps.StampProtoTypeDoH || serverInfo.Proto == stamps.StampProtoTypeTLS)
+	serverInfos := proxy.serversInfo.getServers(groupServerNames, nil)
+	for _, serverInfo := range serverInfos {
+		if serverInfo.Proto == stamps.StampProtoTypeDoH || serverInfo.Proto == stamps.StampProtoTypeTLS || serverInfo.Proto == StampProtoTypeDoQ || serverInfo.Proto == StampProtoTypeODoHTarget {
+			needsEDNS0Padding = true
+		}
 	}
+	var serverInfo *ServerInfo
 	query, _ = pluginsState.ApplyQueryPlugins(&proxy.pluginsGlobals, query, needsEDNS0Padding)
 	if len(query) < MinDNSPacketSize || len(query) > MaxDNSPacketSize {
 		return
@@ -529,123 +909,15 @@ func (proxy *Proxy) processIncomingQueryEx(clientProto string, serverProto strin
 			return
 		}
 	}
-	if len(response) == 0 && serverInfo != nil {
-		var ttl *uint32
-		pluginsState.serverName = serverName
-		if serverInfo.Proto == stamps.StampProtoTypeDNSCrypt {
-			sharedKey, encryptedQuery, clientNonce, err := proxy.Encrypt(serverInfo, query, serverProto)
-			if err != nil && serverProto == "udp" {
-				dlog.Debug("Unable to pad for UDP, re-encrypting query for TCP")
-				serverProto = "tcp"
-				sharedKey, encryptedQuery, clientNonce, err = proxy.Encrypt(serverInfo, query, serverProto)
-			}
-			if err != nil {
-				pluginsState.returnCode = PluginsReturnCodeParseError
-				pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
-				return
-			}
-			serverInfo.noticeBegin(proxy)
-			if serverProto == "udp" {
-				response, err = proxy.exchangeWithUDPServer(serverInfo, sharedKey, encryptedQuery, clientNonce)
-				retryOverTCP := false
-				if err == nil && len(response) >= MinDNSPacketSize && response[2]&0x02 == 0x02 {
-					retryOverTCP = true
-				} else if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-					dlog.Debugf("[%v] Retry over TCP after UDP timeouts", serverName)
-					retryOverTCP = true
-				}
-				if retryOverTCP {
-					serverProto = "tcp"
-					sharedKey, encryptedQuery, clientNonce, err = proxy.Encrypt(serverInfo, query, serverProto)
-					if err != nil {
-						pluginsState.returnCode = PluginsReturnCodeParseError
-						pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
-						return
-					}
-					response, err = proxy.exchangeWithTCPServer(serverInfo, sharedKey, encryptedQuery, clientNonce)
-				}
-			} else {
-				response, err = proxy.exchangeWithTCPServer(serverInfo, sharedKey, encryptedQuery, clientNonce)
-			}
-			if err != nil {
-				if stale, ok := pluginsState.sessionData["stale"]; ok {
-					dlog.Debug("Serving stale response")
-					response, err = (stale.(*dns.Msg)).Pack()
-				}
-			}
-			if err != nil {
-				if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-					pluginsState.returnCode = PluginsReturnCodeServerTimeout
-				} else {
-					pluginsState.returnCode = PluginsReturnCodeNetworkError
-				}
-				pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
-				serverInfo.noticeFailure(proxy)
-				return
-			}
-		} else if serverInfo.Proto == stamps.StampProtoTypeDoH {
-			tid := TransactionID(query)
-			SetTransactionID(query, 0)
-			serverInfo.noticeBegin(proxy)
-			serverResponse, tls, _, err := proxy.xTransport.DoHQuery(serverInfo.useGet, serverInfo.URL, query, proxy.timeout)
-			SetTransactionID(query, tid)
-			if err == nil || tls == nil || !tls.HandshakeComplete {
-				response = nil
-			} else if stale, ok := pluginsState.sessionData["stale"]; ok {
-				dlog.Debug("Serving stale response")
-				response, err = (stale.(*dns.Msg)).Pack()
-			}
-			if err != nil {
-				pluginsState.returnCode = PluginsReturnCodeNetworkError
-				pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
-				serverInfo.noticeFailure(proxy)
-				return
-			}
-			if response == nil {
-				response = serverResponse
-			}
-			if len(response) >= MinDNSPacketSize {
-				SetTransactionID(response, tid)
-			}
+	if len(response) == 0 && len(serverInfos) > 0 {
+		if proxy.canServeStale(&pluginsState) && !forceRequest {
+			serverInfo, response = proxy.resolveQueryOrServeStale(&pluginsState, serverInfos, groupServerNames, query, serverProto, start)
 		} else {
-			dlog.Fatal("Unsupported protocol")
+			serverInfo, response = proxy.resolveQueryCoalesced(&pluginsState, serverInfos, groupServerNames, query, serverProto, start)
 		}
-		if len(response) < MinDNSPacketSize || len(response) > MaxDNSPacketSize {
-			pluginsState.returnCode = PluginsReturnCodeParseError
-			pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
-			serverInfo.noticeFailure(proxy)
-			return
-		}
-		response, err = pluginsState.ApplyResponsePlugins(&proxy.pluginsGlobals, response, ttl)
-		if err != nil {
-			pluginsState.returnCode = PluginsReturnCodeParseError
-			pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
-			serverInfo.noticeFailure(proxy)
-			return
-		}
-		if pluginsState.action == PluginsActionDrop {
-			pluginsState.returnCode = PluginsReturnCodeDrop
-			pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+		if response == nil {
 			return
 		}
-		if pluginsState.synthResponse != nil {
-			response, err = pluginsState.synthResponse.PackBuffer(response)
-			if err != nil {
-				pluginsState.returnCode = PluginsReturnCodeParseError
-				pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
-				return
-			}
-		}
-		if rcode := Rcode(response); rcode == dns.RcodeServerFailure { // SERVFAIL
-			if pluginsState.dnssec {
-				dlog.Debug("A response had an invalid DNSSEC signature")
-			} else {
-				dlog.Infof("Server [%v] returned temporary error code SERVFAIL -- Invalid DNSSEC signature received or server may be experiencing connectivity issues", serverInfo.Name)
-				serverInfo.noticeFailure(proxy)
-			}
-		} else {
-			serverInfo.noticeSuccess(proxy)
-		}
 	}
 	if len(response) < MinDNSPacketSize || len(response) > MaxDNSPacketSize {
 		pluginsState.returnCode = PluginsReturnCodeParseError
@@ -699,17 +971,21 @@ func (proxy *Proxy) processIncomingQueryEx(clientProto string, serverProto strin
 
 		qHash := computeCacheKey(&pluginsState, &msg)
 
-		cachedResponses.Lock()
-		defer cachedResponses.Unlock()
+		shard := cachedResponses.shard(qHash)
+		if shard == nil {
+			return response
+		}
+		shard.Lock()
+		defer shard.Unlock()
 
-		if cachedResponses.fetchLock[qHash] != true {
-			cachedResponses.fetchLock[qHash] = true
-			cachedResponses.Unlock()
+		if shard.fetchLock[qHash] != true {
+			shard.fetchLock[qHash] = true
+			shard.Unlock()
 
 			proxy.processIncomingQueryEx(clientProto, serverProto, query, clientAddr, clientPc, start, true)
 
-			cachedResponses.Lock()
-			cachedResponses.fetchLock[qHash] = false
+			shard.Lock()
+			shard.fetchLock[qHash] = false
 		}
 	}
 
@@ -718,6 +994,7 @@ func (proxy *Proxy) processIncomingQueryEx(clientProto string, serverProto strin
 
 func NewProxy() *Proxy {
 	return &Proxy{
-		serversInfo: NewServersInfo(),
+		serversInfo:    NewServersInfo(),
+		udpSocketPools: NewUDPSocketPools(),
 	}
 }
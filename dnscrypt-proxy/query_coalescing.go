@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// An InflightQuery is a query being resolved by upstream servers. Identical queries received
+// in the meantime wait for its response instead of being sent upstream again.
+
+type InflightQuery struct {
+	done       chan struct{}
+	serverInfo *ServerInfo
+	response   []byte
+	returnCode PluginsReturnCode
+	err        error
+}
+
+type InflightQueries struct {
+	sync.Mutex
+	queries map[[32]byte]*InflightQuery
+}
+
+// join returns the in-flight query with the same key, or registers a new one.
+// The caller that registered the query leads it, and must call finish once it has been resolved.
+func (inflightQueries *InflightQueries) join(cacheKey [32]byte) (*InflightQuery, bool) {
+	inflightQueries.Lock()
+	defer inflightQueries.Unlock()
+	if inflight, ok := inflightQueries.queries[cacheKey]; ok {
+		return inflight, false
+	}
+	inflight := &InflightQuery{done: make(chan struct{})}
+	if inflightQueries.queries == nil {
+		inflightQueries.queries = make(map[[32]byte]*InflightQuery)
+	}
+	inflightQueries.queries[cacheKey] = inflight
+	return inflight, true
+}
+
+// finish records the upstream response to a leading query, and wakes up the followers
+func (inflightQueries *InflightQueries) finish(cacheKey [32]byte, inflight *InflightQuery, serverInfo *ServerInfo, response []byte, returnCode PluginsReturnCode, err error) {
+	inflight.serverInfo, inflight.returnCode, inflight.err = serverInfo, returnCode, err
+	if response != nil {
+		inflight.response = append([]byte{}, response...)
+	}
+	inflightQueries.Lock()
+	delete(inflightQueries.queries, cacheKey)
+	inflightQueries.Unlock()
+	close(inflight.done)
+}
+
+// responseFor waits for the upstream response, and returns a copy with the transaction ID
+// and question of a follower
+func (inflight *InflightQuery) responseFor(questionMsg *dns.Msg) ([]byte, error) {
+	<-inflight.done
+	if inflight.response == nil {
+		return nil, nil
+	}
+	msg := dns.Msg{Compress: true}
+	if err := msg.Unpack(inflight.response); err != nil {
+		return nil, err
+	}
+	msg.Id = questionMsg.Id
+	msg.Question = questionMsg.Question
+	return msg.Pack()
+}
+
+// resolveQueryCoalesced resolves a query, unless an identical one is already in flight.
+// Followers get the upstream response to the leading query, with their own transaction ID and question,
+// and apply the response plugins using their own state.
+func (proxy *Proxy) resolveQueryCoalesced(pluginsState *PluginsState, serverInfos []*ServerInfo, groupServerNames []string, query []byte, serverProto string, start time.Time) (*ServerInfo, []byte) {
+	questionMsg := pluginsState.questionMsg
+	if questionMsg == nil || len(questionMsg.Question) != 1 {
+		return proxy.resolveQuery(pluginsState, serverInfos, groupServerNames, query, serverProto, start)
+	}
+	cacheKey := computeCacheKey(pluginsState, questionMsg)
+	inflight, leader := proxy.inflightQueries.join(cacheKey)
+	if !leader {
+		response, err := inflight.responseFor(questionMsg)
+		if err != nil {
+			pluginsState.serverName = inflight.serverInfo.Name
+			pluginsState.returnCode = PluginsReturnCodeParseError
+			pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+			return nil, nil
+		}
+		serverInfo, response := proxy.processUpstreamResponse(pluginsState, inflight.serverInfo, response, inflight.returnCode, inflight.err)
+		if response != nil && pluginsState.returnCode == PluginsReturnCodePass {
+			pluginsState.returnCode = PluginsReturnCodeCoalesced
+		}
+		return serverInfo, response
+	}
+	serverInfo, response, returnCode, err := proxy.exchangeWithRetries(pluginsState, serverInfos, groupServerNames, query, serverProto, start)
+	proxy.inflightQueries.finish(cacheKey, inflight, serverInfo, response, returnCode, err)
+	return proxy.processUpstreamResponse(pluginsState, serverInfo, response, returnCode, err)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/powerman/check"
+)
+
+func TestInflightQueries(t *testing.T) {
+	c := check.T(t)
+	var inflightQueries InflightQueries
+	key, otherKey := [32]byte{1}, [32]byte{2}
+
+	inflight, leader := inflightQueries.join(key)
+	c.True(leader)
+	other, leader := inflightQueries.join(otherKey)
+	c.True(leader, "Different queries must not be coalesced")
+	c.NotEqual(other, inflight)
+
+	questionMsg := dns.Msg{}
+	questionMsg.SetQuestion("example.com.", dns.TypeA)
+	reply := dns.Msg{}
+	reply.SetReply(&questionMsg)
+	reply.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: []byte{192, 0, 2, 1}}}
+	response, err := reply.Pack()
+	c.Must(c.Nil(err))
+
+	const followersCount = 10
+	var wg sync.WaitGroup
+	responses := make([]*dns.Msg, followersCount)
+	followerMsgs := make([]*dns.Msg, followersCount)
+	for i := 0; i < followersCount; i++ {
+		follower, leader := inflightQueries.join(key)
+		c.False(leader)
+		c.Equal(follower, inflight)
+		followerMsg := dns.Msg{}
+		followerMsg.SetQuestion("EXAMPLE.com.", dns.TypeA)
+		followerMsgs[i] = &followerMsg
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			response, err := follower.responseFor(followerMsgs[i])
+			if err != nil {
+				return
+			}
+			msg := dns.Msg{}
+			if msg.Unpack(response) == nil {
+				responses[i] = &msg
+			}
+		}(i)
+	}
+
+	serverInfo := &ServerInfo{Name: "server"}
+	inflightQueries.finish(key, inflight, serverInfo, response, PluginsReturnCodePass, nil)
+	response[0] ^= 0xff // the leader can reuse its buffer
+	wg.Wait()
+	for i, msg := range responses {
+		c.Must(c.NotNil(msg))
+		c.Equal(msg.Id, followerMsgs[i].Id)
+		c.DeepEqual(msg.Question, followerMsgs[i].Question)
+		c.Len(msg.Answer, 1)
+	}
+	c.Equal(inflight.serverInfo, serverInfo)
+
+	// Once resolved, an identical query is sent upstream again
+	next, leader := inflightQueries.join(key)
+	c.True(leader)
+	c.NotEqual(next, inflight)
+
+	upstreamErr := errors.New("upstream failure")
+	inflightQueries.finish(otherKey, other, serverInfo, nil, PluginsReturnCodeServerTimeout, upstreamErr)
+	response, err = other.responseFor(&questionMsg)
+	c.Nil(err)
+	c.Nil(response)
+	c.Equal(other.returnCode, PluginsReturnCode(PluginsReturnCodeServerTimeout))
+	c.Err(other.err, upstreamErr)
+
+	inflightQueries.finish(key, next, serverInfo, []byte{0, 1, 2}, PluginsReturnCodePass, nil)
+	_, err = next.responseFor(&questionMsg)
+	c.NotNil(err, "Invalid responses must not be sent to followers")
+	c.Len(inflightQueries.queries, 0)
+}
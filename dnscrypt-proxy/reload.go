@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	clocksmith "github.com/jedisct1/go-clocksmith"
+)
+
+const (
+	RulesWatchInterval = 10 * time.Second
+)
+
+type watchedFile struct {
+	modTime time.Time
+	size    int64
+}
+
+func (proxy *Proxy) rulesFiles() []string {
+	var fileNames []string
+	for _, fileName := range []string{proxy.blockNameFile, proxy.whitelistNameFile, proxy.blockIPFile, proxy.cloakFile, proxy.forwardFile, proxy.cacheTTLRulesFile} {
+		if len(fileName) > 0 {
+			fileNames = append(fileNames, fileName)
+		}
+	}
+	for _, group := range proxy.clientGroups.list() {
+		for _, fileName := range []*string{group.blockNameFile, group.whitelistNameFile, group.cloakFile} {
+			if fileName != nil && len(*fileName) > 0 {
+				fileNames = append(fileNames, *fileName)
+			}
+		}
+	}
+	return fileNames
+}
+
+func (proxy *Proxy) reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			dlog.Notice("SIGHUP received, reloading rules")
+			proxy.ReloadPlugins()
+		}
+	}()
+}
+
+func statWatchedFile(fileName string) watchedFile {
+	fileInfo, err := os.Stat(fileName)
+	if err != nil {
+		return watchedFile{}
+	}
+	return watchedFile{modTime: fileInfo.ModTime(), size: fileInfo.Size()}
+}
+
+func (proxy *Proxy) watchRulesFiles() {
+	fileNames := proxy.rulesFiles()
+	if len(fileNames) == 0 {
+		return
+	}
+	watched := make(map[string]watchedFile)
+	for _, fileName := range fileNames {
+		watched[fileName] = statWatchedFile(fileName)
+	}
+	go func() {
+		for {
+			clocksmith.Sleep(RulesWatchInterval)
+			changed := false
+			for _, fileName := range fileNames {
+				current := statWatchedFile(fileName)
+				if current != watched[fileName] {
+					dlog.Noticef("[%s] has changed", fileName)
+					watched[fileName] = current
+					changed = true
+				}
+			}
+			if changed {
+				proxy.ReloadPlugins()
+			}
+		}
+	}()
+}
@@ -3,6 +3,7 @@
 import (
 	crypto_rand "crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -36,9 +37,11 @@ type ServerBugs struct {
 }
 
 type DOHClientCreds struct {
-	clientCert string
-	clientKey  string
-	rootCA     string
+	clientCert  string
+	clientKey   string
+	rootCA      string
+	serverName  string
+	cipherSuite []uint16
 }
 
 type ServerInfo struct {
@@ -61,6 +64,11 @@ type ServerInfo struct {
 	initialRtt         int
 	useGet             bool
 	DOHClientCreds     DOHClientCreds
+	httpTransport      *HTTPTransport
+	dotTransport       *DoTTransport
+	doqTransport       *DoQTransport
+	odohTargetConfigs  []ODoHTargetConfig
+	odohRelayURL       *url.URL
 }
 
 type LBStrategy interface {
@@ -97,6 +105,22 @@ func (LBStrategyRandom) getCandidate(serversCount int) int {
 	return rand.Intn(serversCount)
 }
 
+// LBStrategyRace sends queries to the fastest servers, and uses the first response
+type LBStrategyRace struct {
+	count      int
+	hedgeDelay time.Duration
+}
+
+func (LBStrategyRace) getCandidate(int) int {
+	return 0
+}
+
+const (
+	DefaultLBRaceCount = 2
+	// One query out of LBRaceExploreInterval also races a random slower server, so that its RTT gets updated
+	LBRaceExploreInterval = 10
+)
+
 var DefaultLBStrategy = LBStrategyP2{}
 
 type ServersInfo struct {
@@ -165,6 +189,13 @@ func (serversInfo *ServersInfo) refresh(proxy *Proxy) (int, error) {
 	serversInfo.RLock()
 	registeredServers := serversInfo.registeredServers
 	serversInfo.RUnlock()
+	if proxy.xTransport.encryptedBootstrap != nil {
+		// Servers that can be reached without resolving a name come first, so that they can resolve the other names
+		registeredServers = append([]RegisteredServer{}, registeredServers...)
+		sort.SliceStable(registeredServers, func(i, j int) bool {
+			return isBootstrapStamp(registeredServers[i].stamp) && !isBootstrapStamp(registeredServers[j].stamp)
+		})
+	}
 	liveServers := 0
 	var err error
 	for _, registeredServer := range registeredServers {
@@ -224,90 +255,190 @@ func (serversInfo *ServersInfo) estimatorUpdate() {
 	}
 }
 
-func (serversInfo *ServersInfo) getOne() *ServerInfo {
+// candidates returns the servers listed in serverNames, or all of them if it is empty,
+// except those listed in excludedNames. serversInfo.RWMutex is assumed to be Locked.
+func (serversInfo *ServersInfo) candidates(serverNames []string, excludedNames []string) []*ServerInfo {
+	if len(serverNames) == 0 && len(excludedNames) == 0 {
+		return serversInfo.inner
+	}
+	candidates := make([]*ServerInfo, 0, len(serversInfo.inner))
+	for _, serverInfo := range serversInfo.inner {
+		if len(serverNames) > 0 && !includesName(serverNames, serverInfo.Name) {
+			continue
+		}
+		if includesName(excludedNames, serverInfo.Name) {
+			continue
+		}
+		candidates = append(candidates, serverInfo)
+	}
+	return candidates
+}
+
+// getOne picks a server using the load-balancing strategy.
+// If serverNames is not empty, only the servers it lists are considered.
+// Servers listed in excludedNames are never picked.
+func (serversInfo *ServersInfo) getOne(serverNames []string, excludedNames []string) *ServerInfo {
 	serversInfo.Lock()
-	serversCount := len(serversInfo.inner)
-	if serversCount <= 0 {
+	if len(serversInfo.inner) <= 0 {
 		serversInfo.Unlock()
 		return nil
 	}
 	if serversInfo.lbEstimator {
 		serversInfo.estimatorUpdate()
 	}
+	candidates := serversInfo.candidates(serverNames, excludedNames)
+	serversCount := len(candidates)
+	if serversCount <= 0 {
+		serversInfo.Unlock()
+		return nil
+	}
 	candidate := serversInfo.lbStrategy.getCandidate(serversCount)
-	serverInfo := serversInfo.inner[candidate]
+	serverInfo := candidates[candidate]
 	dlog.Debugf("Using candidate [%s] RTT: %d", (*serverInfo).Name, int((*serverInfo).rtt.Value()))
 	serversInfo.Unlock()
 
 	return serverInfo
 }
 
+// getServers returns the servers a query should be sent to: a single one,
+// or the fastest ones, ordered by RTT, when using the racing strategy.
+// Like p2, the racing strategy occasionally tries a slower server.
+func (serversInfo *ServersInfo) getServers(serverNames []string, excludedNames []string) []*ServerInfo {
+	strategy, race := serversInfo.lbStrategy.(LBStrategyRace)
+	if !race {
+		if serverInfo := serversInfo.getOne(serverNames, excludedNames); serverInfo != nil {
+			return []*ServerInfo{serverInfo}
+		}
+		return nil
+	}
+	serversInfo.Lock()
+	if serversInfo.lbEstimator && len(serversInfo.inner) > 0 {
+		serversInfo.estimatorUpdate()
+	}
+	candidates := append([]*ServerInfo{}, serversInfo.candidates(serverNames, excludedNames)...)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].rtt.Value() < candidates[j].rtt.Value()
+	})
+	serversInfo.Unlock()
+	if len(candidates) > strategy.count {
+		if rand.Intn(LBRaceExploreInterval) == 0 {
+			explore := strategy.count + rand.Intn(len(candidates)-strategy.count)
+			dlog.Debugf("Racing [%s] instead of [%s]", candidates[explore].Name, candidates[strategy.count-1].Name)
+			candidates[strategy.count-1] = candidates[explore]
+		}
+		candidates = candidates[:strategy.count]
+	}
+	return candidates
+}
+
+// getByName returns a live server, using its name
+func (serversInfo *ServersInfo) getByName(name string) *ServerInfo {
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+	for _, serverInfo := range serversInfo.inner {
+		if serverInfo.Name == name {
+			return serverInfo
+		}
+	}
+	return nil
+}
+
 func fetchServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isNew bool) (ServerInfo, error) {
 	if stamp.Proto == stamps.StampProtoTypeDNSCrypt {
 		return fetchDNSCryptServerInfo(proxy, name, stamp, isNew)
 	} else if stamp.Proto == stamps.StampProtoTypeDoH {
 		return fetchDoHServerInfo(proxy, name, stamp, isNew)
+	} else if stamp.Proto == stamps.StampProtoTypeTLS {
+		return fetchDoTServerInfo(proxy, name, stamp, isNew)
+	} else if stamp.Proto == StampProtoTypeDoQ {
+		return fetchDoQServerInfo(proxy, name, stamp, isNew)
+	} else if stamp.Proto == StampProtoTypeODoHTarget {
+		return fetchODoHTargetInfo(proxy, name, stamp, isNew)
 	}
 	return ServerInfo{}, errors.New("Unsupported protocol")
 }
 
-func route(proxy *Proxy, name string) (*net.UDPAddr, *net.TCPAddr, error) {
+func lookupRelayStamp(proxy *Proxy, relayName string) *stamps.ServerStamp {
+	if relayStamp, err := ParseServerStamp(relayName); err == nil {
+		return &relayStamp
+	} else if _, err := net.ResolveUDPAddr("udp", relayName); err == nil {
+		return &stamps.ServerStamp{
+			ServerAddrStr: relayName,
+			Proto:         stamps.StampProtoTypeDNSCryptRelay,
+		}
+	}
+	var relayCandidateStamp *stamps.ServerStamp
+	for _, registeredServer := range proxy.registeredRelays {
+		if registeredServer.name == relayName {
+			relayCandidateStamp = &registeredServer.stamp
+			break
+		}
+	}
+	for _, registeredServer := range proxy.registeredServers {
+		if registeredServer.name == relayName {
+			relayCandidateStamp = &registeredServer.stamp
+			break
+		}
+	}
+	return relayCandidateStamp
+}
+
+// routeStamp picks a random relay among the ones declared for a server, and compatible with the given protocols
+func routeStamp(proxy *Proxy, name string, protos ...stamps.StampProtoType) (*stamps.ServerStamp, error) {
 	routes := proxy.routes
 	if routes == nil {
-		return nil, nil, nil
+		return nil, nil
 	}
 	relayNames, ok := (*routes)[name]
 	if !ok {
 		relayNames, ok = (*routes)["*"]
 	}
 	if !ok {
-		return nil, nil, nil
+		return nil, nil
 	}
-	var relayName string
-	if len(relayNames) > 0 {
-		candidate := rand.Intn(len(relayNames))
-		relayName = relayNames[candidate]
+	if len(relayNames) == 0 {
+		return nil, fmt.Errorf("Route declared for [%v] but an empty relay list", name)
 	}
-	var relayCandidateStamp *stamps.ServerStamp
-	if len(relayName) == 0 {
-		return nil, nil, fmt.Errorf("Route declared for [%v] but an empty relay list", name)
-	} else if relayStamp, err := stamps.NewServerStampFromString(relayName); err == nil {
-		relayCandidateStamp = &relayStamp
-	} else if _, err := net.ResolveUDPAddr("udp", relayName); err == nil {
-		relayCandidateStamp = &stamps.ServerStamp{
-			ServerAddrStr: relayName,
-			Proto:         stamps.StampProtoTypeDNSCryptRelay,
+	var relayCandidateStamps []*stamps.ServerStamp
+	for _, relayName := range relayNames {
+		relayCandidateStamp := lookupRelayStamp(proxy, relayName)
+		if relayCandidateStamp == nil {
+			dlog.Warnf("Undefined relay [%v] for server [%v]", relayName, name)
+			continue
 		}
-	} else {
-		for _, registeredServer := range proxy.registeredRelays {
-			if registeredServer.name == relayName {
-				relayCandidateStamp = &registeredServer.stamp
+		compatible := false
+		for _, proto := range protos {
+			if relayCandidateStamp.Proto == proto {
+				compatible = true
 				break
 			}
 		}
-		for _, registeredServer := range proxy.registeredServers {
-			if registeredServer.name == relayName {
-				relayCandidateStamp = &registeredServer.stamp
-				break
-			}
+		if !compatible {
+			dlog.Debugf("Relay [%v] cannot be used for server [%v]", relayName, name)
+			continue
 		}
+		relayCandidateStamps = append(relayCandidateStamps, relayCandidateStamp)
 	}
-	if relayCandidateStamp == nil {
-		return nil, nil, fmt.Errorf("Undefined relay [%v] for server [%v]", relayName, name)
+	if len(relayCandidateStamps) == 0 {
+		return nil, fmt.Errorf("No usable relay among %v for server [%v]", relayNames, name)
 	}
-	if relayCandidateStamp.Proto == stamps.StampProtoTypeDNSCrypt ||
-		relayCandidateStamp.Proto == stamps.StampProtoTypeDNSCryptRelay {
-		relayUDPAddr, err := net.ResolveUDPAddr("udp", relayCandidateStamp.ServerAddrStr)
-		if err != nil {
-			return nil, nil, err
-		}
-		relayTCPAddr, err := net.ResolveTCPAddr("tcp", relayCandidateStamp.ServerAddrStr)
-		if err != nil {
-			return nil, nil, err
-		}
-		return relayUDPAddr, relayTCPAddr, nil
+	return relayCandidateStamps[rand.Intn(len(relayCandidateStamps))], nil
+}
+
+func route(proxy *Proxy, name string) (*net.UDPAddr, *net.TCPAddr, error) {
+	relayCandidateStamp, err := routeStamp(proxy, name, stamps.StampProtoTypeDNSCrypt, stamps.StampProtoTypeDNSCryptRelay)
+	if err != nil || relayCandidateStamp == nil {
+		return nil, nil, err
 	}
-	return nil, nil, fmt.Errorf("Invalid relay [%v] for server [%v]", relayName, name)
+	relayUDPAddr, err := net.ResolveUDPAddr("udp", relayCandidateStamp.ServerAddrStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	relayTCPAddr, err := net.ResolveTCPAddr("tcp", relayCandidateStamp.ServerAddrStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return relayUDPAddr, relayTCPAddr, nil
 }
 
 func fetchDNSCryptServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isNew bool) (ServerInfo, error) {
@@ -363,6 +494,7 @@ func fetchDNSCryptServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp
 		CryptoConstruction: certInfo.CryptoConstruction,
 		Name:               name,
 		Timeout:            proxy.timeout,
+		HostName:           stamp.ProviderName,
 		UDPAddr:            remoteUDPAddr,
 		TCPAddr:            remoteTCPAddr,
 		RelayUDPAddr:       relayUDPAddr,
@@ -434,21 +566,23 @@ func fetchDoHServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isN
 	if !ok {
 		dohClientCreds, ok = (*proxy.dohCreds)["*"]
 	}
-	if ok {
+	if ok && len(dohClientCreds.clientCert) > 0 {
 		dlog.Noticef("Enabling TLS authentication for [%s]", name)
-		proxy.xTransport.tlsClientCreds = dohClientCreds
-		proxy.xTransport.rebuildTransport()
+	}
+	httpTransport := proxy.xTransport.serverTransport(name, dohClientCreds)
+	if includesName(proxy.xTransport.http3ServerNames, name) {
+		proxy.xTransport.enableHTTP3(url.Host)
 	}
 	useGet := false
-	if _, _, _, err := proxy.xTransport.DoHQuery(useGet, url, body, proxy.timeout); err != nil {
+	if _, _, _, err := httpTransport.DoHQuery(useGet, url, body, proxy.timeout); err != nil {
 		useGet = true
-		if _, _, _, err := proxy.xTransport.DoHQuery(useGet, url, body, proxy.timeout); err != nil {
+		if _, _, _, err := httpTransport.DoHQuery(useGet, url, body, proxy.timeout); err != nil {
 			return ServerInfo{}, err
 		}
 		dlog.Debugf("Server [%s] doesn't appear to support POST; falling back to GET requests", name)
 	}
 	body = dohNXTestPacket(0xcafe)
-	serverResponse, tls, rtt, err := proxy.xTransport.DoHQuery(useGet, url, body, proxy.timeout)
+	serverResponse, tls, rtt, err := httpTransport.DoHQuery(useGet, url, body, proxy.timeout)
 	if err != nil {
 		dlog.Infof("[%s] [%s]: %v", name, url, err)
 		return ServerInfo{}, err
@@ -464,23 +598,50 @@ func fetchDoHServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isN
 	if msg.Rcode != dns.RcodeNameError {
 		dlog.Criticalf("[%s] may be a lying resolver", name)
 	}
-	protocol := tls.NegotiatedProtocol
-	if len(protocol) == 0 {
+	protocol := proxy.xTransport.negotiatedProtocol(url.Host)
+	if protocol == "http/1.1" {
 		protocol = "h1"
 		dlog.Warnf("[%s] does not support HTTP/2", name)
 	}
 	dlog.Infof("[%s] TLS version: %x - Protocol: %v - Cipher suite: %v", name, tls.Version, protocol, tls.CipherSuite)
-	showCerts := proxy.showCerts
+	if err := checkCertHashes(name, stamp.Hashes, tls, proxy.showCerts); err != nil {
+		return ServerInfo{}, err
+	}
+	respBody := serverResponse
+	if len(respBody) < MinDNSPacketSize || len(respBody) > MaxDNSPacketSize ||
+		respBody[0] != 0xca || respBody[1] != 0xfe || respBody[4] != 0x00 || respBody[5] != 0x01 {
+		dlog.Info("Webserver returned an unexpected response")
+		return ServerInfo{}, errors.New("Webserver returned an unexpected response")
+	}
+	xrtt := int(rtt.Nanoseconds() / 1000000)
+	if isNew {
+		dlog.Noticef("[%s] OK (DoH) - rtt: %dms", name, xrtt)
+	} else {
+		dlog.Infof("[%s] OK (DoH) - rtt: %dms", name, xrtt)
+	}
+	return ServerInfo{
+		Proto:         stamps.StampProtoTypeDoH,
+		Name:          name,
+		Timeout:       proxy.timeout,
+		URL:           url,
+		HostName:      stamp.ProviderName,
+		initialRtt:    xrtt,
+		useGet:        useGet,
+		httpTransport: httpTransport,
+	}, nil
+}
+
+func checkCertHashes(name string, hashes [][]uint8, tlsState *tls.ConnectionState, showCerts bool) error {
 	found := false
 	var wantedHash [32]byte
-	for _, cert := range tls.PeerCertificates {
+	for _, cert := range tlsState.PeerCertificates {
 		h := sha256.Sum256(cert.RawTBSCertificate)
 		if showCerts {
 			dlog.Noticef("Advertised cert: [%s] [%x]", cert.Subject, h)
 		} else {
 			dlog.Debugf("Advertised cert: [%s] [%x]", cert.Subject, h)
 		}
-		for _, hash := range stamp.Hashes {
+		for _, hash := range hashes {
 			if len(hash) == len(wantedHash) {
 				copy(wantedHash[:], hash)
 				if h == wantedHash {
@@ -493,34 +654,190 @@ func fetchDoHServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isN
 			break
 		}
 	}
-	if !found && len(stamp.Hashes) > 0 {
+	if !found && len(hashes) > 0 {
 		dlog.Criticalf("[%s] Certificate hash [%x] not found", name, wantedHash)
-		return ServerInfo{}, fmt.Errorf("Certificate hash not found")
+		return fmt.Errorf("Certificate hash not found")
 	}
-	respBody := serverResponse
-	if len(respBody) < MinDNSPacketSize || len(respBody) > MaxDNSPacketSize ||
-		respBody[0] != 0xca || respBody[1] != 0xfe || respBody[4] != 0x00 || respBody[5] != 0x01 {
-		dlog.Info("Webserver returned an unexpected response")
-		return ServerInfo{}, errors.New("Webserver returned an unexpected response")
+	return nil
+}
+
+func fetchDoTServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isNew bool) (ServerInfo, error) {
+	dotTransport := NewDoTTransport(proxy, name, stamp.ProviderName, stamp.ServerAddrStr, stamp.Hashes)
+	tls, err := dotTransport.Probe(proxy.showCerts)
+	if err != nil {
+		dlog.Infof("[%s] [%s]: %v", name, stamp.ProviderName, err)
+		return ServerInfo{}, err
+	}
+	dlog.Infof("[%s] TLS version: %x - Cipher suite: %v", name, tls.Version, tls.CipherSuite)
+	if _, err := dotTransport.Exchange(dohTestPacket(0xcafe), proxy.timeout); err != nil {
+		return ServerInfo{}, err
+	}
+	start := time.Now()
+	serverResponse, err := dotTransport.Exchange(dohNXTestPacket(0xcafe), proxy.timeout)
+	rtt := time.Since(start)
+	if err != nil {
+		dlog.Infof("[%s] [%s]: %v", name, stamp.ProviderName, err)
+		return ServerInfo{}, err
+	}
+	msg := dns.Msg{}
+	if err := msg.Unpack(serverResponse); err != nil {
+		dlog.Warnf("[%s]: %v", name, err)
+		return ServerInfo{}, err
+	}
+	if msg.Rcode != dns.RcodeNameError {
+		dlog.Criticalf("[%s] may be a lying resolver", name)
 	}
 	xrtt := int(rtt.Nanoseconds() / 1000000)
 	if isNew {
-		dlog.Noticef("[%s] OK (DoH) - rtt: %dms", name, xrtt)
+		dlog.Noticef("[%s] OK (DoT) - rtt: %dms", name, xrtt)
 	} else {
-		dlog.Infof("[%s] OK (DoH) - rtt: %dms", name, xrtt)
+		dlog.Infof("[%s] OK (DoT) - rtt: %dms", name, xrtt)
+	}
+	return ServerInfo{
+		Proto:        stamps.StampProtoTypeTLS,
+		Name:         name,
+		Timeout:      proxy.timeout,
+		HostName:     stamp.ProviderName,
+		initialRtt:   xrtt,
+		dotTransport: dotTransport,
+	}, nil
+}
+
+func fetchDoQServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isNew bool) (ServerInfo, error) {
+	doqTransport := NewDoQTransport(proxy, name, stamp.ProviderName, stamp.ServerAddrStr, stamp.Hashes)
+	tls, err := doqTransport.Probe(proxy.showCerts)
+	if err != nil {
+		dlog.Infof("[%s] [%s]: %v", name, stamp.ProviderName, err)
+		return ServerInfo{}, err
+	}
+	dlog.Infof("[%s] TLS version: %x - Cipher suite: %v", name, tls.Version, tls.CipherSuite)
+	if _, err := doqTransport.Exchange(dohTestPacket(0xcafe), proxy.timeout); err != nil {
+		return ServerInfo{}, err
+	}
+	start := time.Now()
+	serverResponse, err := doqTransport.Exchange(dohNXTestPacket(0xcafe), proxy.timeout)
+	rtt := time.Since(start)
+	if err != nil {
+		dlog.Infof("[%s] [%s]: %v", name, stamp.ProviderName, err)
+		return ServerInfo{}, err
+	}
+	msg := dns.Msg{}
+	if err := msg.Unpack(serverResponse); err != nil {
+		dlog.Warnf("[%s]: %v", name, err)
+		return ServerInfo{}, err
+	}
+	if msg.Rcode != dns.RcodeNameError {
+		dlog.Criticalf("[%s] may be a lying resolver", name)
+	}
+	xrtt := int(rtt.Nanoseconds() / 1000000)
+	if isNew {
+		dlog.Noticef("[%s] OK (DoQ) - rtt: %dms", name, xrtt)
+	} else {
+		dlog.Infof("[%s] OK (DoQ) - rtt: %dms", name, xrtt)
+	}
+	return ServerInfo{
+		Proto:        StampProtoTypeDoQ,
+		Name:         name,
+		Timeout:      proxy.timeout,
+		HostName:     stamp.ProviderName,
+		initialRtt:   xrtt,
+		doqTransport: doqTransport,
+	}, nil
+}
+
+func fetchODoHTargetInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isNew bool) (ServerInfo, error) {
+	targetURL := &url.URL{
+		Scheme: "https",
+		Host:   stamp.ProviderName,
+		Path:   stamp.Path,
+	}
+	configURL := &url.URL{
+		Scheme: "https",
+		Host:   stamp.ProviderName,
+		Path:   ODoHConfigsPath,
+	}
+	httpTransport := proxy.xTransport.serverTransport(name, DOHClientCreds{})
+	configs, _, _, err := httpTransport.Get(configURL, "", proxy.timeout)
+	if err != nil {
+		dlog.Infof("[%s] [%s]: %v", name, configURL, err)
+		return ServerInfo{}, err
+	}
+	targetConfigs, err := ParseODoHTargetConfigs(configs)
+	if err != nil {
+		dlog.Warnf("[%s]: %v", name, err)
+		return ServerInfo{}, err
+	}
+	relayStamp, err := routeStamp(proxy, name, StampProtoTypeODoHRelay)
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	var relayURL *url.URL
+	queryURL := targetURL
+	if relayStamp != nil {
+		if len(relayStamp.ServerAddrStr) > 0 {
+			ipOnly, _ := ExtractHostAndPort(relayStamp.ServerAddrStr, -1)
+			if ip := ParseIP(ipOnly); ip != nil {
+				proxy.xTransport.saveCachedIP(relayStamp.ProviderName, ip, -1*time.Second)
+			}
+		}
+		relayURL = odohRelayURL(&url.URL{
+			Scheme: "https",
+			Host:   relayStamp.ProviderName,
+			Path:   relayStamp.Path,
+		}, targetURL)
+		queryURL = relayURL
+	} else {
+		dlog.Warnf("[%s] is an ODoH target, but no ODoH relay has been configured -- Queries will not be anonymized", name)
+	}
+	if includesName(proxy.xTransport.http3ServerNames, name) {
+		proxy.xTransport.enableHTTP3(queryURL.Host)
+	}
+	if _, _, _, err := httpTransport.ODoHQuery(&targetConfigs[0], queryURL, dohTestPacket(0), proxy.timeout); err != nil {
+		dlog.Infof("[%s] [%s]: %v", name, queryURL, err)
+		return ServerInfo{}, err
+	}
+	serverResponse, tls, rtt, err := httpTransport.ODoHQuery(&targetConfigs[0], queryURL, dohNXTestPacket(0), proxy.timeout)
+	if err != nil {
+		dlog.Infof("[%s] [%s]: %v", name, queryURL, err)
+		return ServerInfo{}, err
+	}
+	if tls == nil || !tls.HandshakeComplete {
+		return ServerInfo{}, errors.New("TLS handshake failed")
+	}
+	if relayStamp != nil {
+		if err := checkCertHashes(name, relayStamp.Hashes, tls, proxy.showCerts); err != nil {
+			return ServerInfo{}, err
+		}
+	}
+	msg := dns.Msg{}
+	if err := msg.Unpack(serverResponse); err != nil {
+		dlog.Warnf("[%s]: %v", name, err)
+		return ServerInfo{}, err
+	}
+	if msg.Rcode != dns.RcodeNameError {
+		dlog.Criticalf("[%s] may be a lying resolver", name)
+	}
+	xrtt := int(rtt.Nanoseconds() / 1000000)
+	if isNew {
+		dlog.Noticef("[%s] OK (ODoH) - rtt: %dms", name, xrtt)
+	} else {
+		dlog.Infof("[%s] OK (ODoH) - rtt: %dms", name, xrtt)
 	}
 	return ServerInfo{
-		Proto:      stamps.StampProtoTypeDoH,
-		Name:       name,
-		Timeout:    proxy.timeout,
-		URL:        url,
-		HostName:   stamp.ProviderName,
-		initialRtt: xrtt,
-		useGet:     useGet,
+		Proto:             StampProtoTypeODoHTarget,
+		Name:              name,
+		Timeout:           proxy.timeout,
+		URL:               targetURL,
+		HostName:          stamp.ProviderName,
+		initialRtt:        xrtt,
+		odohTargetConfigs: targetConfigs,
+		odohRelayURL:      relayURL,
+		httpTransport:     httpTransport,
 	}, nil
 }
 
 func (serverInfo *ServerInfo) noticeFailure(proxy *Proxy) {
+	proxy.metrics.countServerFailure(serverInfo.Name)
 	proxy.serversInfo.Lock()
 	serverInfo.rtt.Add(float64(proxy.timeout.Nanoseconds() / 1000000))
 	proxy.serversInfo.Unlock()
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/VividCortex/ewma"
+	"github.com/powerman/check"
+)
+
+func TestGetServersRace(t *testing.T) {
+	c := check.T(t)
+	serversInfo := NewServersInfo()
+	serversInfo.lbStrategy = LBStrategyRace{count: 2}
+	serversInfo.lbEstimator = false
+	for i := 0; i < 5; i++ {
+		serverInfo := &ServerInfo{Name: fmt.Sprintf("server%d", i), rtt: ewma.NewMovingAverage(RTTEwmaDecay)}
+		serverInfo.rtt.Set(float64(50 - 10*i))
+		serversInfo.inner = append(serversInfo.inner, serverInfo)
+	}
+
+	raced := make(map[string]int)
+	for i := 0; i < 100*LBRaceExploreInterval; i++ {
+		serverInfos := serversInfo.getServers(nil, nil)
+		c.Must(c.Len(serverInfos, 2))
+		c.Equal(serverInfos[0].Name, "server4", "The fastest server must always be raced")
+		raced[serverInfos[1].Name]++
+	}
+	c.Zero(raced["server4"])
+	c.True(raced["server3"] > raced["server2"]+raced["server1"]+raced["server0"])
+	c.True(raced["server2"] > 0, "Slower servers must be raced occasionally")
+	c.True(raced["server0"] > 0, "Slower servers must be raced occasionally")
+
+	serverInfos := serversInfo.getServers([]string{"server0", "server1"}, nil)
+	c.Len(serverInfos, 2)
+	serverInfos = serversInfo.getServers(nil, []string{"server1", "server2", "server3", "server4"})
+	c.Must(c.Len(serverInfos, 1))
+	c.Equal(serverInfos[0].Name, "server0")
+}
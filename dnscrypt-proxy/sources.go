@@ -282,7 +282,7 @@ func (source *Source) parseV2(prefix string) ([]RegisteredServer, error) {
 		var stamp dnsstamps.ServerStamp
 		var err error
 		for _, stampStr = range stampStrs {
-			stamp, err = dnsstamps.NewServerStampFromString(stampStr)
+			stamp, err = ParseServerStamp(stampStr)
 			if err == nil {
 				break
 			}
@@ -294,7 +294,7 @@ func (source *Source) parseV2(prefix string) ([]RegisteredServer, error) {
 		registeredServer := RegisteredServer{
 			name: name, stamp: stamp, description: description,
 		}
-		dlog.Debugf("Registered [%s] with stamp [%s]", name, stamp.String())
+		dlog.Debugf("Registered [%s] with stamp [%s]", name, ServerStampString(&stamp))
 		registeredServers = append(registeredServers, registeredServer)
 	}
 	if len(stampErrs) > 0 {
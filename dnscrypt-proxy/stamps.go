@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	stamps "github.com/jedisct1/go-dnsstamps"
+)
+
+const (
+	DefaultDoTPort = 853
+	DefaultDoQPort = 853
+
+	StampProtoTypeDoQ        = stamps.StampProtoType(0x04)
+	StampProtoTypeODoHTarget = stamps.StampProtoType(0x05)
+	StampProtoTypeODoHRelay  = stamps.StampProtoType(0x85)
+)
+
+// ParseServerStamp parses a server stamp, including protocols that the go-dnsstamps package doesn't handle yet.
+func ParseServerStamp(stampStr string) (stamps.ServerStamp, error) {
+	stamp, err := stamps.NewServerStampFromString(stampStr)
+	if err == nil {
+		return stamp, nil
+	}
+	if !strings.HasPrefix(stampStr, "sdns:") {
+		return stamp, err
+	}
+	bin, err2 := base64.RawURLEncoding.Strict().DecodeString(strings.TrimPrefix(stampStr[5:], "//"))
+	if err2 != nil || len(bin) < 1 {
+		return stamp, err
+	}
+	switch stamps.StampProtoType(bin[0]) {
+	case stamps.StampProtoTypeTLS:
+		return newDoTServerStamp(bin)
+	case StampProtoTypeDoQ:
+		return newDoQServerStamp(bin)
+	case StampProtoTypeODoHTarget:
+		return newODoHTargetStamp(bin)
+	case StampProtoTypeODoHRelay:
+		return newODoHRelayStamp(bin)
+	}
+	return stamp, err
+}
+
+type stampReader struct {
+	bin []byte
+	pos int
+}
+
+func (reader *stampReader) lp() (string, error) {
+	if reader.pos >= len(reader.bin) {
+		return "", errors.New("Invalid stamp")
+	}
+	length := int(reader.bin[reader.pos])
+	if length > len(reader.bin)-reader.pos-1 {
+		return "", errors.New("Invalid stamp")
+	}
+	reader.pos++
+	str := string(reader.bin[reader.pos : reader.pos+length])
+	reader.pos += length
+	return str, nil
+}
+
+func (reader *stampReader) vlp() ([][]uint8, error) {
+	var values [][]uint8
+	for {
+		if reader.pos >= len(reader.bin) {
+			return nil, errors.New("Invalid stamp")
+		}
+		vlen := int(reader.bin[reader.pos])
+		length := vlen & ^0x80
+		if length > len(reader.bin)-reader.pos-1 {
+			return nil, errors.New("Invalid stamp")
+		}
+		reader.pos++
+		if length > 0 {
+			values = append(values, reader.bin[reader.pos:reader.pos+length])
+		}
+		reader.pos += length
+		if vlen&0x80 != 0x80 {
+			break
+		}
+	}
+	return values, nil
+}
+
+func normalizeStampAddr(addrStr string, defaultPort int) (string, error) {
+	if len(addrStr) == 0 {
+		return addrStr, nil
+	}
+	colIndex := strings.LastIndex(addrStr, ":")
+	bracketIndex := strings.LastIndex(addrStr, "]")
+	if colIndex < bracketIndex {
+		colIndex = -1
+	}
+	if colIndex < 0 {
+		colIndex = len(addrStr)
+		addrStr = fmt.Sprintf("%s:%d", addrStr, defaultPort)
+	}
+	if colIndex >= len(addrStr)-1 {
+		return addrStr, errors.New("Invalid stamp (empty port)")
+	}
+	if _, err := strconv.ParseUint(addrStr[colIndex+1:], 10, 16); err != nil {
+		return addrStr, errors.New("Invalid stamp (port range)")
+	}
+	if ParseIP(addrStr[:colIndex]) == nil {
+		return addrStr, errors.New("Invalid stamp (IP address)")
+	}
+	return addrStr, nil
+}
+
+// id(u8)=0x03 props addrLen(1) serverAddr hashLen(1) hash providerNameLen(1) providerName
+
+func newDoTServerStamp(bin []byte) (stamps.ServerStamp, error) {
+	return newTLSServerStamp(bin, stamps.StampProtoTypeTLS, DefaultDoTPort)
+}
+
+// id(u8)=0x04 props addrLen(1) serverAddr hashLen(1) hash providerNameLen(1) providerName
+
+func newDoQServerStamp(bin []byte) (stamps.ServerStamp, error) {
+	return newTLSServerStamp(bin, StampProtoTypeDoQ, DefaultDoQPort)
+}
+
+func newTLSServerStamp(bin []byte, proto stamps.StampProtoType, defaultPort int) (stamps.ServerStamp, error) {
+	stamp := stamps.ServerStamp{Proto: proto}
+	if len(bin) < 12 {
+		return stamp, errors.New("Stamp is too short")
+	}
+	stamp.Props = stamps.ServerInformalProperties(binary.LittleEndian.Uint64(bin[1:9]))
+	reader := stampReader{bin: bin, pos: 9}
+	var err error
+	if stamp.ServerAddrStr, err = reader.lp(); err != nil {
+		return stamp, err
+	}
+	if stamp.Hashes, err = reader.vlp(); err != nil {
+		return stamp, err
+	}
+	if stamp.ProviderName, err = reader.lp(); err != nil {
+		return stamp, err
+	}
+	if reader.pos != len(bin) {
+		return stamp, errors.New("Invalid stamp (garbage after end)")
+	}
+	if len(stamp.ProviderName) == 0 {
+		return stamp, errors.New("Invalid stamp (missing host name)")
+	}
+	stamp.ServerAddrStr, err = normalizeStampAddr(stamp.ServerAddrStr, defaultPort)
+	return stamp, err
+}
+
+// id(u8)=0x05 props hostNameLen(1) hostName pathLen(1) path
+
+func newODoHTargetStamp(bin []byte) (stamps.ServerStamp, error) {
+	stamp := stamps.ServerStamp{Proto: StampProtoTypeODoHTarget}
+	if len(bin) < 12 {
+		return stamp, errors.New("Stamp is too short")
+	}
+	stamp.Props = stamps.ServerInformalProperties(binary.LittleEndian.Uint64(bin[1:9]))
+	reader := stampReader{bin: bin, pos: 9}
+	var err error
+	if stamp.ProviderName, err = reader.lp(); err != nil {
+		return stamp, err
+	}
+	if stamp.Path, err = reader.lp(); err != nil {
+		return stamp, err
+	}
+	if reader.pos != len(bin) {
+		return stamp, errors.New("Invalid stamp (garbage after end)")
+	}
+	if len(stamp.ProviderName) == 0 {
+		return stamp, errors.New("Invalid stamp (missing host name)")
+	}
+	return stamp, nil
+}
+
+// id(u8)=0x85 props addrLen(1) serverAddr hashLen(1) hash hostNameLen(1) hostName pathLen(1) path [bootstrapIPs]
+
+func newODoHRelayStamp(bin []byte) (stamps.ServerStamp, error) {
+	stamp := stamps.ServerStamp{Proto: StampProtoTypeODoHRelay}
+	if len(bin) < 13 {
+		return stamp, errors.New("Stamp is too short")
+	}
+	stamp.Props = stamps.ServerInformalProperties(binary.LittleEndian.Uint64(bin[1:9]))
+	reader := stampReader{bin: bin, pos: 9}
+	var err error
+	if stamp.ServerAddrStr, err = reader.lp(); err != nil {
+		return stamp, err
+	}
+	if stamp.Hashes, err = reader.vlp(); err != nil {
+		return stamp, err
+	}
+	if stamp.ProviderName, err = reader.lp(); err != nil {
+		return stamp, err
+	}
+	if stamp.Path, err = reader.lp(); err != nil {
+		return stamp, err
+	}
+	if reader.pos < len(bin) {
+		// Bootstrap IP addresses are not used
+		if _, err = reader.vlp(); err != nil {
+			return stamp, err
+		}
+	}
+	if reader.pos != len(bin) {
+		return stamp, errors.New("Invalid stamp (garbage after end)")
+	}
+	if len(stamp.ProviderName) == 0 {
+		return stamp, errors.New("Invalid stamp (missing host name)")
+	}
+	stamp.ServerAddrStr, err = normalizeStampAddr(stamp.ServerAddrStr, stamps.DefaultPort)
+	return stamp, err
+}
+
+func appendStampLP(bin []byte, str string) []byte {
+	bin = append(bin, uint8(len(str)))
+	return append(bin, []uint8(str)...)
+}
+
+func appendStampVLP(bin []byte, values [][]uint8) []byte {
+	if len(values) == 0 {
+		return append(bin, 0)
+	}
+	last := len(values) - 1
+	for i, value := range values {
+		vlen := len(value)
+		if i < last {
+			vlen |= 0x80
+		}
+		bin = append(bin, uint8(vlen))
+		bin = append(bin, value...)
+	}
+	return bin
+}
+
+func stripDefaultPort(addrStr string, defaultPort int) string {
+	return strings.TrimSuffix(addrStr, ":"+strconv.Itoa(defaultPort))
+}
+
+// ServerStampString is a replacement for stamp.String() that doesn't panic on protocols unknown to go-dnsstamps.
+func ServerStampString(stamp *stamps.ServerStamp) string {
+	bin := make([]uint8, 9)
+	bin[0] = uint8(stamp.Proto)
+	binary.LittleEndian.PutUint64(bin[1:9], uint64(stamp.Props))
+	switch stamp.Proto {
+	case stamps.StampProtoTypeTLS:
+		bin = appendStampLP(bin, stripDefaultPort(stamp.ServerAddrStr, DefaultDoTPort))
+		bin = appendStampVLP(bin, stamp.Hashes)
+		bin = appendStampLP(bin, stamp.ProviderName)
+	case StampProtoTypeDoQ:
+		bin = appendStampLP(bin, stripDefaultPort(stamp.ServerAddrStr, DefaultDoQPort))
+		bin = appendStampVLP(bin, stamp.Hashes)
+		bin = appendStampLP(bin, stamp.ProviderName)
+	case StampProtoTypeODoHTarget:
+		bin = appendStampLP(bin, stamp.ProviderName)
+		bin = appendStampLP(bin, stamp.Path)
+	case StampProtoTypeODoHRelay:
+		bin = appendStampLP(bin, stripDefaultPort(stamp.ServerAddrStr, stamps.DefaultPort))
+		bin = appendStampVLP(bin, stamp.Hashes)
+		bin = appendStampLP(bin, stamp.ProviderName)
+		bin = appendStampLP(bin, stamp.Path)
+	default:
+		return stamp.String()
+	}
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(bin)
+}
+
+// StampProtoString is a replacement for proto.String() that doesn't panic on protocols unknown to go-dnsstamps.
+func StampProtoString(proto stamps.StampProtoType) string {
+	switch proto {
+	case stamps.StampProtoTypeTLS:
+		return "DoT"
+	case StampProtoTypeDoQ:
+		return "DoQ"
+	case StampProtoTypeODoHTarget:
+		return "ODoH"
+	case StampProtoTypeODoHRelay:
+		return "ODoH relay"
+	case stamps.StampProtoTypePlain, stamps.StampProtoTypeDNSCrypt, stamps.StampProtoTypeDoH, stamps.StampProtoTypeDNSCryptRelay:
+		return proto.String()
+	}
+	return fmt.Sprintf("Unknown (%d)", proto)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	stamps "github.com/jedisct1/go-dnsstamps"
+	"github.com/powerman/check"
+)
+
+// stampsTestBin builds a stamp following the layout of the specification:
+// id(u8) props(u64 LE), then a length-prefixed string for every part
+func stampsTestBin(proto stamps.StampProtoType, props stamps.ServerInformalProperties, parts ...[]byte) []byte {
+	bin := []byte{uint8(proto), uint8(props), 0, 0, 0, 0, 0, 0, 0}
+	for _, part := range parts {
+		bin = append(bin, part...)
+	}
+	return bin
+}
+
+func stampsTestLP(str string) []byte {
+	return append([]byte{uint8(len(str))}, str...)
+}
+
+func stampsTestString(bin []byte) string {
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(bin)
+}
+
+func TestServerStamps(t *testing.T) {
+	hash := bytes.Repeat([]byte{0xab}, 32)
+	otherHash := bytes.Repeat([]byte{0xcd}, 32)
+	hashes := append(append([]byte{0x80 | 32}, hash...), append([]byte{32}, otherHash...)...)
+	props := stamps.ServerInformalPropertyDNSSEC | stamps.ServerInformalPropertyNoLog | stamps.ServerInformalPropertyNoFilter
+
+	for _, tt := range []struct {
+		name      string
+		stamp     string
+		want      stamps.ServerStamp
+		canonical bool
+		optional  int // size of an optional trailing part
+	}{
+		{
+			name:      "DoT",
+			stamp:     stampsTestString(stampsTestBin(stamps.StampProtoTypeTLS, props, stampsTestLP("1.1.1.1"), append([]byte{32}, hash...), stampsTestLP("cloudflare-dns.com"))),
+			want:      stamps.ServerStamp{Proto: stamps.StampProtoTypeTLS, Props: props, ServerAddrStr: "1.1.1.1:853", Hashes: [][]uint8{hash}, ProviderName: "cloudflare-dns.com"},
+			canonical: true,
+		},
+		{
+			name:  "DoT with an explicit default port",
+			stamp: stampsTestString(stampsTestBin(stamps.StampProtoTypeTLS, 0, stampsTestLP("1.1.1.1:853"), []byte{0}, stampsTestLP("cloudflare-dns.com"))),
+			want:  stamps.ServerStamp{Proto: stamps.StampProtoTypeTLS, ServerAddrStr: "1.1.1.1:853", ProviderName: "cloudflare-dns.com"},
+		},
+		{
+			name:      "DoT without an address",
+			stamp:     stampsTestString(stampsTestBin(stamps.StampProtoTypeTLS, 0, []byte{0}, []byte{0}, stampsTestLP("dns.example.com:8853"))),
+			want:      stamps.ServerStamp{Proto: stamps.StampProtoTypeTLS, ProviderName: "dns.example.com:8853"},
+			canonical: true,
+		},
+		{
+			name:      "DoQ",
+			stamp:     stampsTestString(stampsTestBin(StampProtoTypeDoQ, stamps.ServerInformalPropertyNoLog, stampsTestLP("[2606:4700::1111]:8853"), hashes, stampsTestLP("dns.example.com"))),
+			want:      stamps.ServerStamp{Proto: StampProtoTypeDoQ, Props: stamps.ServerInformalPropertyNoLog, ServerAddrStr: "[2606:4700::1111]:8853", Hashes: [][]uint8{hash, otherHash}, ProviderName: "dns.example.com"},
+			canonical: true,
+		},
+		{
+			name:      "DoQ IPv6 with the default port",
+			stamp:     stampsTestString(stampsTestBin(StampProtoTypeDoQ, 0, stampsTestLP("[2606:4700::1111]"), []byte{0}, stampsTestLP("dns.example.com"))),
+			want:      stamps.ServerStamp{Proto: StampProtoTypeDoQ, ServerAddrStr: "[2606:4700::1111]:853", ProviderName: "dns.example.com"},
+			canonical: true,
+		},
+		{
+			name:      "ODoH target",
+			stamp:     "sdns://BQcAAAAAAAAAF29kb2guY2xvdWRmbGFyZS1kbnMuY29tCi9kbnMtcXVlcnk",
+			want:      stamps.ServerStamp{Proto: StampProtoTypeODoHTarget, Props: props, ProviderName: "odoh.cloudflare-dns.com", Path: "/dns-query"},
+			canonical: true,
+		},
+		{
+			name:      "ODoH relay",
+			stamp:     "sdns://hQcAAAAAAAAAAAAab2RvaC1yZWxheS5lZGdlY29tcHV0ZS5hcHABLw",
+			want:      stamps.ServerStamp{Proto: StampProtoTypeODoHRelay, Props: props, ProviderName: "odoh-relay.edgecompute.app", Path: "/"},
+			canonical: true,
+		},
+		{
+			name:      "ODoH relay with an address and hashes",
+			stamp:     stampsTestString(stampsTestBin(StampProtoTypeODoHRelay, 0, stampsTestLP("192.0.2.1:4443"), hashes, stampsTestLP("relay.example.com"), stampsTestLP("/proxy"))),
+			want:      stamps.ServerStamp{Proto: StampProtoTypeODoHRelay, ServerAddrStr: "192.0.2.1:4443", Hashes: [][]uint8{hash, otherHash}, ProviderName: "relay.example.com", Path: "/proxy"},
+			canonical: true,
+		},
+		{
+			name:     "ODoH relay with bootstrap addresses",
+			stamp:    stampsTestString(stampsTestBin(StampProtoTypeODoHRelay, 0, stampsTestLP("192.0.2.1"), []byte{0}, stampsTestLP("relay.example.com"), stampsTestLP("/proxy"), stampsTestLP("192.0.2.53"))),
+			want:     stamps.ServerStamp{Proto: StampProtoTypeODoHRelay, ServerAddrStr: "192.0.2.1:443", ProviderName: "relay.example.com", Path: "/proxy"},
+			optional: len(stampsTestLP("192.0.2.53")),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := check.T(t)
+			stamp, err := ParseServerStamp(tt.stamp)
+			c.Must(c.Nil(err))
+			c.DeepEqual(stamp, tt.want)
+			stampStr := ServerStampString(&stamp)
+			if tt.canonical {
+				c.Equal(stampStr, tt.stamp)
+			}
+			stamp2, err := ParseServerStamp(stampStr)
+			c.Nil(err)
+			c.DeepEqual(stamp2, stamp)
+			c.NotEqual(StampProtoString(stamp.Proto), "")
+
+			// Every truncation of a valid stamp must be rejected
+			bin, err := base64.RawURLEncoding.DecodeString(tt.stamp[len("sdns://"):])
+			c.Must(c.Nil(err))
+			for i := 1; i < len(bin); i++ {
+				if i == len(bin)-tt.optional {
+					continue
+				}
+				_, err := ParseServerStamp(stampsTestString(bin[:i]))
+				c.NotNil(err, "Truncated to %d bytes", i)
+			}
+			// Two extra bytes, as an ODoH relay stamp may end with an empty list of bootstrap addresses
+			_, err = ParseServerStamp(stampsTestString(append(bin, 0, 0)))
+			c.NotNil(err, "Garbage after end")
+		})
+	}
+
+	for _, tt := range []struct {
+		name  string
+		stamp string
+		err   string
+	}{
+		{"missing host name", stampsTestString(stampsTestBin(stamps.StampProtoTypeTLS, 0, stampsTestLP("1.1.1.1"), []byte{0}, []byte{0})), "missing host name"},
+		{"host name instead of an IP", stampsTestString(stampsTestBin(StampProtoTypeDoQ, 0, stampsTestLP("dns.example.com"), []byte{0}, stampsTestLP("dns.example.com"))), "IP address"},
+		{"empty port", stampsTestString(stampsTestBin(StampProtoTypeDoQ, 0, stampsTestLP("192.0.2.1:"), []byte{0}, stampsTestLP("dns.example.com"))), "empty port"},
+		{"port out of range", stampsTestString(stampsTestBin(stamps.StampProtoTypeTLS, 0, stampsTestLP("192.0.2.1:65536"), []byte{0}, stampsTestLP("dns.example.com"))), "port range"},
+		{"hash length past the end", stampsTestString(stampsTestBin(stamps.StampProtoTypeTLS, 0, stampsTestLP("192.0.2.1"), []byte{0x80 | 32}, hash, stampsTestLP("dns.example.com"))), "Invalid stamp"},
+		{"ODoH target without host name", stampsTestString(stampsTestBin(StampProtoTypeODoHTarget, 0, []byte{0}, stampsTestLP("/dns-query"))), "missing host name"},
+		{"ODoH relay without host name", stampsTestString(stampsTestBin(StampProtoTypeODoHRelay, 0, []byte{0}, []byte{0}, []byte{0}, stampsTestLP("/"))), "missing host name"},
+		{"unknown protocol", stampsTestString(stampsTestBin(stamps.StampProtoType(0x42), 0, stampsTestLP("dns.example.com"))), "Unsupported stamp"},
+		{"invalid base64", "sdns://BQcAAAAAAAAAF29kb2gu!", "illegal base64"},
+		{"empty", "sdns://", "too short"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := check.T(t)
+			_, err := ParseServerStamp(tt.stamp)
+			c.Match(err, tt.err)
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	UDPPoolSize          = 4
+	UDPSocketMaxAge      = 5 * time.Minute
+	UDPSocketMaxAgeDelta = 2 * time.Minute
+)
+
+// DNSCrypt queries to a server or relay are sent over a small pool of long-lived UDP sockets.
+// Responses are matched with queries using the client nonce, which the server copies into the
+// first half of the response nonce. Sockets are replaced after a random delay, so that the
+// source port doesn't identify the proxy for longer than a few minutes.
+
+type udpSocket struct {
+	conn       *net.UDPConn
+	expiration time.Time
+	pending    map[[HalfNonceSize]byte]chan []byte
+	inFlight   int
+	retired    bool
+}
+
+type UDPSocketPool struct {
+	sync.Mutex
+	upstreamAddr *net.UDPAddr
+	sockets      [UDPPoolSize]*udpSocket
+	next         int
+}
+
+type UDPSocketPools struct {
+	sync.Mutex
+	pools map[string]*UDPSocketPool
+}
+
+func NewUDPSocketPools() *UDPSocketPools {
+	return &UDPSocketPools{pools: make(map[string]*UDPSocketPool)}
+}
+
+func (udpSocketPools *UDPSocketPools) get(upstreamAddr *net.UDPAddr) *UDPSocketPool {
+	key := upstreamAddr.String()
+	udpSocketPools.Lock()
+	defer udpSocketPools.Unlock()
+	pool, ok := udpSocketPools.pools[key]
+	if !ok {
+		pool = &UDPSocketPool{upstreamAddr: upstreamAddr}
+		udpSocketPools.pools[key] = pool
+	}
+	return pool
+}
+
+func (pool *UDPSocketPool) newSocket() (*udpSocket, error) {
+	conn, err := net.DialUDP("udp", nil, pool.upstreamAddr)
+	if err != nil {
+		return nil, err
+	}
+	socket := &udpSocket{
+		conn:       conn,
+		expiration: time.Now().Add(UDPSocketMaxAge + time.Duration(rand.Int63n(int64(UDPSocketMaxAgeDelta)))),
+		pending:    make(map[[HalfNonceSize]byte]chan []byte),
+	}
+	go pool.receive(socket)
+	return socket, nil
+}
+
+// receive dispatches the responses received on a socket, until the socket is closed
+func (pool *UDPSocketPool) receive(socket *udpSocket) {
+	serverMagicLen := len(ServerMagic)
+	buffer := make([]byte, MaxDNSPacketSize)
+	for {
+		length, err := socket.conn.Read(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			dlog.Debugf("[%v] %v", pool.upstreamAddr, err)
+			continue
+		}
+		if length < serverMagicLen+HalfNonceSize || !bytes.Equal(buffer[:serverMagicLen], ServerMagic[:]) {
+			continue
+		}
+		var clientNonce [HalfNonceSize]byte
+		copy(clientNonce[:], buffer[serverMagicLen:])
+		pool.Lock()
+		responseCh, ok := socket.pending[clientNonce]
+		if ok {
+			delete(socket.pending, clientNonce)
+		}
+		pool.Unlock()
+		if !ok {
+			dlog.Debugf("[%v] Unexpected response, possibly received after a timeout", pool.upstreamAddr)
+			continue
+		}
+		responseCh <- append([]byte{}, buffer[:length]...)
+	}
+}
+
+// acquire registers a query on one of the sockets, replacing the next socket if it has expired
+func (pool *UDPSocketPool) acquire(clientNonce [HalfNonceSize]byte) (*udpSocket, chan []byte, error) {
+	pool.Lock()
+	defer pool.Unlock()
+	index := pool.next
+	pool.next = (pool.next + 1) % UDPPoolSize
+	socket := pool.sockets[index]
+	if socket == nil || time.Now().After(socket.expiration) {
+		newSocket, err := pool.newSocket()
+		if err != nil {
+			return nil, nil, err
+		}
+		if socket != nil {
+			socket.retired = true
+			if socket.inFlight == 0 {
+				socket.conn.Close()
+			}
+		}
+		socket = newSocket
+		pool.sockets[index] = socket
+	}
+	if _, ok := socket.pending[clientNonce]; ok {
+		return nil, nil, errors.New("Duplicate client nonce")
+	}
+	responseCh := make(chan []byte, 1)
+	socket.pending[clientNonce] = responseCh
+	socket.inFlight++
+	return socket, responseCh, nil
+}
+
+func (pool *UDPSocketPool) release(socket *udpSocket, clientNonce [HalfNonceSize]byte) {
+	pool.Lock()
+	delete(socket.pending, clientNonce)
+	socket.inFlight--
+	if socket.retired && socket.inFlight == 0 {
+		socket.conn.Close()
+	}
+	pool.Unlock()
+}
+
+// Exchange sends an encrypted query, and returns the encrypted response matching the client nonce.
+// The query is sent again once if no response has been received after half of the timeout.
+func (pool *UDPSocketPool) Exchange(encryptedQuery []byte, clientNonce []byte, timeout time.Duration) ([]byte, error) {
+	var nonce [HalfNonceSize]byte
+	copy(nonce[:], clientNonce)
+	socket, responseCh, err := pool.acquire(nonce)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.release(socket, nonce)
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	retry := time.NewTimer(timeout / 2)
+	defer retry.Stop()
+	if _, err := socket.conn.Write(encryptedQuery); err != nil {
+		return nil, err
+	}
+	for {
+		select {
+		case encryptedResponse := <-responseCh:
+			return encryptedResponse, nil
+		case <-retry.C:
+			dlog.Debugf("[%v] Retry on timeout", pool.upstreamAddr)
+			if _, err := socket.conn.Write(encryptedQuery); err != nil {
+				return nil, err
+			}
+		case <-deadline.C:
+			return nil, &net.OpError{Op: "read", Net: "udp", Addr: pool.upstreamAddr, Err: dotTimeoutError{}}
+		}
+	}
+}
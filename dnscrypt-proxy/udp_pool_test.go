@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+)
+
+// udpPoolTestServer answers queries made of a client nonce followed by a payload, the way a
+// DNSCrypt server copies the client nonce into its response. answer is called for every
+// received query, and returns the packets to send back.
+type udpPoolTestServer struct {
+	conn    *net.UDPConn
+	lock    sync.Mutex
+	queries int
+}
+
+func newUDPPoolTestServer(t *testing.T, answer func(query []byte) [][]byte) *udpPoolTestServer {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	server := &udpPoolTestServer{conn: conn}
+	go func() {
+		buffer := make([]byte, MaxDNSPacketSize)
+		for {
+			length, clientAddr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			server.lock.Lock()
+			server.queries++
+			server.lock.Unlock()
+			query := append([]byte{}, buffer[:length]...)
+			go func() {
+				for _, packet := range answer(query) {
+					_, _ = conn.WriteToUDP(packet, clientAddr)
+				}
+			}()
+		}
+	}()
+	return server
+}
+
+func (server *udpPoolTestServer) queriesCount() int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.queries
+}
+
+func udpPoolTestEcho(query []byte) []byte {
+	return append(append([]byte{}, ServerMagic[:]...), query...)
+}
+
+func udpPoolTestQuery(i int) ([]byte, []byte) {
+	nonce := make([]byte, HalfNonceSize)
+	copy(nonce, fmt.Sprintf("nonce%d", i))
+	return append(append([]byte{}, nonce...), fmt.Sprintf("query%d", i)...), nonce
+}
+
+func TestUDPSocketPoolConcurrentQueries(t *testing.T) {
+	c := check.T(t)
+	server := newUDPPoolTestServer(t, func(query []byte) [][]byte {
+		return [][]byte{udpPoolTestEcho(query)}
+	})
+	pool := NewUDPSocketPools().get(server.conn.LocalAddr().(*net.UDPAddr))
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			query, nonce := udpPoolTestQuery(i)
+			response, err := pool.Exchange(query, nonce, 5*time.Second)
+			if err == nil && !bytes.Equal(response, udpPoolTestEcho(query)) {
+				err = fmt.Errorf("Query %d got a response to another query", i)
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Nil(err)
+	}
+	for _, socket := range pool.sockets {
+		c.Must(c.NotNil(socket))
+		c.Len(socket.pending, 0)
+		c.Zero(socket.inFlight)
+	}
+}
+
+func TestUDPSocketPoolUnexpectedResponses(t *testing.T) {
+	c := check.T(t)
+	server := newUDPPoolTestServer(t, func(query []byte) [][]byte {
+		unknownNonce, _ := udpPoolTestQuery(-1)
+		return [][]byte{
+			[]byte("not a DNSCrypt response"),
+			ServerMagic[:4],
+			udpPoolTestEcho(unknownNonce),
+			udpPoolTestEcho(query),
+		}
+	})
+	pool := NewUDPSocketPools().get(server.conn.LocalAddr().(*net.UDPAddr))
+	for i := 0; i < 2*UDPPoolSize; i++ {
+		query, nonce := udpPoolTestQuery(i)
+		response, err := pool.Exchange(query, nonce, 5*time.Second)
+		c.Nil(err)
+		c.DeepEqual(response, udpPoolTestEcho(query))
+	}
+
+	query, nonce := udpPoolTestQuery(0)
+	socket, _, err := pool.acquire([HalfNonceSize]byte(nonce))
+	c.Must(c.Nil(err))
+	pool.next = (pool.next + UDPPoolSize - 1) % UDPPoolSize
+	_, err = pool.Exchange(query, nonce, 5*time.Second)
+	c.Match(err, "Duplicate client nonce")
+	pool.release(socket, [HalfNonceSize]byte(nonce))
+}
+
+func TestUDPSocketPoolRotation(t *testing.T) {
+	c := check.T(t)
+	slow, _ := udpPoolTestQuery(-1)
+	release := make(chan struct{})
+	server := newUDPPoolTestServer(t, func(query []byte) [][]byte {
+		if bytes.HasPrefix(query, slow) {
+			<-release
+		}
+		return [][]byte{udpPoolTestEcho(query)}
+	})
+	pool := NewUDPSocketPools().get(server.conn.LocalAddr().(*net.UDPAddr))
+
+	slowQuery := append(append([]byte{}, slow...), "slow"...)
+	slowResponse := make(chan error, 1)
+	go func() {
+		response, err := pool.Exchange(slowQuery, slow, 5*time.Second)
+		if err == nil && !bytes.Equal(response, udpPoolTestEcho(slowQuery)) {
+			err = errors.New("Unexpected response")
+		}
+		slowResponse <- err
+	}()
+	for server.queriesCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	pool.Lock()
+	oldSocket := pool.sockets[0]
+	for _, socket := range pool.sockets {
+		if socket != nil {
+			socket.expiration = time.Now().Add(-time.Second)
+		}
+	}
+	pool.Unlock()
+
+	// Every socket is replaced, while the slow query is still waiting on the old one
+	for i := 0; i < UDPPoolSize; i++ {
+		query, nonce := udpPoolTestQuery(i)
+		response, err := pool.Exchange(query, nonce, 5*time.Second)
+		c.Nil(err)
+		c.DeepEqual(response, udpPoolTestEcho(query))
+	}
+	pool.Lock()
+	c.NotEqual(pool.sockets[0], oldSocket)
+	c.True(oldSocket.retired)
+	c.Equal(oldSocket.inFlight, 1)
+	pool.Unlock()
+
+	close(release)
+	c.Nil(<-slowResponse)
+	pool.Lock()
+	c.Zero(oldSocket.inFlight)
+	pool.Unlock()
+	_, err := oldSocket.conn.Write(slowQuery)
+	c.True(errors.Is(err, net.ErrClosed), "The retired socket must be closed once its queries are done")
+}
+
+func TestUDPSocketPoolTimeout(t *testing.T) {
+	c := check.T(t)
+	server := newUDPPoolTestServer(t, func(query []byte) [][]byte {
+		return nil
+	})
+	pool := NewUDPSocketPools().get(server.conn.LocalAddr().(*net.UDPAddr))
+	query, nonce := udpPoolTestQuery(0)
+	start := time.Now()
+	_, err := pool.Exchange(query, nonce, 200*time.Millisecond)
+	c.Must(c.NotNil(err))
+	var netErr net.Error
+	c.True(errors.As(err, &netErr) && netErr.Timeout())
+	c.True(time.Since(start) >= 200*time.Millisecond)
+	c.Equal(server.queriesCount(), 2, "The query must be sent again after half of the timeout")
+
+	// The query has been released, so that its nonce can be used again
+	for _, socket := range pool.sockets {
+		if socket != nil {
+			c.Len(socket.pending, 0)
+			c.Zero(socket.inFlight)
+		}
+	}
+	_, err = pool.Exchange(query, nonce, 100*time.Millisecond)
+	c.True(errors.As(err, &netErr) && netErr.Timeout())
+}
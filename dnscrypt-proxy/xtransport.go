@@ -23,6 +23,8 @@
 	"github.com/jedisct1/dlog"
 	stamps "github.com/jedisct1/go-dnsstamps"
 	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
 	"golang.org/x/net/http2"
 	netproxy "golang.org/x/net/proxy"
 )
@@ -34,6 +36,8 @@
 	SystemResolverIPTTL     = 24 * time.Hour
 	MinResolverIPTTL        = 12 * time.Hour
 	ExpiredCachedIPGraceTTL = 15 * time.Minute
+	DefaultAltSvcMaxAge     = 24 * time.Hour
+	HTTP3RetryDelay         = 10 * time.Minute
 )
 
 type CachedIPItem struct {
@@ -46,8 +50,41 @@ type CachedIPs struct {
 	cache map[string]*CachedIPItem
 }
 
+// AltSupport remembers which servers can be reached over HTTP/3, either because they
+// advertised it using an Alt-Svc header, or because HTTP/3 was enabled for them.
+// Items are keyed by the host name and port of the original URL.
+
+type AltSupportItem struct {
+	port       int
+	expiration *time.Time
+	retryAfter time.Time
+}
+
+type AltSupport struct {
+	sync.RWMutex
+	cache     map[string]*AltSupportItem
+	protocols map[string]string
+}
+
+// An HTTPTransport holds the connections to a DoH or ODoH server, so that servers don't
+// share connection pools, client certificates, cipher suites or TLS sessions.
+// The XTransport has its own HTTPTransport, for everything else such as downloading sources.
+
+type HTTPTransport struct {
+	xTransport     *XTransport
+	creds          DOHClientCreds
+	tlsCipherSuite []uint16
+	transport      *http.Transport
+	h3Transport    *http3.Transport
+}
+
 type XTransport struct {
-	transport                *http.Transport
+	httpTransport            *HTTPTransport
+	serverTransports         map[string]*HTTPTransport
+	serverTransportsLock     sync.Mutex
+	http3                    bool
+	http3ServerNames         []string
+	altSupport               AltSupport
 	keepAlive                time.Duration
 	timeout                  time.Duration
 	cachedIPs                CachedIPs
@@ -60,7 +97,7 @@ type XTransport struct {
 	tlsCipherSuite           []uint16
 	proxyDialer              *netproxy.Dialer
 	httpProxyFunction        func(*http.Request) (*url.URL, error)
-	tlsClientCreds           DOHClientCreds
+	encryptedBootstrap       func(host string) (net.IP, time.Duration, error)
 }
 
 func NewXTransport() *XTransport {
@@ -69,6 +106,8 @@ func NewXTransport() *XTransport {
 	}
 	xTransport := XTransport{
 		cachedIPs:                CachedIPs{cache: make(map[string]*CachedIPItem)},
+		serverTransports:         make(map[string]*HTTPTransport),
+		altSupport:               AltSupport{cache: make(map[string]*AltSupportItem), protocols: make(map[string]string)},
 		keepAlive:                DefaultKeepAlive,
 		timeout:                  DefaultTimeout,
 		fallbackResolvers:        []string{DefaultFallbackResolver},
@@ -118,11 +157,174 @@ func (xTransport *XTransport) loadCachedIP(host string) (ip net.IP, expired bool
 	return
 }
 
+// pinnedIP returns the address of a host if it never expires, because it was part of a stamp
+func (xTransport *XTransport) pinnedIP(host string) net.IP {
+	xTransport.cachedIPs.RLock()
+	item, ok := xTransport.cachedIPs.cache[host]
+	xTransport.cachedIPs.RUnlock()
+	if !ok || item.expiration != nil {
+		return nil
+	}
+	return item.ip
+}
+
+func altSupportKey(hostAndPort string) string {
+	host, port := ExtractHostAndPort(hostAndPort, stamps.DefaultPort)
+	return net.JoinHostPort(strings.TrimRight(strings.TrimLeft(host, "["), "]"), strconv.Itoa(port))
+}
+
+// enableHTTP3 makes queries to a server use HTTP/3 right away, on the same port as the URL
+func (xTransport *XTransport) enableHTTP3(hostAndPort string) {
+	key := altSupportKey(hostAndPort)
+	_, port := ExtractHostAndPort(key, stamps.DefaultPort)
+	xTransport.altSupport.Lock()
+	if item, ok := xTransport.altSupport.cache[key]; !ok || item.expiration != nil {
+		xTransport.altSupport.cache[key] = &AltSupportItem{port: port}
+	}
+	xTransport.altSupport.Unlock()
+}
+
+// http3Port returns the UDP port to reach a server over HTTP/3, or 0 if HTTP/2 should be used
+func (xTransport *XTransport) http3Port(hostAndPort string) int {
+	key := altSupportKey(hostAndPort)
+	xTransport.altSupport.RLock()
+	item, ok := xTransport.altSupport.cache[key]
+	xTransport.altSupport.RUnlock()
+	if !ok {
+		return 0
+	}
+	now := time.Now()
+	if now.Before(item.retryAfter) || (item.expiration != nil && now.After(*item.expiration)) {
+		return 0
+	}
+	return item.port
+}
+
+// noticeAltSvc records the HTTP/3 endpoint advertised by a server, such as `h3=":443"; ma=86400`.
+// HTTPS records are not looked up, as miekg/dns doesn't parse SVCB parameters yet.
+func (xTransport *XTransport) noticeAltSvc(hostAndPort string, altSvc string) {
+	if !xTransport.http3 || len(altSvc) == 0 {
+		return
+	}
+	key := altSupportKey(hostAndPort)
+	if strings.TrimSpace(altSvc) == "clear" {
+		xTransport.altSupport.Lock()
+		if item, ok := xTransport.altSupport.cache[key]; ok && item.expiration != nil {
+			delete(xTransport.altSupport.cache, key)
+		}
+		xTransport.altSupport.Unlock()
+		return
+	}
+	for _, alternative := range strings.Split(altSvc, ",") {
+		params := strings.Split(alternative, ";")
+		protoAndAuthority := strings.SplitN(strings.TrimSpace(params[0]), "=", 2)
+		if len(protoAndAuthority) != 2 || protoAndAuthority[0] != http3.NextProtoH3 {
+			continue
+		}
+		authority := strings.Trim(protoAndAuthority[1], `"`)
+		// Alternative hosts would require a different certificate and IP address
+		if !strings.HasPrefix(authority, ":") {
+			continue
+		}
+		port, err := strconv.Atoi(authority[1:])
+		if err != nil || port <= 0 || port > 65535 {
+			continue
+		}
+		maxAge := DefaultAltSvcMaxAge
+		for _, param := range params[1:] {
+			nameAndValue := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(nameAndValue) == 2 && nameAndValue[0] == "ma" {
+				if seconds, err := strconv.ParseUint(nameAndValue[1], 10, 32); err == nil {
+					maxAge = time.Duration(seconds) * time.Second
+				}
+			}
+		}
+		expiration := time.Now().Add(maxAge)
+		xTransport.altSupport.Lock()
+		item, ok := xTransport.altSupport.cache[key]
+		if !ok {
+			dlog.Infof("[%s] advertises HTTP/3 support on port %d", key, port)
+			xTransport.altSupport.cache[key] = &AltSupportItem{port: port, expiration: &expiration}
+		} else if item.expiration != nil {
+			item.port, item.expiration = port, &expiration
+		}
+		xTransport.altSupport.Unlock()
+		return
+	}
+}
+
+// noticeHTTP3Failure makes queries to a server use HTTP/2 for a while, for example if UDP is blocked
+func (xTransport *XTransport) noticeHTTP3Failure(hostAndPort string, err error) {
+	key := altSupportKey(hostAndPort)
+	xTransport.altSupport.Lock()
+	if item, ok := xTransport.altSupport.cache[key]; ok {
+		item.retryAfter = time.Now().Add(HTTP3RetryDelay)
+	}
+	xTransport.altSupport.Unlock()
+	dlog.Noticef("[%s] HTTP/3 failed (%v) - Falling back to HTTP/2 for %v", key, err, HTTP3RetryDelay)
+}
+
+func (xTransport *XTransport) noticeProtocol(hostAndPort string, protocol string) {
+	key := altSupportKey(hostAndPort)
+	xTransport.altSupport.Lock()
+	xTransport.altSupport.protocols[key] = protocol
+	xTransport.altSupport.Unlock()
+}
+
+// negotiatedProtocol returns the HTTP version used by the latest successful query to a server
+func (xTransport *XTransport) negotiatedProtocol(hostAndPort string) string {
+	key := altSupportKey(hostAndPort)
+	xTransport.altSupport.RLock()
+	protocol := xTransport.altSupport.protocols[key]
+	xTransport.altSupport.RUnlock()
+	return protocol
+}
+
 func (xTransport *XTransport) rebuildTransport() {
-	dlog.Debug("Rebuilding transport")
-	if xTransport.transport != nil {
-		(*xTransport.transport).CloseIdleConnections()
+	if xTransport.httpTransport != nil {
+		xTransport.httpTransport.close()
+	}
+	xTransport.httpTransport = xTransport.newHTTPTransport(DOHClientCreds{})
+}
+
+// serverTransport returns the HTTPTransport of a server, creating it on first use
+func (xTransport *XTransport) serverTransport(name string, creds DOHClientCreds) *HTTPTransport {
+	xTransport.serverTransportsLock.Lock()
+	defer xTransport.serverTransportsLock.Unlock()
+	httpTransport, ok := xTransport.serverTransports[name]
+	if !ok {
+		httpTransport = xTransport.newHTTPTransport(creds)
+		xTransport.serverTransports[name] = httpTransport
+	}
+	return httpTransport
+}
+
+func (xTransport *XTransport) newHTTPTransport(creds DOHClientCreds) *HTTPTransport {
+	httpTransport := &HTTPTransport{
+		xTransport:     xTransport,
+		creds:          creds,
+		tlsCipherSuite: xTransport.tlsCipherSuite,
 	}
+	if creds.cipherSuite != nil {
+		httpTransport.tlsCipherSuite = creds.cipherSuite
+	}
+	httpTransport.rebuild()
+	return httpTransport
+}
+
+func (httpTransport *HTTPTransport) close() {
+	if httpTransport.transport != nil {
+		httpTransport.transport.CloseIdleConnections()
+	}
+	if httpTransport.h3Transport != nil {
+		httpTransport.h3Transport.Close()
+	}
+}
+
+func (httpTransport *HTTPTransport) rebuild() {
+	dlog.Debug("Rebuilding transport")
+	httpTransport.close()
+	xTransport := httpTransport.xTransport
 	timeout := xTransport.timeout
 	transport := &http.Transport{
 		DisableKeepAlives:      false,
@@ -158,40 +360,75 @@ func (xTransport *XTransport) rebuildTransport() {
 	if xTransport.httpProxyFunction != nil {
 		transport.Proxy = xTransport.httpProxyFunction
 	}
-	tlsClientConfig := tls.Config{}
-	clientCreds := xTransport.tlsClientCreds
-	if (clientCreds != DOHClientCreds{}) {
+	tlsClientConfig := tls.Config{ServerName: httpTransport.creds.serverName}
+	clientCreds := httpTransport.creds
+	if len(clientCreds.clientCert) > 0 {
 		cert, err := tls.LoadX509KeyPair(clientCreds.clientCert, clientCreds.clientKey)
 		if err != nil {
 			dlog.Fatalf("Unable to use certificate [%v] (Key: [%v]): %v", clientCreds.clientCert, clientCreds.clientKey, err)
 		}
-		if clientCreds.rootCA != "" {
-			caCert, err := ioutil.ReadFile(clientCreds.rootCA)
-			if err != nil {
-				dlog.Fatal(err)
-			}
-			systemCertPool, err := x509.SystemCertPool()
-			if err != nil {
-				dlog.Fatal(err)
-			}
-			systemCertPool.AppendCertsFromPEM(caCert)
-			tlsClientConfig.RootCAs = systemCertPool
-		}
 		tlsClientConfig.Certificates = []tls.Certificate{cert}
 	}
-	if xTransport.tlsDisableSessionTickets || xTransport.tlsCipherSuite != nil {
-		tlsClientConfig.SessionTicketsDisabled = xTransport.tlsDisableSessionTickets
-		if !xTransport.tlsDisableSessionTickets {
-			tlsClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(10)
+	if clientCreds.rootCA != "" {
+		caCert, err := ioutil.ReadFile(clientCreds.rootCA)
+		if err != nil {
+			dlog.Fatal(err)
 		}
-		if xTransport.tlsCipherSuite != nil {
-			tlsClientConfig.PreferServerCipherSuites = false
-			tlsClientConfig.CipherSuites = xTransport.tlsCipherSuite
+		systemCertPool, err := x509.SystemCertPool()
+		if err != nil {
+			dlog.Fatal(err)
 		}
+		systemCertPool.AppendCertsFromPEM(caCert)
+		tlsClientConfig.RootCAs = systemCertPool
+	}
+	tlsClientConfig.SessionTicketsDisabled = xTransport.tlsDisableSessionTickets
+	if !xTransport.tlsDisableSessionTickets {
+		tlsClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(10)
+	}
+	if httpTransport.tlsCipherSuite != nil {
+		tlsClientConfig.PreferServerCipherSuites = false
+		tlsClientConfig.CipherSuites = httpTransport.tlsCipherSuite
 	}
 	transport.TLSClientConfig = &tlsClientConfig
 	http2.ConfigureTransport(transport)
-	xTransport.transport = transport
+	httpTransport.transport = transport
+	httpTransport.h3Transport = nil
+	if !xTransport.http3 && len(xTransport.http3ServerNames) == 0 {
+		return
+	}
+	if xTransport.proxyDialer != nil || xTransport.httpProxyFunction != nil {
+		dlog.Notice("HTTP/3 cannot be used through a proxy - Using HTTP/2 instead")
+		return
+	}
+	httpTransport.h3Transport = xTransport.newH3Transport(&tlsClientConfig)
+}
+
+func (xTransport *XTransport) newH3Transport(tlsClientConfig *tls.Config) *http3.Transport {
+	timeout := xTransport.timeout
+	return &http3.Transport{
+		TLSClientConfig:        tlsClientConfig.Clone(),
+		DisableCompression:     true,
+		MaxResponseHeaderBytes: 4096,
+		QUICConfig: &quic.Config{
+			HandshakeIdleTimeout: timeout / 2,
+			MaxIdleTimeout:       xTransport.keepAlive + timeout,
+		},
+		Dial: func(ctx context.Context, addrStr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+			host, _ := ExtractHostAndPort(addrStr, stamps.DefaultPort)
+			port := xTransport.http3Port(addrStr)
+			if port <= 0 {
+				return nil, errors.New("HTTP/3 is not enabled for [" + host + "]")
+			}
+			ipOnly := host
+			cachedIP, _ := xTransport.loadCachedIP(host)
+			if cachedIP != nil {
+				ipOnly = cachedIP.String()
+			} else {
+				dlog.Debugf("[%s] IP address was not cached", host)
+			}
+			return quic.DialAddrEarly(ctx, net.JoinHostPort(strings.TrimRight(strings.TrimLeft(ipOnly, "["), "]"), strconv.Itoa(port)), tlsCfg, cfg)
+		},
+	}
 }
 
 func (xTransport *XTransport) resolveUsingSystem(host string) (ip net.IP, ttl time.Duration, err error) {
@@ -294,6 +531,15 @@ func (xTransport *XTransport) resolveAndUpdateCache(host string) error {
 	if cachedIP != nil && !expired {
 		return nil
 	}
+	if xTransport.encryptedBootstrap != nil {
+		ip, ttl, err := xTransport.encryptedBootstrap(host)
+		if err == nil {
+			xTransport.saveCachedIP(host, ip, ttl)
+			dlog.Debugf("[%s] IP address [%s] added to the cache, valid for %v", host, ip, ttl)
+			return nil
+		}
+		dlog.Warnf("Unable to resolve [%s] using encrypted servers (%v) - Falling back to cleartext resolution", host, err)
+	}
 	var foundIP net.IP
 	var ttl time.Duration
 	var err error
@@ -338,11 +584,11 @@ func (xTransport *XTransport) resolveAndUpdateCache(host string) error {
 	return nil
 }
 
-func (xTransport *XTransport) Fetch(method string, url *url.URL, accept string, contentType string, body *[]byte, timeout time.Duration) ([]byte, *tls.ConnectionState, time.Duration, error) {
+func (httpTransport *HTTPTransport) Fetch(method string, url *url.URL, accept string, contentType string, body *[]byte, timeout time.Duration) ([]byte, *tls.ConnectionState, time.Duration, error) {
+	xTransport := httpTransport.xTransport
 	if timeout <= 0 {
 		timeout = xTransport.timeout
 	}
-	client := http.Client{Transport: xTransport.transport, Timeout: timeout}
 	header := map[string][]string{"User-Agent": {"dnscrypt-proxy"}}
 	if len(accept) > 0 {
 		header["Accept"] = []string{accept}
@@ -367,18 +613,39 @@ func (xTransport *XTransport) Fetch(method string, url *url.URL, accept string,
 		dlog.Errorf("Unable to resolve [%v] - Make sure that the system resolver works, or that `fallback_resolver` has been set to a resolver that can be reached", host)
 		return nil, nil, 0, err
 	}
-	req := &http.Request{
-		Method: method,
-		URL:    url,
-		Header: header,
-		Close:  false,
-	}
-	if body != nil {
-		req.ContentLength = int64(len(*body))
-		req.Body = ioutil.NopCloser(bytes.NewReader(*body))
+	newRequest := func() *http.Request {
+		req := &http.Request{
+			Method: method,
+			URL:    url,
+			Header: header,
+			Close:  false,
+		}
+		if body != nil {
+			req.ContentLength = int64(len(*body))
+			req.Body = ioutil.NopCloser(bytes.NewReader(*body))
+		}
+		return req
 	}
+	req := newRequest()
 	start := time.Now()
-	resp, err := client.Do(req)
+	var resp *http.Response
+	var err error
+	if h3Transport := httpTransport.h3Transport; h3Transport != nil && xTransport.http3Port(url.Host) > 0 {
+		// Leave enough time to retry over HTTP/2 if UDP is blocked
+		client := http.Client{Transport: h3Transport, Timeout: timeout / 2}
+		resp, err = client.Do(req)
+		if err != nil {
+			xTransport.noticeHTTP3Failure(url.Host, err)
+			if remaining := timeout - time.Since(start); remaining > 0 {
+				client := http.Client{Transport: httpTransport.transport, Timeout: remaining}
+				req = newRequest()
+				resp, err = client.Do(req)
+			}
+		}
+	} else {
+		client := http.Client{Transport: httpTransport.transport, Timeout: timeout}
+		resp, err = client.Do(req)
+	}
 	rtt := time.Since(start)
 	if err == nil {
 		if resp == nil {
@@ -387,17 +654,26 @@ func (xTransport *XTransport) Fetch(method string, url *url.URL, accept string,
 			err = errors.New(resp.Status)
 		}
 	} else {
-		(*xTransport.transport).CloseIdleConnections()
+		httpTransport.transport.CloseIdleConnections()
 	}
 	if err != nil {
 		dlog.Debugf("[%s]: [%s]", req.URL, err)
-		if xTransport.tlsCipherSuite != nil && strings.Contains(err.Error(), "handshake failure") {
+		if httpTransport.tlsCipherSuite != nil && strings.Contains(err.Error(), "handshake failure") {
 			dlog.Warnf("TLS handshake failure - Try changing or deleting the tls_cipher_suite value in the configuration file")
-			xTransport.tlsCipherSuite = nil
-			xTransport.rebuildTransport()
+			httpTransport.tlsCipherSuite = nil
+			httpTransport.rebuild()
 		}
 		return nil, nil, 0, err
 	}
+	switch resp.ProtoMajor {
+	case 3:
+		xTransport.noticeProtocol(url.Host, http3.NextProtoH3)
+	case 2:
+		xTransport.noticeProtocol(url.Host, "h2")
+	default:
+		xTransport.noticeProtocol(url.Host, "http/1.1")
+	}
+	xTransport.noticeAltSvc(url.Host, resp.Header.Get("Alt-Svc"))
 	tls := resp.TLS
 	bin, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxHTTPBodyLength))
 	if err != nil {
@@ -407,15 +683,15 @@ func (xTransport *XTransport) Fetch(method string, url *url.URL, accept string,
 	return bin, tls, rtt, err
 }
 
-func (xTransport *XTransport) Get(url *url.URL, accept string, timeout time.Duration) ([]byte, *tls.ConnectionState, time.Duration, error) {
-	return xTransport.Fetch("GET", url, accept, "", nil, timeout)
+func (httpTransport *HTTPTransport) Get(url *url.URL, accept string, timeout time.Duration) ([]byte, *tls.ConnectionState, time.Duration, error) {
+	return httpTransport.Fetch("GET", url, accept, "", nil, timeout)
 }
 
-func (xTransport *XTransport) Post(url *url.URL, accept string, contentType string, body *[]byte, timeout time.Duration) ([]byte, *tls.ConnectionState, time.Duration, error) {
-	return xTransport.Fetch("POST", url, accept, contentType, body, timeout)
+func (httpTransport *HTTPTransport) Post(url *url.URL, accept string, contentType string, body *[]byte, timeout time.Duration) ([]byte, *tls.ConnectionState, time.Duration, error) {
+	return httpTransport.Fetch("POST", url, accept, contentType, body, timeout)
 }
 
-func (xTransport *XTransport) DoHQuery(useGet bool, url *url.URL, body []byte, timeout time.Duration) ([]byte, *tls.ConnectionState, time.Duration, error) {
+func (httpTransport *HTTPTransport) DoHQuery(useGet bool, url *url.URL, body []byte, timeout time.Duration) ([]byte, *tls.ConnectionState, time.Duration, error) {
 	dataType := "application/dns-message"
 	if useGet {
 		qs := url.Query()
@@ -423,7 +699,11 @@ func (xTransport *XTransport) DoHQuery(useGet bool, url *url.URL, body []byte, t
 		qs.Add("dns", encBody)
 		url2 := *url
 		url2.RawQuery = qs.Encode()
-		return xTransport.Get(&url2, dataType, timeout)
+		return httpTransport.Get(&url2, dataType, timeout)
 	}
-	return xTransport.Post(url, dataType, dataType, &body, timeout)
+	return httpTransport.Post(url, dataType, dataType, &body, timeout)
+}
+
+func (xTransport *XTransport) Get(url *url.URL, accept string, timeout time.Duration) ([]byte, *tls.ConnectionState, time.Duration, error) {
+	return xTransport.httpTransport.Get(url, accept, timeout)
 }